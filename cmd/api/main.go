@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 
@@ -9,6 +10,7 @@ import (
 	"baas/internal/auth"
 	"baas/internal/db"
 	"baas/internal/realtime"
+	"baas/internal/storage"
 
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
@@ -29,14 +31,29 @@ func main() {
 	}
 	defer db.Close()
 
+	// Bring existing project schemas up to date
+	if err := admin.MigrateProjects(context.Background()); err != nil {
+		log.Printf("Could not migrate project schemas: %v", err)
+	}
+
+	// Object storage backend
+	storage.Setup()
+
 	// Initialize Fiber App
 	app := fiber.New(fiber.Config{
 		AppName: "Hanbase",
+		// Request bodies are limited per route (see storage.BodyLimit)
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
 	})
 
 	// Middleware
 	app.Use(logger.New())
-	app.Use(cors.New())
+	app.Use(storage.BodyLimit())
+	app.Use(cors.New(cors.Config{
+		// Lets the dashboard cancel SQL editor queries (see api.RunSQLHandler)
+		ExposeHeaders: "X-Query-Id",
+	}))
 
 	// Routes
 	app.Get("/", func(c *fiber.Ctx) error {
@@ -46,6 +63,9 @@ func main() {
 		})
 	})
 
+	// Realtime change source status (registered before /:project/:table)
+	app.Get("/realtime/health", realtime.HealthHandler)
+
 	// Auth Routes (Platform)
 	app.Post("/auth/signup", auth.SignUpHandler)
 	app.Post("/auth/signin", auth.SignInHandler)
@@ -54,12 +74,14 @@ func main() {
 	// Admin / Project Management
 	app.Post("/projects", auth.Protected(), admin.CreateProjectHandler)
 	app.Get("/projects", auth.Protected(), admin.GetProjectsHandler)
-	app.Delete("/projects/:slug", auth.Protected(), admin.DeleteProjectHandler)
+	app.Delete("/projects/:project", auth.Protected(), auth.RequireProjectRole("owner"), admin.DeleteProjectHandler)
 
 	// Admin / SQL Editor Route
 	// This allows the Dashboard to run "CREATE TABLE", "ALTER TABLE" etc.
-	// SECURED: Basic Protected (Platform Admin) for now.
-	app.Post("/query", auth.Protected(), api.RunSQLHandler)
+	// SECURED: Project members, executed as the project's own database role.
+	// Members with the "viewer" role can only run read-only queries.
+	app.Post("/:project/query", auth.Protected(), auth.RequireProjectRole(), api.RunSQLHandler)
+	app.Post("/:project/query/:id/cancel", auth.Protected(), auth.RequireProjectRole(), api.CancelSQLHandler)
 
 	// Metadata Routes (For Table Editor)
 	// SECURED: Tenant Protected (Project Access)
@@ -69,12 +91,28 @@ func main() {
 	// Admin / User Management Routes (For Dashboard)
 	// Note: Ideally these should be protected by Platform Admin token, but targeting a specific project
 	// For simplicity, we use Protected() (Platform Admin) since Dashboard uses Platform Token.
-	app.Get("/:project/auth/users", auth.Protected(), auth.ListUsersHandler)
-	app.Delete("/:project/auth/users/:id", auth.Protected(), auth.DeleteUserHandler)
+	app.Get("/:project/auth/users", auth.Protected(), auth.RequireProjectRole("owner"), auth.ListUsersHandler)
+	app.Post("/:project/auth/users", auth.Protected(), auth.RequireProjectRole("owner"), auth.CreateUserHandler)
+	app.Patch("/:project/auth/users/:id", auth.Protected(), auth.RequireProjectRole("owner"), auth.AdminUpdateUserHandler)
+	app.Delete("/:project/auth/users/:id", auth.Protected(), auth.RequireProjectRole("owner"), auth.DeleteUserHandler)
+	app.Post("/:project/auth/users/:id/impersonate", auth.Protected(), auth.RequireProjectRole("owner"), auth.ImpersonateUserHandler)
+	app.Get("/:project/auth/settings", auth.Protected(), auth.RequireProjectRole("owner"), auth.GetSettingsHandler)
+	app.Put("/:project/auth/settings", auth.Protected(), auth.RequireProjectRole("owner"), auth.UpdateSettingsHandler)
+	app.Get("/:project/auth/audit", auth.Protected(), auth.RequireProjectRole("owner"), auth.ListAuditLogHandler)
+	app.Get("/:project/auth/hooks", auth.Protected(), auth.RequireProjectRole("owner"), auth.ListHooksHandler)
+	app.Post("/:project/auth/hooks", auth.Protected(), auth.RequireProjectRole("owner"), auth.CreateHookHandler)
+	app.Delete("/:project/auth/hooks/:id", auth.Protected(), auth.RequireProjectRole("owner"), auth.DeleteHookHandler)
 
 	// Tenant Auth Routes (For End-Users)
 	app.Post("/:project/auth/signup", auth.TenantSignUp)
 	app.Post("/:project/auth/signin", auth.TenantSignIn)
+	app.Post("/:project/auth/anonymous", auth.AnonymousSignIn)
+	app.Post("/:project/auth/token", auth.RefreshTokenHandler)
+	app.Post("/:project/auth/logout", auth.TenantProtected(), auth.LogoutHandler)
+	app.Get("/:project/auth/verify", auth.VerifyHandler)
+	app.Post("/:project/auth/verify", auth.VerifyHandler)
+	app.Get("/:project/auth/user", auth.TenantProtected(), auth.GetUserHandler)
+	app.Put("/:project/auth/user", auth.TenantProtected(), auth.UpdateUserHandler)
 
 	// Dynamic Routes: /:project/:table
 	// Note: Project should technically be mapped to a Schema name.
@@ -83,10 +121,72 @@ func main() {
 	app.All("/:project/:table", auth.TenantProtected(), api.DynamicHandler)
 
 	// Realtime Hub Start
+	// Cluster mode shares broadcasts and presence between API instances
+	if os.Getenv("REALTIME_CLUSTER") == "true" {
+		realtime.MainHub.EnableCluster()
+	}
 	go realtime.MainHub.Run()
-	go realtime.ListenToPostgres()
+	// Change source: "notify" (LISTEN/NOTIFY, default) or "replication"
+	// (logical replication slot, requires wal_level=logical)
+	if os.Getenv("REALTIME_SOURCE") == "replication" {
+		go realtime.ListenToReplication()
+	} else {
+		go realtime.ListenToPostgres()
+	}
 
 	// Realtime Routes
+	// Enabling realtime per table (For Dashboard)
+	app.Get("/:project/realtime/tables", auth.Protected(), auth.RequireProjectRole("owner"), realtime.ListRealtimeTablesHandler)
+	app.Put("/:project/realtime/tables/:table", auth.Protected(), auth.RequireProjectRole("owner"), realtime.SetRealtimeTableHandler)
+	// Server-Sent Events transport (authenticates like the WebSocket endpoint)
+	app.Get("/:project/realtime/sse", realtime.SSEHandler)
+	// Channel authorization rules (Project owners)
+	app.Get("/:project/realtime/rules", auth.Protected(), auth.RequireProjectRole("owner"), realtime.ListChannelRulesHandler)
+	app.Post("/:project/realtime/rules", auth.Protected(), auth.RequireProjectRole("owner"), realtime.CreateChannelRuleHandler)
+	app.Delete("/:project/realtime/rules/:id", auth.Protected(), auth.RequireProjectRole("owner"), realtime.DeleteChannelRuleHandler)
+
+	// Storage Routes
+	// Buckets: listing for project users, management for platform admins
+	app.Get("/:project/storage/v1/bucket", auth.TenantProtected(), storage.ListBucketsHandler)
+	app.Get("/:project/storage/v1/bucket/:bucket", auth.TenantProtected(), storage.GetBucketHandler)
+	app.Post("/:project/storage/v1/bucket", auth.Protected(), auth.RequireProjectRole("owner"), storage.CreateBucketHandler)
+	app.Put("/:project/storage/v1/bucket/:bucket", auth.Protected(), auth.RequireProjectRole("owner"), storage.UpdateBucketHandler)
+	app.Delete("/:project/storage/v1/bucket/:bucket", auth.Protected(), auth.RequireProjectRole("owner"), storage.DeleteBucketHandler)
+	app.Post("/:project/storage/v1/bucket/:bucket/empty", auth.Protected(), auth.RequireProjectRole("owner"), storage.EmptyBucketHandler)
+	// Objects (the fixed prefixes are registered before /object/:bucket/*)
+	app.Get("/:project/storage/v1/object/public/:bucket/*", storage.PublicDownloadHandler)
+	// Signed URLs: created by users with access, used without a token
+	app.Post("/:project/storage/v1/object/sign/:bucket/*", auth.TenantProtected(), storage.CreateSignedURLHandler)
+	app.Get("/:project/storage/v1/object/sign/:bucket/*", storage.SignedDownloadHandler)
+	app.Post("/:project/storage/v1/object/upload/sign/:bucket/*", auth.TenantProtected(), storage.CreateSignedUploadURLHandler)
+	app.Put("/:project/storage/v1/object/upload/sign/:bucket/*", storage.SignedUploadHandler)
+	app.Get("/:project/storage/v1/object/info/:bucket/*", auth.TenantProtected(), storage.ObjectInfoHandler)
+	app.Post("/:project/storage/v1/object/list/:bucket", auth.TenantProtected(), storage.ListObjectsHandler)
+	app.Post("/:project/storage/v1/object/move", auth.TenantProtected(), storage.MoveObjectHandler)
+	app.Post("/:project/storage/v1/object/copy", auth.TenantProtected(), storage.CopyObjectHandler)
+	app.Post("/:project/storage/v1/object/:bucket/*", auth.TenantProtected(), storage.UploadObjectHandler)
+	app.Put("/:project/storage/v1/object/:bucket/*", auth.TenantProtected(), storage.UploadObjectHandler)
+	app.Get("/:project/storage/v1/object/:bucket/*", auth.TenantProtected(), storage.DownloadObjectHandler)
+	app.Delete("/:project/storage/v1/object/:bucket/*", auth.TenantProtected(), storage.DeleteObjectHandler)
+	// Resumable uploads (tus 1.0)
+	app.Options("/:project/storage/v1/upload/resumable", storage.TusOptionsHandler)
+	app.Options("/:project/storage/v1/upload/resumable/:id", storage.TusOptionsHandler)
+	app.Post("/:project/storage/v1/upload/resumable", auth.TenantProtected(), storage.TusCreateHandler)
+	app.Head("/:project/storage/v1/upload/resumable/:id", auth.TenantProtected(), storage.TusHeadHandler)
+	app.Patch("/:project/storage/v1/upload/resumable/:id", auth.TenantProtected(), storage.TusPatchHandler)
+	app.Delete("/:project/storage/v1/upload/resumable/:id", auth.TenantProtected(), storage.TusDeleteHandler)
+	// S3-compatible API (SigV4 with project access keys) and its keys (Project owners)
+	app.All("/:project/storage/v1/s3", storage.S3Auth(), storage.S3Handler)
+	app.All("/:project/storage/v1/s3/:bucket", storage.S3Auth(), storage.S3Handler)
+	app.All("/:project/storage/v1/s3/:bucket/*", storage.S3Auth(), storage.S3Handler)
+	app.Get("/:project/storage/v1/access-keys", auth.Protected(), auth.RequireProjectRole("owner"), storage.ListAccessKeysHandler)
+	app.Post("/:project/storage/v1/access-keys", auth.Protected(), auth.RequireProjectRole("owner"), storage.CreateAccessKeyHandler)
+	app.Delete("/:project/storage/v1/access-keys/:id", auth.Protected(), auth.RequireProjectRole("owner"), storage.DeleteAccessKeyHandler)
+	// Access policies for project users (Project owners)
+	app.Get("/:project/storage/v1/policies", auth.Protected(), auth.RequireProjectRole("owner"), storage.ListPoliciesHandler)
+	app.Post("/:project/storage/v1/policies", auth.Protected(), auth.RequireProjectRole("owner"), storage.CreatePolicyHandler)
+	app.Delete("/:project/storage/v1/policies/:id", auth.Protected(), auth.RequireProjectRole("owner"), storage.DeletePolicyHandler)
+
 	app.Use("/ws", func(c *fiber.Ctx) error {
 		if websocket.IsWebSocketUpgrade(c) {
 			c.Locals("allowed", true)
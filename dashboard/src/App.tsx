@@ -142,7 +142,7 @@ function App() {
                         </div>
                     )}
                     {activeTab === 'tables' && <div className="h-full p-6"><TableEditor token={token} projects={projects} selectedProjectSlug={selectedProject} onSelectProject={setSelectedProject} /></div>}
-                    {activeTab === 'sql' && <div className="h-full p-6"><SQLEditor token={token} /></div>}
+                    {activeTab === 'sql' && projects.length > 0 && <div className="h-full p-6"><SQLEditor token={token} project={selectedProject || projects[0]?.slug} /></div>}
                     {activeTab === 'auth' && projects.length > 0 && <div className="h-full p-6"><AuthManager token={token} project={selectedProject || projects[0]?.slug} /></div>}
                 </div>
             </div>
@@ -41,9 +41,9 @@ export function AuthManager({ token, project }: { token: string | null, project:
     const createUser = async (e: React.FormEvent) => {
         e.preventDefault()
         try {
-            const res = await fetch(`${API_URL}/${project}/auth/signup`, {
+            const res = await fetch(`${API_URL}/${project}/auth/users`, {
                 method: 'POST',
-                headers: { 'Content-Type': 'application/json' },
+                headers: { 'Content-Type': 'application/json', 'Authorization': `Bearer ${token}` },
                 body: JSON.stringify({ email: newUserEmail, password: newUserPass })
             })
             if (res.ok) {
@@ -52,7 +52,8 @@ export function AuthManager({ token, project }: { token: string | null, project:
                 setNewUserPass('')
                 fetchUsers()
             } else {
-                alert("Failed to create user")
+                const data = await res.json().catch(() => ({}))
+                alert(data.error || "Failed to create user")
             }
         } catch (e) { console.error(e) }
     }
@@ -56,7 +56,7 @@ export function CreateTableModal({ token, project, onClose, onSuccess }: {
             const query = `CREATE TABLE "${project}"."${tableName}" (\n  ${columnDefs}\n);`
             console.log("Executing SQL:", query) // Debugging
 
-            const res = await fetch(`${API_URL}/query`, {
+            const res = await fetch(`${API_URL}/${project}/query`, {
                 method: 'POST',
                 headers: {
                     'Content-Type': 'application/json',
@@ -66,7 +66,8 @@ export function CreateTableModal({ token, project, onClose, onSuccess }: {
             })
 
             const data = await res.json()
-            if (!res.ok) throw new Error(data.error || 'Failed to create table')
+            // SQL errors are reported in the body (see RunSQLHandler)
+            if (!res.ok || data.error) throw new Error(data.error || 'Failed to create table')
 
             onSuccess(tableName)
             onClose()
@@ -4,9 +4,12 @@ import { Play, RotateCw } from 'lucide-react'
 // Simple helper to fetch API
 const API_URL = 'http://localhost:8000'
 
-export function SQLEditor({ token }: { token: string | null }) {
-    const [query, setQuery] = useState('SELECT * FROM information_schema.tables;')
+export function SQLEditor({ token, project }: { token: string | null, project: string }) {
+    const [query, setQuery] = useState('SELECT * FROM information_schema.tables WHERE table_schema = current_schema();')
     const [results, setResults] = useState<any[]>([])
+    const [transaction, setTransaction] = useState(false)
+    const [readOnly, setReadOnly] = useState(false)
+    const [queryId, setQueryId] = useState<string | null>(null)
     const [loading, setLoading] = useState(false)
     const [error, setError] = useState('')
 
@@ -15,37 +18,63 @@ export function SQLEditor({ token }: { token: string | null }) {
         setError('')
         setResults([])
         try {
-            const res = await fetch(`${API_URL}/query`, {
+            const res = await fetch(`${API_URL}/${project}/query`, {
                 method: 'POST',
                 headers: {
                     'Content-Type': 'application/json',
                     'Authorization': `Bearer ${token}`
                 },
-                body: JSON.stringify({ query })
+                body: JSON.stringify({ query, transaction, read_only: readOnly })
             })
+            // The query ID arrives before the results, to allow cancelling
+            setQueryId(res.headers.get('X-Query-Id'))
             const data = await res.json()
-            if (!res.ok) throw new Error(data.error || 'Query failed')
-
-            if (Array.isArray(data)) {
-                setResults(data)
-            } else {
-                setResults([data]) // For non-SELECT commands that might return a message object
+            // Statements before a failing one still report their results
+            setResults(Array.isArray(data.results) ? data.results : [])
+            if (!res.ok || data.error) {
+                let message = data.error || 'Query failed'
+                if (data.failed_statement !== undefined) message = `Statement ${data.failed_statement + 1}: ${message}`
+                if (data.cancelled) message = 'Query cancelled'
+                if (data.rolled_back) message += ' (transaction rolled back)'
+                throw new Error(message)
             }
         } catch (err: any) {
             setError(err.message)
         } finally {
             setLoading(false)
+            setQueryId(null)
         }
     }
 
+    const cancelQuery = async () => {
+        if (!queryId) return
+        await fetch(`${API_URL}/${project}/query/${queryId}/cancel`, {
+            method: 'POST',
+            headers: { 'Authorization': `Bearer ${token}` }
+        })
+    }
+
     return (
         <div className="flex flex-col h-full gap-4 max-w-6xl mx-auto">
             <div className="flex items-center justify-between">
                 <div>
                     <h1 className="text-2xl font-semibold tracking-tight mb-1">SQL Editor</h1>
-                    <p className="text-muted-foreground text-sm">Run raw SQL queries against your database.</p>
+                    <p className="text-muted-foreground text-sm">Run raw SQL queries against the selected project's schema.</p>
                 </div>
-                <div className="flex gap-2">
+                <div className="flex gap-2 items-center">
+                    <label className="flex items-center gap-2 text-sm text-zinc-400 mr-2">
+                        <input type="checkbox" checked={transaction} onChange={(e) => setTransaction(e.target.checked)} />
+                        All or nothing
+                    </label>
+                    <label className="flex items-center gap-2 text-sm text-zinc-400 mr-2">
+                        <input type="checkbox" checked={readOnly} onChange={(e) => setReadOnly(e.target.checked)} />
+                        Read only
+                    </label>
+                    {queryId && (
+                        <button onClick={cancelQuery} className="flex items-center gap-2 border border-zinc-700 hover:bg-zinc-800 text-zinc-300 px-4 py-2 rounded-md font-medium text-sm transition-colors">
+                            Cancel
+                        </button>
+                    )}
                     <button onClick={runQuery} disabled={loading} className="flex items-center gap-2 bg-emerald-600 hover:bg-emerald-700 text-white px-4 py-2 rounded-md font-medium text-sm transition-colors shadow-lg shadow-emerald-900/20 disabled:opacity-50">
                         {loading ? <RotateCw className="animate-spin" size={16} /> : <Play size={16} />}
                         Run Query
@@ -74,26 +103,36 @@ export function SQLEditor({ token }: { token: string | null }) {
 
                     {results.length > 0 && (
                         <div className="overflow-auto flex-1">
-                            <table className="w-full text-left text-sm">
-                                <thead className="bg-zinc-950/50 sticky top-0">
-                                    <tr>
-                                        {Object.keys(results[0]).map((key) => (
-                                            <th key={key} className="px-4 py-3 font-medium text-zinc-400 border-b border-zinc-800 whitespace-nowrap">{key}</th>
-                                        ))}
-                                    </tr>
-                                </thead>
-                                <tbody>
-                                    {results.map((row, i) => (
-                                        <tr key={i} className="hover:bg-zinc-800/20 font-mono text-xs">
-                                            {Object.values(row).map((val: any, j) => (
-                                                <td key={j} className="px-4 py-2 border-b border-zinc-900/50 whitespace-nowrap text-zinc-300">
-                                                    {typeof val === 'object' ? JSON.stringify(val) : String(val)}
-                                                </td>
-                                            ))}
-                                        </tr>
-                                    ))}
-                                </tbody>
-                            </table>
+                            {results.map((result, r) => (
+                                <div key={r} className="border-b border-zinc-800">
+                                    <div className="px-4 py-2 text-xs text-zinc-500 font-mono bg-zinc-950/30">
+                                        {result.command} · {result.columns.length > 0 ? `${result.rows.length} rows` : `${result.rows_affected} rows affected`}
+                                        {result.truncated && ' (truncated)'}
+                                    </div>
+                                    {result.columns.length > 0 && (
+                                        <table className="w-full text-left text-sm">
+                                            <thead className="bg-zinc-950/50 sticky top-0">
+                                                <tr>
+                                                    {result.columns.map((col: any, i: number) => (
+                                                        <th key={i} title={col.type_name} className="px-4 py-3 font-medium text-zinc-400 border-b border-zinc-800 whitespace-nowrap">{col.name}</th>
+                                                    ))}
+                                                </tr>
+                                            </thead>
+                                            <tbody>
+                                                {result.rows.map((row: any[], i: number) => (
+                                                    <tr key={i} className="hover:bg-zinc-800/20 font-mono text-xs">
+                                                        {row.map((val: any, j: number) => (
+                                                            <td key={j} className="px-4 py-2 border-b border-zinc-900/50 whitespace-nowrap text-zinc-300">
+                                                                {typeof val === 'object' ? JSON.stringify(val) : String(val)}
+                                                            </td>
+                                                        ))}
+                                                    </tr>
+                                                ))}
+                                            </tbody>
+                                        </table>
+                                    )}
+                                </div>
+                            ))}
                         </div>
                     )}
 
@@ -80,14 +80,19 @@ export function TableEditor({ token, projects, selectedProjectSlug, onSelectProj
             setSchema(Array.isArray(schemaData) ? schemaData : [])
 
             // 2. Get Data via SQL (Admin)
-            const queryRes = await fetch(`${API_URL}/query`, {
+            const queryRes = await fetch(`${API_URL}/${selectedProjectSlug}/query`, {
                 method: 'POST',
                 headers: { 'Content-Type': 'application/json', 'Authorization': `Bearer ${token}` },
                 body: JSON.stringify({ query: `SELECT * FROM "${selectedProjectSlug}"."${selectedTable}" LIMIT 100` })
             })
 
-            const tableRows = await queryRes.json()
-            setData(Array.isArray(tableRows) ? tableRows : [])
+            const queryData = await queryRes.json()
+            const result = queryData.results?.[0]
+            // Rows come as arrays in column order
+            const tableRows = Array.isArray(result?.rows)
+                ? result.rows.map((row: any[]) => Object.fromEntries(result.columns.map((col: any, i: number) => [col.name, row[i]])))
+                : []
+            setData(tableRows)
 
         } catch (e) {
             console.error(e)
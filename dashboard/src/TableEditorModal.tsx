@@ -43,7 +43,7 @@ export function AddRowModal({ token, project, table, schema, onClose, onSuccess
 
             const query = `INSERT INTO "${project}"."${table}" (${cols.map(c => `"${c}"`).join(', ')}) VALUES (${vals.join(', ')})`
 
-            const res = await fetch(`${API_URL}/query`, {
+            const res = await fetch(`${API_URL}/${project}/query`, {
                 method: 'POST',
                 headers: {
                     'Content-Type': 'application/json',
@@ -53,7 +53,8 @@ export function AddRowModal({ token, project, table, schema, onClose, onSuccess
             })
 
             const data = await res.json()
-            if (!res.ok) throw new Error(data.error || 'Failed to insert')
+            // SQL errors are reported in the body (see RunSQLHandler)
+            if (!res.ok || data.error) throw new Error(data.error || 'Failed to insert')
 
             onSuccess()
             onClose()
@@ -35,14 +35,25 @@ func CreateProjectHandler(c *fiber.Ctx) error {
 	// Ensure slug is safe!
 	schemaName := req.Slug
 
-	_, err = tx.Exec(context.Background(),
-		"INSERT INTO baas_system.projects (name, slug, db_schema) VALUES ($1, $2, $3)",
-		req.Name, req.Slug, schemaName)
+	var projectID string
+	err = tx.QueryRow(context.Background(),
+		"INSERT INTO baas_system.projects (name, slug, db_schema) VALUES ($1, $2, $3) RETURNING id",
+		req.Name, req.Slug, schemaName).Scan(&projectID)
 
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Could not create project record: " + err.Error()})
 	}
 
+	// The creator owns the project
+	if userID, ok := c.Locals("user_id").(string); ok {
+		_, err = tx.Exec(context.Background(),
+			"INSERT INTO baas_system.project_members (project_id, user_id, role) VALUES ($1, $2, 'owner')",
+			projectID, userID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Could not add project owner: " + err.Error()})
+		}
+	}
+
 	// 2. Create the Schema in Postgres
 	// WARNING: In production, sanitize schemaName strictly!
 	_, err = tx.Exec(context.Background(), fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", schemaName))
@@ -50,19 +61,8 @@ func CreateProjectHandler(c *fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"error": "Could not create database schema: " + err.Error()})
 	}
 
-	// 3. Initialize Auth Logic for this Tenant (Create users table)
-	authTableSQL := fmt.Sprintf(`
-		CREATE TABLE IF NOT EXISTS %s.users (
-			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-			email TEXT NOT NULL UNIQUE,
-			password_hash TEXT NOT NULL,
-			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
-			updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
-		);
-	`, schemaName)
-
-	_, err = tx.Exec(context.Background(), authTableSQL)
-	if err != nil {
+	// 3. Initialize Auth Logic for this Tenant (Create users table etc.)
+	if err := provisionTenant(context.Background(), tx, schemaName); err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Could not create auth tables: " + err.Error()})
 	}
 
@@ -100,7 +100,7 @@ func GetProjectsHandler(c *fiber.Ctx) error {
 
 // DeleteProjectHandler deletes a project and its schema
 func DeleteProjectHandler(c *fiber.Ctx) error {
-	slug := c.Params("slug")
+	slug := c.Params("project")
 	if !isValidSlug(slug) {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid slug"})
 	}
@@ -111,7 +111,12 @@ func DeleteProjectHandler(c *fiber.Ctx) error {
 	}
 	defer tx.Rollback(context.Background())
 
-	// 1. Delete from system table
+	// 1. Delete from system tables
+	_, err = tx.Exec(context.Background(),
+		"DELETE FROM baas_system.project_members WHERE project_id = (SELECT id FROM baas_system.projects WHERE slug = $1)", slug)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete project members"})
+	}
 	_, err = tx.Exec(context.Background(), "DELETE FROM baas_system.projects WHERE slug = $1", slug)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete project record"})
@@ -123,6 +128,22 @@ func DeleteProjectHandler(c *fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to drop schema"})
 	}
 
+	// 3. Drop the project's database roles (their grants and default privileges first)
+	for _, role := range []string{db.ProjectRole(slug), db.TenantRole(slug)} {
+		_, err = tx.Exec(context.Background(), fmt.Sprintf(`
+			DO $$
+			BEGIN
+				IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = '%s') THEN
+					DROP OWNED BY %s;
+					DROP ROLE %s;
+				END IF;
+			END
+			$$`, role, role, role))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to drop database role"})
+		}
+	}
+
 	if err := tx.Commit(context.Background()); err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
 	}
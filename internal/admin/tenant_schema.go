@@ -0,0 +1,409 @@
+package admin
+
+import (
+	"baas/internal/db"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// InternalTables are the hanbase-managed tables of a project schema.
+// They are hidden from tenant roles and cannot be exposed over realtime.
+var InternalTables = []string{"users", "auth_sessions", "auth_audit_log", "realtime_outbox", "storage_buckets", "storage_objects", "storage_uploads", "storage_multipart_uploads", "storage_multipart_parts"}
+
+// IsInternalTable reports whether table is one of InternalTables
+func IsInternalTable(table string) bool {
+	for _, t := range InternalTables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
+
+// tenantSchemaSQL returns the statements that create (or upgrade) the
+// per-project tables hanbase itself relies on. Every statement must be
+// idempotent so it can run both for new projects and on startup for
+// projects created by older versions.
+func tenantSchemaSQL(schemaName string) []string {
+	tenantRole := db.TenantRole(schemaName)
+	return []string{
+		// Auth: end-users of the project
+		fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s.users (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			email TEXT NOT NULL UNIQUE,
+			password_hash TEXT NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		)`, schemaName),
+		fmt.Sprintf(`ALTER TABLE %s.users ADD COLUMN IF NOT EXISTS email_confirmed_at TIMESTAMP WITH TIME ZONE`, schemaName),
+		fmt.Sprintf(`ALTER TABLE %s.users ADD COLUMN IF NOT EXISTS confirmation_token TEXT`, schemaName),
+		fmt.Sprintf(`ALTER TABLE %s.users ADD COLUMN IF NOT EXISTS confirmation_sent_at TIMESTAMP WITH TIME ZONE`, schemaName),
+		fmt.Sprintf(`ALTER TABLE %s.users ADD COLUMN IF NOT EXISTS user_metadata JSONB NOT NULL DEFAULT '{}'`, schemaName),
+		fmt.Sprintf(`ALTER TABLE %s.users ADD COLUMN IF NOT EXISTS app_metadata JSONB NOT NULL DEFAULT '{}'`, schemaName),
+		fmt.Sprintf(`ALTER TABLE %s.users ADD COLUMN IF NOT EXISTS banned_until TIMESTAMP WITH TIME ZONE`, schemaName),
+		fmt.Sprintf(`ALTER TABLE %s.users ADD COLUMN IF NOT EXISTS email_change TEXT`, schemaName),
+		fmt.Sprintf(`ALTER TABLE %s.users ADD COLUMN IF NOT EXISTS email_change_token TEXT`, schemaName),
+		fmt.Sprintf(`ALTER TABLE %s.users ADD COLUMN IF NOT EXISTS email_change_sent_at TIMESTAMP WITH TIME ZONE`, schemaName),
+		// Anonymous users have no credentials until they link an email/password
+		fmt.Sprintf(`ALTER TABLE %s.users ADD COLUMN IF NOT EXISTS is_anonymous BOOLEAN NOT NULL DEFAULT FALSE`, schemaName),
+		fmt.Sprintf(`ALTER TABLE %s.users ALTER COLUMN email DROP NOT NULL`, schemaName),
+		fmt.Sprintf(`ALTER TABLE %s.users ALTER COLUMN password_hash DROP NOT NULL`, schemaName),
+
+		// Auth: refresh token sessions
+		fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s.auth_sessions (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			user_id UUID NOT NULL REFERENCES %s.users(id) ON DELETE CASCADE,
+			refresh_token_hash TEXT NOT NULL UNIQUE,
+			claims JSONB NOT NULL DEFAULT '{}', -- Extra claims added by auth hooks at sign-in
+			ip TEXT,
+			user_agent TEXT,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			refreshed_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			revoked_at TIMESTAMP WITH TIME ZONE
+		)`, schemaName, schemaName),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS auth_sessions_user_id_idx ON %s.auth_sessions (user_id)`, schemaName),
+
+		// Auth: audit trail of auth events
+		fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s.auth_audit_log (
+			id BIGSERIAL PRIMARY KEY,
+			event TEXT NOT NULL,
+			user_id UUID,
+			actor_id TEXT, -- Platform admin performing the action, if any
+			ip TEXT,
+			user_agent TEXT,
+			payload JSONB NOT NULL DEFAULT '{}',
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		)`, schemaName),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS auth_audit_log_created_at_idx ON %s.auth_audit_log (created_at DESC)`, schemaName),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS auth_audit_log_user_id_idx ON %s.auth_audit_log (user_id)`, schemaName),
+
+		// Realtime: recent change events kept for replay (see realtime.storeOutbox)
+		fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s.realtime_outbox (
+			seq BIGSERIAL PRIMARY KEY,
+			event_id TEXT UNIQUE,
+			event JSONB NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		)`, schemaName),
+
+		// Storage: buckets and object metadata (contents live in the storage backend)
+		fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s.storage_buckets (
+			id TEXT PRIMARY KEY,
+			public BOOLEAN NOT NULL DEFAULT FALSE,
+			file_size_limit BIGINT, -- Bytes, NULL means the server limit
+			allowed_mime_types TEXT[], -- e.g. {image/*,application/pdf}, NULL means any
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		)`, schemaName),
+		fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s.storage_objects (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			bucket_id TEXT NOT NULL REFERENCES %s.storage_buckets(id),
+			name TEXT NOT NULL,
+			owner UUID, -- Uploading project user, NULL for platform admins
+			size BIGINT NOT NULL,
+			mime_type TEXT NOT NULL,
+			etag TEXT NOT NULL,
+			metadata JSONB NOT NULL DEFAULT '{}',
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			UNIQUE (bucket_id, name)
+		)`, schemaName, schemaName),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS storage_objects_name_idx ON %s.storage_objects (bucket_id, name text_pattern_ops)`, schemaName),
+		// Storage: resumable (tus) uploads in progress
+		fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s.storage_uploads (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			bucket_id TEXT NOT NULL REFERENCES %s.storage_buckets(id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			owner UUID,
+			upload_length BIGINT NOT NULL,
+			mime_type TEXT NOT NULL,
+			metadata JSONB NOT NULL DEFAULT '{}',
+			upsert BOOLEAN NOT NULL DEFAULT FALSE,
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		)`, schemaName, schemaName),
+		// Storage: S3 multipart uploads in progress
+		fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s.storage_multipart_uploads (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			bucket_id TEXT NOT NULL REFERENCES %s.storage_buckets(id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			mime_type TEXT NOT NULL,
+			metadata JSONB NOT NULL DEFAULT '{}',
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		)`, schemaName, schemaName),
+		fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s.storage_multipart_parts (
+			upload_id UUID NOT NULL REFERENCES %s.storage_multipart_uploads(id) ON DELETE CASCADE,
+			part_number INT NOT NULL,
+			size BIGINT NOT NULL,
+			etag TEXT NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			PRIMARY KEY (upload_id, part_number)
+		)`, schemaName, schemaName),
+
+		// Tenant requests run as the project's tenant role (see
+		// db.TenantRole): project tables are fully granted and meant to be
+		// restricted with RLS policies, while the hanbase-managed tables above
+		// stay private. The server's role must be a member to SET ROLE to it.
+		fmt.Sprintf(`
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = '%s') THEN
+				CREATE ROLE %s NOLOGIN;
+			END IF;
+		END
+		$$`, tenantRole, tenantRole),
+		fmt.Sprintf(`GRANT authenticated TO %s`, tenantRole),
+		fmt.Sprintf(`GRANT %s TO CURRENT_USER`, tenantRole),
+		fmt.Sprintf(`GRANT USAGE ON SCHEMA %s TO %s`, schemaName, tenantRole),
+		fmt.Sprintf(`GRANT ALL ON ALL TABLES IN SCHEMA %s TO %s`, schemaName, tenantRole),
+		fmt.Sprintf(`GRANT ALL ON ALL SEQUENCES IN SCHEMA %s TO %s`, schemaName, tenantRole),
+		fmt.Sprintf(`ALTER DEFAULT PRIVILEGES IN SCHEMA %s GRANT ALL ON TABLES TO %s`, schemaName, tenantRole),
+		fmt.Sprintf(`ALTER DEFAULT PRIVILEGES IN SCHEMA %s GRANT ALL ON SEQUENCES TO %s`, schemaName, tenantRole),
+		fmt.Sprintf(`REVOKE ALL ON %s FROM %s`, qualifiedTables(schemaName, InternalTables), tenantRole),
+		// Older versions granted the project tables to the shared role, which
+		// every project's tenant requests used
+		fmt.Sprintf(`REVOKE ALL ON SCHEMA %s FROM authenticated`, schemaName),
+		fmt.Sprintf(`REVOKE ALL ON ALL TABLES IN SCHEMA %s FROM authenticated`, schemaName),
+		fmt.Sprintf(`REVOKE ALL ON ALL SEQUENCES IN SCHEMA %s FROM authenticated`, schemaName),
+		fmt.Sprintf(`ALTER DEFAULT PRIVILEGES IN SCHEMA %s REVOKE ALL ON TABLES FROM authenticated`, schemaName),
+		fmt.Sprintf(`ALTER DEFAULT PRIVILEGES IN SCHEMA %s REVOKE ALL ON SEQUENCES FROM authenticated`, schemaName),
+
+		// Realtime: trigger function emitting change notifications on the
+		// db_events channel (see realtime.ChangeEvent for the payload format).
+		// Attached per table by the realtime API. Payloads are signed (see
+		// realtime.verifyNotification) with a key only the server's role can
+		// read: hanbase_sign_change runs as the server's role, but only on
+		// JSON (row conversions may run project code) and always for this
+		// schema, so a project's SQL can forge nothing it could not cause by
+		// writing its own tables.
+		fmt.Sprintf(`
+		CREATE OR REPLACE FUNCTION %s.hanbase_sign_change(tbl text, op text, data jsonb, old jsonb) RETURNS void
+		LANGUAGE plpgsql SECURITY DEFINER SET search_path = pg_catalog AS $fn$
+		DECLARE
+			payload jsonb;
+			body text;
+			signing record;
+		BEGIN
+			payload := jsonb_build_object(
+				'id', gen_random_uuid(),
+				'schema', '%s',
+				'table', tbl,
+				'type', op,
+				'data', data,
+				'old', old
+			);
+			-- NOTIFY payloads are limited to 8000 bytes, including the
+			-- signature: drop the old record first, then the row itself
+			IF octet_length(payload::text) > 7800 THEN
+				payload := payload - 'old';
+			END IF;
+			IF octet_length(payload::text) > 7800 THEN
+				payload := (payload - 'data') || jsonb_build_object('truncated', true);
+			END IF;
+			SELECT k.ipad, k.opad INTO signing FROM baas_system.realtime_signing_key k;
+			IF NOT FOUND THEN
+				RETURN; -- Setup not run since upgrading; the server reports it
+			END IF;
+			body := payload::text;
+			PERFORM pg_notify('db_events',
+				encode(sha256(signing.opad || sha256(signing.ipad || convert_to(body, 'UTF8'))), 'hex') || ':' || body);
+		END
+		$fn$`, schemaName, strings.ToLower(schemaName)),
+		fmt.Sprintf(`
+		CREATE OR REPLACE FUNCTION %s.hanbase_notify_change() RETURNS trigger
+		LANGUAGE plpgsql AS $fn$
+		BEGIN
+			PERFORM %s.hanbase_sign_change(TG_TABLE_NAME, TG_OP,
+				CASE WHEN TG_OP = 'DELETE' THEN to_jsonb(OLD) ELSE to_jsonb(NEW) END,
+				CASE WHEN TG_OP = 'INSERT' THEN NULL ELSE to_jsonb(OLD) END);
+			RETURN NULL;
+		END
+		$fn$`, schemaName, schemaName),
+	}
+}
+
+func qualifiedTables(schemaName string, tables []string) string {
+	names := make([]string, len(tables))
+	for i, t := range tables {
+		names[i] = schemaName + "." + t
+	}
+	return strings.Join(names, ", ")
+}
+
+// ownerRoleSQL returns the statements that set up the project's login role
+// (see db.ProjectRole). It owns the user tables of the schema and has full
+// access to the hanbase-managed ones, but no privileges outside the schema.
+func ownerRoleSQL(schemaName, password string) []string {
+	role := db.ProjectRole(schemaName)
+	return []string{
+		fmt.Sprintf(`
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = '%s') THEN
+				CREATE ROLE %s LOGIN NOINHERIT;
+			END IF;
+		END
+		$$`, role, role),
+		fmt.Sprintf(`ALTER ROLE %s LOGIN NOINHERIT NOCREATEDB NOCREATEROLE CONNECTION LIMIT 10 PASSWORD '%s'`, role, password),
+		// The server's role must be a member to hand objects over to it and to
+		// keep accessing the tables it creates
+		fmt.Sprintf(`GRANT %s TO CURRENT_USER`, role),
+		fmt.Sprintf(`GRANT USAGE, CREATE ON SCHEMA %s TO %s`, schemaName, role),
+		// Data access only to the tables hanbase creates: a trigger the role
+		// attached to one of them would run as whoever writes it, e.g. the
+		// server's role during a signup
+		fmt.Sprintf(`GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA %s TO %s`, schemaName, role),
+		fmt.Sprintf(`REVOKE TRIGGER, TRUNCATE, REFERENCES ON %s FROM %s`, qualifiedTables(schemaName, InternalTables), role),
+		fmt.Sprintf(`GRANT ALL ON ALL SEQUENCES IN SCHEMA %s TO %s`, schemaName, role),
+		fmt.Sprintf(`GRANT EXECUTE ON ALL FUNCTIONS IN SCHEMA %s TO %s`, schemaName, role),
+		fmt.Sprintf(`ALTER DEFAULT PRIVILEGES IN SCHEMA %s REVOKE ALL ON TABLES FROM %s`, schemaName, role),
+		fmt.Sprintf(`ALTER DEFAULT PRIVILEGES IN SCHEMA %s GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO %s`, schemaName, role),
+		fmt.Sprintf(`ALTER DEFAULT PRIVILEGES IN SCHEMA %s GRANT ALL ON SEQUENCES TO %s`, schemaName, role),
+		// Tables created in the SQL editor stay reachable for tenant requests
+		fmt.Sprintf(`ALTER DEFAULT PRIVILEGES FOR ROLE %s IN SCHEMA %s REVOKE ALL ON TABLES FROM authenticated`, role, schemaName),
+		fmt.Sprintf(`ALTER DEFAULT PRIVILEGES FOR ROLE %s IN SCHEMA %s REVOKE ALL ON SEQUENCES FROM authenticated`, role, schemaName),
+		fmt.Sprintf(`ALTER DEFAULT PRIVILEGES FOR ROLE %s IN SCHEMA %s GRANT ALL ON TABLES TO %s`, role, schemaName, db.TenantRole(schemaName)),
+		fmt.Sprintf(`ALTER DEFAULT PRIVILEGES FOR ROLE %s IN SCHEMA %s GRANT ALL ON SEQUENCES TO %s`, role, schemaName, db.TenantRole(schemaName)),
+		// User tables and views created by older versions (through the server's
+		// role) are handed over so they can be altered and dropped
+		fmt.Sprintf(`
+		DO $$
+		DECLARE
+			rel record;
+		BEGIN
+			FOR rel IN
+				SELECT c.relname, c.relkind FROM pg_class c
+				JOIN pg_namespace n ON n.oid = c.relnamespace
+				WHERE n.nspname = '%s' AND c.relkind IN ('r', 'p', 'v', 'm')
+				  AND c.relname <> ALL ('{%s}'::text[])
+				  AND pg_get_userbyid(c.relowner) = current_user
+			LOOP
+				IF rel.relkind IN ('v', 'm') THEN
+					EXECUTE format('ALTER %%s %%I.%%I OWNER TO %%I',
+						CASE rel.relkind WHEN 'v' THEN 'VIEW' ELSE 'MATERIALIZED VIEW' END, '%s', rel.relname, '%s');
+				ELSE
+					EXECUTE format('ALTER TABLE %%I.%%I OWNER TO %%I', '%s', rel.relname, '%s');
+				END IF;
+			END LOOP;
+		END
+		$$`, strings.ToLower(schemaName), strings.Join(InternalTables, ","),
+			strings.ToLower(schemaName), role, strings.ToLower(schemaName), role),
+	}
+}
+
+// provisionTenant creates the hanbase-managed tables inside a project schema
+// and the project's database role.
+func provisionTenant(ctx context.Context, tx pgx.Tx, schemaName string) error {
+	for _, stmt := range tenantSchemaSQL(schemaName) {
+		if _, err := tx.Exec(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	// The role's password is generated once and kept with the project
+	var password *string
+	err := tx.QueryRow(ctx,
+		"SELECT db_password FROM baas_system.projects WHERE db_schema = $1", schemaName).Scan(&password)
+	if err != nil {
+		return err
+	}
+	if password == nil {
+		generated := randomPassword()
+		_, err = tx.Exec(ctx,
+			"UPDATE baas_system.projects SET db_password = $1 WHERE db_schema = $2", generated, schemaName)
+		if err != nil {
+			return err
+		}
+		password = &generated
+	}
+	for _, stmt := range ownerRoleSQL(schemaName, *password) {
+		if _, err := tx.Exec(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return checkOwnerRole(ctx, tx, schemaName)
+}
+
+// checkOwnerRole fails if the project's role can attach triggers to (or
+// otherwise take over) a hanbase-managed table, whatever granted it
+func checkOwnerRole(ctx context.Context, tx pgx.Tx, schemaName string) error {
+	role := db.ProjectRole(schemaName)
+	for _, table := range InternalTables {
+		var unsafe bool
+		err := tx.QueryRow(ctx, `
+			SELECT has_table_privilege($1, $2, 'TRIGGER')
+			    OR has_table_privilege($1, $2, 'TRUNCATE')
+			    OR has_table_privilege($1, $2, 'REFERENCES')
+			    OR pg_has_role($1, (SELECT relowner FROM pg_class WHERE oid = $2::regclass), 'USAGE')`,
+			role, schemaName+"."+table).Scan(&unsafe)
+		if err != nil {
+			return err
+		}
+		if unsafe {
+			return fmt.Errorf("role %s can create triggers on %s.%s", role, schemaName, table)
+		}
+	}
+	return nil
+}
+
+func randomPassword() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return hex.EncodeToString(b)
+}
+
+// MigrateProjects brings the schemas of all existing projects up to date.
+// Called once on startup; failures are logged per project so one broken
+// schema does not keep the API from booting.
+func MigrateProjects(ctx context.Context) error {
+	// Projects created before memberships were recorded have no owner and
+	// would be closed to everyone (see auth.RequireProjectRole): they are
+	// given to the oldest platform account, the one that set up the instance.
+	_, err := db.Pool.Exec(ctx, `
+		INSERT INTO baas_system.project_members (project_id, user_id, role)
+		SELECT p.id, (SELECT id FROM baas_system.users ORDER BY created_at, id LIMIT 1), 'owner'
+		FROM baas_system.projects p
+		WHERE NOT EXISTS (SELECT 1 FROM baas_system.project_members m WHERE m.project_id = p.id)
+		  AND EXISTS (SELECT 1 FROM baas_system.users)`)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Pool.Query(ctx, "SELECT db_schema FROM baas_system.projects")
+	if err != nil {
+		return err
+	}
+	schemas, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+
+	for _, schemaName := range schemas {
+		if !isValidSlug(schemaName) {
+			continue
+		}
+		err := pgx.BeginFunc(ctx, db.Pool, func(tx pgx.Tx) error {
+			return provisionTenant(ctx, tx, schemaName)
+		})
+		if err != nil {
+			log.Printf("Migration of project schema %q failed: %v\n", schemaName, err)
+		}
+	}
+	return nil
+}
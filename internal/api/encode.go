@@ -0,0 +1,410 @@
+package api
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Query results are encoded the same way by the REST API and the SQL
+// editor, independent of session settings such as DateStyle or TimeZone:
+//
+//	bool                          true / false
+//	int2, int4, int8, oid, xid    number (int8 is exact in the JSON text, but
+//	                              JavaScript loses precision beyond 2^53)
+//	float4, float8                number; NaN, Infinity, -Infinity as strings
+//	numeric                       number with all its digits; NaN, Infinity,
+//	                              -Infinity as strings
+//	json, jsonb                   the JSON value itself
+//	bytea                         string, hex with a \x prefix ("\\xdeadbeef")
+//	uuid                          string
+//	date                          string, "2024-01-31"
+//	time                          string, "13:45:00.5"
+//	timestamp                     string, "2024-01-31T13:45:00.5"
+//	timestamptz                   string in UTC, "2024-01-31T13:45:00.5Z"
+//	date/timestamp infinity       string, "infinity" / "-infinity"
+//	interval                      string, ISO 8601 duration ("P1Y2M3DT4H5M6.5S")
+//	inet                          string, prefix length only for networks
+//	cidr                          string, always with the prefix length
+//	macaddr, macaddr8             string, "08:00:2b:01:02:03"
+//	bit, varbit                   string of 0s and 1s
+//	ranges                        object {"empty", "lower", "upper",
+//	                              "lower_inclusive", "upper_inclusive"}, bounds
+//	                              encoded like their type, null when unbounded
+//	multiranges                   array of range objects
+//	arrays                        (nested) arrays of their element encoding
+//	records                       array of the field values
+//	anything else                 string in the Postgres text representation
+//	                              (text types, enums, timetz, money,
+//	                              geometric types, composites, ...)
+
+// Column describes a result column
+type Column struct {
+	Name     string `json:"name"`
+	TypeOID  uint32 `json:"type_oid"`
+	TypeName string `json:"type_name"` // pg_type.typname, e.g. "int4", "_text"
+}
+
+// readRows encodes the values of up to maxRows rows (all rows when maxRows
+// is negative). truncated reports whether rows were left; the caller closes
+// rows.
+func readRows(rows pgx.Rows, maxRows int) (values [][]any, truncated bool, err error) {
+	m := rows.Conn().TypeMap()
+	fields := rows.FieldDescriptions()
+	values = [][]any{}
+	for rows.Next() {
+		if maxRows >= 0 && len(values) == maxRows {
+			return values, true, nil
+		}
+		row := make([]any, len(fields))
+		for i, raw := range rows.RawValues() {
+			if row[i], err = decodeColumn(m, fields[i], raw); err != nil {
+				return nil, false, fmt.Errorf("column %s: %w", fields[i].Name, err)
+			}
+		}
+		values = append(values, row)
+	}
+	return values, false, rows.Err()
+}
+
+// queryObjects runs a query and encodes its rows as JSON objects, keeping
+// the column order
+func queryObjects(ctx context.Context, q queryer, sql string, args ...any) ([]json.RawMessage, error) {
+	rows, err := q.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fields := rows.FieldDescriptions()
+	values, _, err := readRows(rows, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]json.RawMessage, len(values))
+	for r, row := range values {
+		var b strings.Builder
+		b.WriteByte('{')
+		for i, v := range row {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			key, _ := json.Marshal(fields[i].Name)
+			value, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			b.Write(key)
+			b.WriteByte(':')
+			b.Write(value)
+		}
+		b.WriteByte('}')
+		objects[r] = json.RawMessage(b.String())
+	}
+	return objects, nil
+}
+
+// queryObject is queryObjects for a single row, pgx.ErrNoRows without any
+func queryObject(ctx context.Context, q queryer, sql string, args ...any) (json.RawMessage, error) {
+	objects, err := queryObjects(ctx, q, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 {
+		return nil, pgx.ErrNoRows
+	}
+	return objects[0], nil
+}
+
+// describeColumns returns the columns of a result. Types pgx does not know
+// (enums, composites, extension types) are looked up in pg_type.
+func describeColumns(ctx context.Context, q queryer, m *pgtype.Map, fields []pgconn.FieldDescription) ([]Column, error) {
+	columns := make([]Column, len(fields))
+	var unknown []uint32
+	for i, f := range fields {
+		columns[i] = Column{Name: f.Name, TypeOID: f.DataTypeOID}
+		if t, ok := m.TypeForOID(f.DataTypeOID); ok {
+			columns[i].TypeName = t.Name
+		} else {
+			unknown = append(unknown, f.DataTypeOID)
+		}
+	}
+	if len(unknown) == 0 {
+		return columns, nil
+	}
+
+	rows, err := q.Query(ctx, "SELECT oid, typname FROM pg_catalog.pg_type WHERE oid = ANY($1)", unknown)
+	if err != nil {
+		return nil, err
+	}
+	names := map[uint32]string{}
+	var oid uint32
+	var name string
+	_, err = pgx.ForEachRow(rows, []any{&oid, &name}, func() error {
+		names[oid] = name
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range columns {
+		if columns[i].TypeName == "" {
+			columns[i].TypeName = names[columns[i].TypeOID]
+		}
+	}
+	return columns, nil
+}
+
+// decodeColumn encodes a raw column value (see the table above)
+func decodeColumn(m *pgtype.Map, f pgconn.FieldDescription, raw []byte) (any, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	oid := f.DataTypeOID
+
+	switch {
+	case oid == pgtype.JSONOID:
+		return json.RawMessage(append([]byte(nil), raw...)), nil
+	case oid == pgtype.JSONBOID:
+		if f.Format == pgtype.BinaryFormatCode {
+			raw = raw[1:] // Version byte
+		}
+		return json.RawMessage(append([]byte(nil), raw...)), nil
+	}
+
+	t, ok := m.TypeForOID(oid)
+	if !ok {
+		// Unknown types are sent in their text representation
+		if f.Format == pgtype.TextFormatCode {
+			return string(raw), nil
+		}
+		return `\x` + hex.EncodeToString(raw), nil
+	}
+
+	if codec, ok := t.Codec.(*pgtype.ArrayCodec); ok {
+		// Scanned into an Array to keep the dimensions
+		var arr pgtype.Array[any]
+		if err := m.PlanScan(oid, f.Format, &arr).Scan(raw, &arr); err != nil {
+			return nil, err
+		}
+		elements := make([]any, len(arr.Elements))
+		for i, e := range arr.Elements {
+			elements[i] = encodeValue(m, codec.ElementType.OID, e)
+		}
+		return shapeArray(elements, arr.Dims), nil
+	}
+
+	v, err := t.Codec.DecodeValue(m, oid, f.Format, raw)
+	if err != nil {
+		return nil, err
+	}
+	return encodeValue(m, oid, v), nil
+}
+
+// shapeArray nests the flat elements of a multidimensional array
+func shapeArray(elements []any, dims []pgtype.ArrayDimension) []any {
+	if len(dims) <= 1 {
+		return elements
+	}
+	n := int(dims[0].Length)
+	size := len(elements) / max(n, 1)
+	nested := make([]any, n)
+	for i := range nested {
+		nested[i] = shapeArray(elements[i*size:(i+1)*size], dims[1:])
+	}
+	return nested
+}
+
+// encodeValue encodes a value decoded by pgx for a column of type oid
+func encodeValue(m *pgtype.Map, oid uint32, v any) any {
+	if r, ok := v.(rune); ok && oid == pgtype.QCharOID {
+		return string(r)
+	}
+
+	switch x := v.(type) {
+	case nil, bool, string, int16, int32, int64, uint32, uint64:
+		return x
+	case float32:
+		return encodeFloat(float64(x), 32)
+	case float64:
+		return encodeFloat(x, 64)
+	case pgtype.Numeric:
+		s, err := x.Value()
+		if err != nil || s == nil {
+			return nil
+		}
+		if x.NaN || x.InfinityModifier != pgtype.Finite {
+			return s // "NaN", "Infinity", "-Infinity"
+		}
+		return json.Number(s.(string))
+	case []byte:
+		if oid == pgtype.ByteaOID {
+			return `\x` + hex.EncodeToString(x)
+		}
+		return string(x)
+	case [16]byte:
+		return fmt.Sprintf("%x-%x-%x-%x-%x", x[0:4], x[4:6], x[6:8], x[8:10], x[10:16])
+	case time.Time:
+		switch oid {
+		case pgtype.DateOID:
+			return x.Format("2006-01-02")
+		case pgtype.TimestampOID:
+			return x.Format("2006-01-02T15:04:05.999999")
+		default:
+			return x.UTC().Format("2006-01-02T15:04:05.999999Z07:00")
+		}
+	case pgtype.InfinityModifier:
+		return x.String()
+	case pgtype.Time:
+		return formatTimeOfDay(x.Microseconds)
+	case pgtype.Interval:
+		return formatInterval(x)
+	case netip.Prefix:
+		if oid == pgtype.InetOID && x.Bits() == x.Addr().BitLen() {
+			return x.Addr().String()
+		}
+		return x.String()
+	case net.HardwareAddr:
+		return x.String()
+	case pgtype.Bits:
+		var b strings.Builder
+		for i := int32(0); i < x.Len; i++ {
+			if x.Bytes[i/8]&(0x80>>(i%8)) != 0 {
+				b.WriteByte('1')
+			} else {
+				b.WriteByte('0')
+			}
+		}
+		return b.String()
+	case pgtype.Range[any]:
+		return encodeRange(m, rangeElementOID(m, oid), x)
+	case pgtype.Multirange[pgtype.Range[any]]:
+		var elementOID uint32
+		if t, ok := m.TypeForOID(oid); ok {
+			if codec, ok := t.Codec.(*pgtype.MultirangeCodec); ok {
+				elementOID = rangeElementOID(m, codec.ElementType.OID)
+			}
+		}
+		ranges := make([]any, len(x))
+		for i, r := range x {
+			ranges[i] = encodeRange(m, elementOID, r)
+		}
+		return ranges
+	case []any:
+		// Record fields; their types are not known here
+		fields := make([]any, len(x))
+		for i, f := range x {
+			fields[i] = encodeValue(m, 0, f)
+		}
+		return fields
+	case map[string]any:
+		return x // JSON array elements
+	}
+
+	// The Postgres text representation
+	if text, err := m.Encode(oid, pgtype.TextFormatCode, v, nil); err == nil && text != nil {
+		return string(text)
+	}
+	return fmt.Sprint(v)
+}
+
+func encodeFloat(f float64, bits int) any {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return json.Number(strconv.FormatFloat(f, 'g', -1, bits))
+}
+
+func rangeElementOID(m *pgtype.Map, oid uint32) uint32 {
+	if t, ok := m.TypeForOID(oid); ok {
+		if codec, ok := t.Codec.(*pgtype.RangeCodec); ok {
+			return codec.ElementType.OID
+		}
+	}
+	return 0
+}
+
+func encodeRange(m *pgtype.Map, elementOID uint32, r pgtype.Range[any]) map[string]any {
+	if r.LowerType == pgtype.Empty {
+		return map[string]any{"empty": true, "lower": nil, "upper": nil, "lower_inclusive": false, "upper_inclusive": false}
+	}
+	bound := func(v any, t pgtype.BoundType) any {
+		if t == pgtype.Unbounded {
+			return nil
+		}
+		return encodeValue(m, elementOID, v)
+	}
+	return map[string]any{
+		"empty":           false,
+		"lower":           bound(r.Lower, r.LowerType),
+		"upper":           bound(r.Upper, r.UpperType),
+		"lower_inclusive": r.LowerType == pgtype.Inclusive,
+		"upper_inclusive": r.UpperType == pgtype.Inclusive,
+	}
+}
+
+// formatTimeOfDay formats microseconds since midnight as hh:mm:ss[.ffffff]
+func formatTimeOfDay(us int64) string {
+	s := fmt.Sprintf("%02d:%02d:%02d", us/3_600_000_000, us/60_000_000%60, us/1_000_000%60)
+	if frac := us % 1_000_000; frac != 0 {
+		s += strings.TrimRight(fmt.Sprintf(".%06d", frac), "0")
+	}
+	return s
+}
+
+// formatInterval formats an interval as an ISO 8601 duration, each field
+// carrying its own sign like Postgres' iso_8601 IntervalStyle
+func formatInterval(iv pgtype.Interval) string {
+	var b strings.Builder
+	b.WriteByte('P')
+	if years := iv.Months / 12; years != 0 {
+		fmt.Fprintf(&b, "%dY", years)
+	}
+	if months := iv.Months % 12; months != 0 {
+		fmt.Fprintf(&b, "%dM", months)
+	}
+	if iv.Days != 0 {
+		fmt.Fprintf(&b, "%dD", iv.Days)
+	}
+	if us := iv.Microseconds; us != 0 {
+		b.WriteByte('T')
+		if hours := us / 3_600_000_000; hours != 0 {
+			fmt.Fprintf(&b, "%dH", hours)
+		}
+		if minutes := us / 60_000_000 % 60; minutes != 0 {
+			fmt.Fprintf(&b, "%dM", minutes)
+		}
+		if seconds := us % 60_000_000; seconds != 0 {
+			sign := ""
+			if seconds < 0 {
+				sign, seconds = "-", -seconds
+			}
+			s := strconv.FormatInt(seconds/1_000_000, 10)
+			if frac := seconds % 1_000_000; frac != 0 {
+				s += strings.TrimRight(fmt.Sprintf(".%06d", frac), "0")
+			}
+			fmt.Fprintf(&b, "%s%sS", sign, s)
+		}
+	}
+	if b.Len() == 1 {
+		return "PT0S"
+	}
+	return b.String()
+}
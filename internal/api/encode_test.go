@@ -0,0 +1,173 @@
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"math/big"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// jsonOf marshals an encoded value the way the handlers send it
+func jsonOf(t *testing.T, v any) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("json.Marshal(%#v): %v", v, err)
+	}
+	return string(b)
+}
+
+func TestEncodeValue(t *testing.T) {
+	m := pgtype.NewMap()
+	ts := time.Date(2024, 1, 31, 13, 45, 0, 500_000_000, time.UTC)
+
+	tests := []struct {
+		name string
+		oid  uint32
+		v    any
+		want string
+	}{
+		{"null", pgtype.Int4OID, nil, `null`},
+		{"bool", pgtype.BoolOID, true, `true`},
+		{"int2", pgtype.Int2OID, int16(-3), `-3`},
+		{"int8 beyond 2^53", pgtype.Int8OID, int64(9007199254740993), `9007199254740993`},
+		{"oid", pgtype.OIDOID, uint32(4294967295), `4294967295`},
+		{"float4", pgtype.Float4OID, float32(0.1), `0.1`},
+		{"float8", pgtype.Float8OID, 1e21, `1e+21`},
+		{"float8 NaN", pgtype.Float8OID, math.NaN(), `"NaN"`},
+		{"float8 -Infinity", pgtype.Float8OID, math.Inf(-1), `"-Infinity"`},
+		{"numeric", pgtype.NumericOID, pgtype.Numeric{Int: big.NewInt(12345678901234567), Exp: -2, Valid: true}, `123456789012345.67`},
+		{"numeric NaN", pgtype.NumericOID, pgtype.Numeric{NaN: true, Valid: true}, `"NaN"`},
+		{"numeric Infinity", pgtype.NumericOID, pgtype.Numeric{InfinityModifier: pgtype.Infinity, Valid: true}, `"Infinity"`},
+		{"text", pgtype.TextOID, "a\"b", `"a\"b"`},
+		{"char", pgtype.QCharOID, rune('x'), `"x"`},
+		{"bytea", pgtype.ByteaOID, []byte{0xde, 0xad, 0xbe, 0xef}, `"\\xdeadbeef"`},
+		{"uuid", pgtype.UUIDOID, [16]byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0, 0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0}, `"12345678-9abc-def0-1234-56789abcdef0"`},
+		{"date", pgtype.DateOID, ts, `"2024-01-31"`},
+		{"timestamp", pgtype.TimestampOID, ts, `"2024-01-31T13:45:00.5"`},
+		{"timestamptz", pgtype.TimestamptzOID, ts.In(time.FixedZone("", 2*3600)), `"2024-01-31T13:45:00.5Z"`},
+		{"timestamp infinity", pgtype.TimestampOID, pgtype.Infinity, `"infinity"`},
+		{"date -infinity", pgtype.DateOID, pgtype.NegativeInfinity, `"-infinity"`},
+		{"time", pgtype.TimeOID, pgtype.Time{Microseconds: 13*3_600_000_000 + 45*60_000_000 + 500_000, Valid: true}, `"13:45:00.5"`},
+		{"interval", pgtype.IntervalOID, pgtype.Interval{Months: 14, Days: 3, Microseconds: 4*3_600_000_000 + 5*60_000_000 + 6_500_000, Valid: true}, `"P1Y2M3DT4H5M6.5S"`},
+		{"inet host", pgtype.InetOID, netip.MustParsePrefix("192.168.0.1/32"), `"192.168.0.1"`},
+		{"inet network", pgtype.InetOID, netip.MustParsePrefix("192.168.0.1/24"), `"192.168.0.1/24"`},
+		{"cidr host", pgtype.CIDROID, netip.MustParsePrefix("10.0.0.1/32"), `"10.0.0.1/32"`},
+		{"macaddr", pgtype.MacaddrOID, net.HardwareAddr{0x08, 0x00, 0x2b, 0x01, 0x02, 0x03}, `"08:00:2b:01:02:03"`},
+		{"varbit", pgtype.VarbitOID, pgtype.Bits{Bytes: []byte{0b10110000}, Len: 5, Valid: true}, `"10110"`},
+		{
+			"int4range",
+			pgtype.Int4rangeOID,
+			pgtype.Range[any]{Lower: int32(1), Upper: int32(10), LowerType: pgtype.Inclusive, UpperType: pgtype.Exclusive, Valid: true},
+			`{"empty":false,"lower":1,"lower_inclusive":true,"upper":10,"upper_inclusive":false}`,
+		},
+		{
+			"unbounded tsrange",
+			pgtype.TsrangeOID,
+			pgtype.Range[any]{Lower: ts, LowerType: pgtype.Exclusive, UpperType: pgtype.Unbounded, Valid: true},
+			`{"empty":false,"lower":"2024-01-31T13:45:00.5","lower_inclusive":false,"upper":null,"upper_inclusive":false}`,
+		},
+		{
+			"empty range",
+			pgtype.Int8rangeOID,
+			pgtype.Range[any]{LowerType: pgtype.Empty, UpperType: pgtype.Empty, Valid: true},
+			`{"empty":true,"lower":null,"lower_inclusive":false,"upper":null,"upper_inclusive":false}`,
+		},
+		{"record", pgtype.RecordOID, []any{int32(1), "a", nil}, `[1,"a",null]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jsonOf(t, encodeValue(m, tt.oid, tt.v)); got != tt.want {
+				t.Errorf("encodeValue(%d, %#v) = %s, want %s", tt.oid, tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeColumnText(t *testing.T) {
+	m := pgtype.NewMap()
+
+	tests := []struct {
+		name string
+		oid  uint32
+		raw  string
+		want string
+	}{
+		{"int4", pgtype.Int4OID, "42", `42`},
+		{"bool", pgtype.BoolOID, "t", `true`},
+		{"numeric", pgtype.NumericOID, "1.50", `1.50`},
+		{"json", pgtype.JSONOID, `{"a": [1, 2]}`, `{"a":[1,2]}`},
+		{"jsonb", pgtype.JSONBOID, `{"a": 1}`, `{"a":1}`},
+		{"date infinity", pgtype.DateOID, "infinity", `"infinity"`},
+		{"int4 array", pgtype.Int4ArrayOID, "{1,NULL,3}", `[1,null,3]`},
+		{"2-d text array", pgtype.TextArrayOID, "{{a,b},{c,d}}", `[["a","b"],["c","d"]]`},
+		{"unknown type", 999999, "(1,2)", `"(1,2)"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := pgconn.FieldDescription{DataTypeOID: tt.oid, Format: pgtype.TextFormatCode}
+			v, err := decodeColumn(m, f, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("decodeColumn(%q): %v", tt.raw, err)
+			}
+			if got := jsonOf(t, v); got != tt.want {
+				t.Errorf("decodeColumn(%q) = %s, want %s", tt.raw, got, tt.want)
+			}
+		})
+	}
+
+	if v, err := decodeColumn(m, pgconn.FieldDescription{DataTypeOID: pgtype.TextOID}, nil); err != nil || v != nil {
+		t.Errorf("decodeColumn(NULL) = %v, %v, want nil", v, err)
+	}
+}
+
+func TestFormatInterval(t *testing.T) {
+	tests := []struct {
+		name string
+		iv   pgtype.Interval
+		want string
+	}{
+		{"zero", pgtype.Interval{}, "PT0S"},
+		{"years and months", pgtype.Interval{Months: 26}, "P2Y2M"},
+		{"days", pgtype.Interval{Days: 7}, "P7D"},
+		{"hours", pgtype.Interval{Microseconds: 3 * 3_600_000_000}, "PT3H"},
+		{"fraction", pgtype.Interval{Microseconds: 1}, "PT0.000001S"},
+		{"everything", pgtype.Interval{Months: 14, Days: 3, Microseconds: 4*3_600_000_000 + 5*60_000_000 + 6_500_000}, "P1Y2M3DT4H5M6.5S"},
+		{"negative month", pgtype.Interval{Months: -1}, "P-1M"},
+		{"negative time", pgtype.Interval{Microseconds: -90_000_000}, "PT-1M-30S"},
+		{"mixed signs", pgtype.Interval{Days: 1, Microseconds: -1_500_000}, "P1DT-1.5S"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatInterval(tt.iv); got != tt.want {
+				t.Errorf("formatInterval(%+v) = %q, want %q", tt.iv, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatTimeOfDay(t *testing.T) {
+	tests := []struct {
+		us   int64
+		want string
+	}{
+		{0, "00:00:00"},
+		{13*3_600_000_000 + 45*60_000_000, "13:45:00"},
+		{23*3_600_000_000 + 59*60_000_000 + 59_999_999, "23:59:59.999999"},
+		{24 * 3_600_000_000, "24:00:00"},
+		{120_000, "00:00:00.12"},
+	}
+	for _, tt := range tests {
+		if got := formatTimeOfDay(tt.us); got != tt.want {
+			t.Errorf("formatTimeOfDay(%d) = %q, want %q", tt.us, got, tt.want)
+		}
+	}
+}
@@ -1,12 +1,14 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
 
 	"baas/internal/db"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/jackc/pgx/v5"
 )
 
@@ -40,21 +42,21 @@ func DynamicHandler(c *fiber.Ctx) error {
 func handleList(c *fiber.Ctx, fullTableName string) error {
 	// Query params for simple filtering: ?id=eq.1 or ?name=eq.John
 	// For MVP, we pass everything as SELECT * for now.
-	query := fmt.Sprintf("SELECT json_agg(t) FROM (SELECT * FROM %s LIMIT 100) t", fullTableName)
+	query := fmt.Sprintf("SELECT * FROM %s LIMIT 100", fullTableName)
 
-	var result []byte
-	err := db.Pool.QueryRow(c.Context(), query).Scan(&result)
+	var result []json.RawMessage
+	err := db.WithClaims(c.Context(), c.Params("project"), claimsOf(c), func(tx pgx.Tx) error {
+		var err error
+		result, err = queryObjects(c.Context(), tx, query)
+		return err
+	})
 
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			return c.JSON([]interface{}{})
-		}
 		// If table doesn't exist, Postgres returns specific error code, but for now 500
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	c.Set("Content-Type", "application/json")
-	return c.Send(result)
+	return c.JSON(result)
 }
 
 func handleCreate(c *fiber.Ctx, fullTableName string) error {
@@ -83,15 +85,18 @@ func handleCreate(c *fiber.Ctx, fullTableName string) error {
 	}
 
 	query := fmt.Sprintf(
-		"INSERT INTO %s (%s) VALUES (%s) RETURNING to_jsonb(%s.*)",
+		"INSERT INTO %s (%s) VALUES (%s) RETURNING *",
 		fullTableName,
 		strings.Join(columns, ", "),
 		strings.Join(placeholders, ", "),
-		fullTableName,
 	)
 
-	var result []byte
-	err := db.Pool.QueryRow(c.Context(), query, values...).Scan(&result)
+	var result json.RawMessage
+	err := db.WithClaims(c.Context(), c.Params("project"), claimsOf(c), func(tx pgx.Tx) error {
+		var err error
+		result, err = queryObject(c.Context(), tx, query, values...)
+		return err
+	})
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
@@ -133,15 +138,18 @@ func handleUpdate(c *fiber.Ctx, fullTableName string) error {
 	values = append(values, id)
 
 	query := fmt.Sprintf(
-		"UPDATE %s SET %s WHERE id = $%d RETURNING to_jsonb(%s.*)",
+		"UPDATE %s SET %s WHERE id = $%d RETURNING *",
 		fullTableName,
 		strings.Join(updates, ", "),
 		i, // The ID placeholder index
-		fullTableName,
 	)
 
-	var result []byte
-	err := db.Pool.QueryRow(c.Context(), query, values...).Scan(&result)
+	var result json.RawMessage
+	err := db.WithClaims(c.Context(), c.Params("project"), claimsOf(c), func(tx pgx.Tx) error {
+		var err error
+		result, err = queryObject(c.Context(), tx, query, values...)
+		return err
+	})
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
@@ -157,10 +165,14 @@ func handleDelete(c *fiber.Ctx, fullTableName string) error {
 	}
 
 	// Warning: This assumes 'id' column is integer or text that matches parameter
-	query := fmt.Sprintf("DELETE FROM %s WHERE id = $1 RETURNING to_jsonb(%s.*)", fullTableName, fullTableName)
-
-	var result []byte
-	err := db.Pool.QueryRow(c.Context(), query, id).Scan(&result)
+	query := fmt.Sprintf("DELETE FROM %s WHERE id = $1 RETURNING *", fullTableName)
+
+	var result json.RawMessage
+	err := db.WithClaims(c.Context(), c.Params("project"), claimsOf(c), func(tx pgx.Tx) error {
+		var err error
+		result, err = queryObject(c.Context(), tx, query, id)
+		return err
+	})
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
@@ -169,6 +181,13 @@ func handleDelete(c *fiber.Ctx, fullTableName string) error {
 	return c.Send(result)
 }
 
+// claimsOf returns the JWT claims stored by auth.TenantProtected, so queries
+// run with the caller's role and claims (RLS)
+func claimsOf(c *fiber.Ctx) map[string]interface{} {
+	claims, _ := c.Locals("claims").(jwt.MapClaims)
+	return claims
+}
+
 func isValidIdentifier(s string) bool {
 	for _, r := range s {
 		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '_' {
@@ -1,54 +1,315 @@
 package api
 
 import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"baas/internal/db"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// sqlLimits returns the SQL editor limits, configured through the
+// environment: the default statement_timeout and the most a request may ask
+// for (a whole script may not run longer either), and the rows returned per
+// statement (larger results are truncated)
+func sqlLimits() (timeout, maxTimeout time.Duration, maxRows int) {
+	timeout = time.Duration(envInt("SQL_STATEMENT_TIMEOUT_MS", 30_000)) * time.Millisecond
+	maxTimeout = time.Duration(envInt("SQL_MAX_STATEMENT_TIMEOUT_MS", 300_000)) * time.Millisecond
+	maxRows = envInt("SQL_MAX_ROWS", 1000)
+	return timeout, maxTimeout, maxRows
+}
+
+// sqlProbeInterval is how often a running script checks that its client is
+// still connected (see RunSQLHandler)
+const sqlProbeInterval = 2 * time.Second
+
+// ViewerRole is the project member role restricted to read-only queries
+const ViewerRole = "viewer"
+
+// StatementResult is the outcome of one statement of a script
+type StatementResult struct {
+	Statement    string   `json:"statement"`
+	Command      string   `json:"command"` // e.g. "SELECT", "CREATE TABLE"
+	RowsAffected int64    `json:"rows_affected"`
+	Columns      []Column `json:"columns"`
+	Rows         [][]any  `json:"rows"`      // Values in column order (see encodeValue)
+	Truncated    bool     `json:"truncated"` // More rows than were returned
+}
+
+// runningQuery is a script in progress, cancellable by its ID
+type runningQuery struct {
+	project   string
+	pid       uint32 // Backend of the query's connection
+	cancelled atomic.Bool
+}
+
+// runningQueries maps query IDs to *runningQuery. Queries can only be
+// cancelled through the API instance running them.
+var runningQueries sync.Map
+
+// queryer is implemented by both *pgx.Conn and pgx.Tx
+type queryer interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+var (
+	errQueryCancelled = errors.New("query cancelled")
+	errTxEnded        = errors.New("the script must not end the transaction it runs in")
 )
 
-// RunSQLHandler executes raw SQL queries.
-// Start with high privilege (Admin/Owner only).
+// RunSQLHandler executes a SQL script in a project schema.
+// Queries run on a connection of the project's own role (see
+// db.ConnectProject), which cannot reach other schemas or baas_system.
+//
+// The script is split into statements (see splitStatements) that run one
+// after another, each returning its own result. Execution stops at the first
+// error; with "transaction": true the whole script runs in a transaction that
+// is rolled back on that error, otherwise earlier statements stay committed.
+// "read_only": true (forced for viewers) runs it in a read-only transaction
+// that is always rolled back.
+//
+// Statements are limited by "timeout_ms" (statement_timeout) and return at
+// most "max_rows" rows. The response headers, including the query ID in
+// X-Query-Id (see CancelSQLHandler), are sent before the script runs, so
+// errors while running it are reported in the body with status 200. The
+// script is cancelled if the client disconnects.
 func RunSQLHandler(c *fiber.Ctx) error {
+	project := c.Params("project")
+	if !isValidIdentifier(project) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+
 	type Request struct {
-		Query string `json:"query"`
+		Query       string `json:"query"`
+		Transaction bool   `json:"transaction"`
+		ReadOnly    bool   `json:"read_only"`
+		TimeoutMs   int    `json:"timeout_ms"`
+		MaxRows     int    `json:"max_rows"`
 	}
 	var req Request
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
 
-	if req.Query == "" {
+	statements := splitStatements(req.Query)
+	if len(statements) == 0 {
 		return c.Status(400).JSON(fiber.Map{"error": "Query is required"})
 	}
 
-	// Execute with pgx
-	// Using Query (not Exec) to return results if it's a SELECT
-	rows, err := db.Pool.Query(c.Context(), req.Query)
+	timeout, maxTimeout, maxRows := sqlLimits()
+	if req.TimeoutMs > 0 {
+		timeout = time.Duration(req.TimeoutMs) * time.Millisecond
+	}
+	if timeout > maxTimeout {
+		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("timeout_ms must be at most %d", maxTimeout.Milliseconds())})
+	}
+	if req.MaxRows > 0 && req.MaxRows < maxRows {
+		maxRows = req.MaxRows
+	}
+	if role, _ := c.Locals("project_role").(string); role == ViewerRole {
+		req.ReadOnly = true
+	}
+
+	// The script outlives the request context: the body is streamed after
+	// the handler returns
+	ctx, cancel := context.WithTimeout(context.Background(), maxTimeout)
+
+	conn, err := db.ConnectProject(ctx, project)
 	if err != nil {
-		// Return the PG error directly (useful for SQL editor feedback)
-		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		cancel()
+		return c.Status(500).JSON(fiber.Map{"error": "Could not connect as the project role: " + err.Error()})
 	}
-	defer rows.Close()
+	if _, err := conn.Exec(ctx, fmt.Sprintf("SET statement_timeout = %d", timeout.Milliseconds())); err != nil {
+		conn.Close(context.Background())
+		cancel()
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	id := newQueryID()
+	query := &runningQuery{project: project, pid: conn.PgConn().PID()}
+	runningQueries.Store(id, query)
+
+	c.Set("X-Query-Id", id)
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	c.Context().Response.ImmediateHeaderFlush = true
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer cancel()
+		defer conn.Close(context.Background())
+		defer runningQueries.Delete(id)
+
+		done := make(chan fiber.Map, 1)
+		go func() {
+			done <- runScript(ctx, conn, statements, req.Transaction, req.ReadOnly, maxRows, query)
+		}()
 
-	// Parse results into generic map
-	results := []map[string]interface{}{}
+		ticker := time.NewTicker(sqlProbeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case response := <-done:
+				response["id"] = id
+				json.NewEncoder(w).Encode(response)
+				w.Flush()
+				return
+			case <-ticker.C:
+				// Whitespace ahead of the JSON finds out whether the client
+				// is still there; if not, the script is cancelled
+				_, err := w.WriteString(" ")
+				if err == nil {
+					err = w.Flush()
+				}
+				if err != nil {
+					query.cancelled.Store(true)
+					cancel()
+					<-done
+					return
+				}
+			}
+		}
+	})
+	return nil
+}
+
+// runScript executes the statements of a script (see RunSQLHandler) and
+// returns the response body
+func runScript(ctx context.Context, conn *pgx.Conn, statements []string, transaction, readOnly bool, maxRows int, query *runningQuery) fiber.Map {
+	var q queryer = conn
+	var tx pgx.Tx
+	if transaction || readOnly {
+		var err error
+		opts := pgx.TxOptions{}
+		if readOnly {
+			opts.AccessMode = pgx.ReadOnly
+		}
+		if tx, err = conn.BeginTx(ctx, opts); err != nil {
+			return fiber.Map{"error": err.Error(), "results": []StatementResult{}}
+		}
+		defer tx.Rollback(context.Background())
+		q = tx
 
-	// Get column descriptions
-	fieldDescriptions := rows.FieldDescriptions()
+		// Take the transaction's snapshot, after which the script can no
+		// longer switch it to SET TRANSACTION READ WRITE
+		if _, err := tx.Exec(ctx, "SELECT 1"); err != nil {
+			return fiber.Map{"error": err.Error(), "results": []StatementResult{}}
+		}
+	}
 
-	for rows.Next() {
-		// pgx dynamic scanning is a bit tricky, we need to scan into generic values
-		values, err := rows.Values()
+	results := []StatementResult{}
+	for i, stmt := range statements {
+		var result StatementResult
+		err := errQueryCancelled
+		if !query.cancelled.Load() {
+			result, err = runStatement(ctx, q, stmt, maxRows)
+		}
+		if err == nil && tx != nil && conn.PgConn().TxStatus() != 'T' {
+			// A COMMIT or ROLLBACK in the script: what follows would run
+			// outside the transaction (and no longer read-only)
+			err = errTxEnded
+		}
 		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			// Return the PG error directly (useful for SQL editor feedback)
+			return fiber.Map{
+				"error":            err.Error(),
+				"failed_statement": i,
+				"results":          results,
+				"rolled_back":      tx != nil,
+				"cancelled":        query.cancelled.Load(),
+			}
 		}
+		results = append(results, result)
+	}
 
-		rowMap := make(map[string]interface{})
-		for i, field := range fieldDescriptions {
-			rowMap[string(field.Name)] = values[i]
+	if tx != nil && !readOnly {
+		if err := tx.Commit(ctx); err != nil {
+			return fiber.Map{"error": err.Error(), "results": results, "rolled_back": true}
 		}
-		results = append(results, rowMap)
 	}
+	return fiber.Map{"results": results}
+}
+
+// runStatement executes a single statement and collects up to maxRows rows
+func runStatement(ctx context.Context, q queryer, stmt string, maxRows int) (StatementResult, error) {
+	result := StatementResult{Statement: stmt}
+
+	// Using Query (not Exec) to return results if it's a SELECT
+	rows, err := q.Query(ctx, stmt)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	m := rows.Conn().TypeMap()
+	fields := append([]pgconn.FieldDescription(nil), rows.FieldDescriptions()...)
+	result.Rows, result.Truncated, err = readRows(rows, maxRows)
+	if err != nil {
+		return result, err
+	}
+	// Close discards the remaining rows
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	tag := rows.CommandTag()
+	result.Command = commandName(tag.String())
+	result.RowsAffected = tag.RowsAffected()
+	result.Columns, err = describeColumns(ctx, q, m, fields)
+	return result, err
+}
+
+// CancelSQLHandler cancels a running script (see RunSQLHandler) with
+// pg_cancel_backend. The script stops at the cancelled statement.
+func CancelSQLHandler(c *fiber.Ctx) error {
+	value, ok := runningQueries.Load(c.Params("id"))
+	if !ok || value.(*runningQuery).project != c.Params("project") {
+		return c.Status(404).JSON(fiber.Map{"error": "Query not found or already finished"})
+	}
+	query := value.(*runningQuery)
+	query.cancelled.Store(true)
+
+	// Between statements there is nothing to signal; the flag stops the script
+	_, err := db.Pool.Exec(context.Background(), "SELECT pg_cancel_backend($1)", int64(query.pid))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not cancel query: " + err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "Query cancelled"})
+}
+
+// commandName strips the row counts from a command tag ("INSERT 0 3" -> "INSERT")
+func commandName(tag string) string {
+	fields := strings.Fields(tag)
+	for len(fields) > 1 && strings.Trim(fields[len(fields)-1], "0123456789") == "" {
+		fields = fields[:len(fields)-1]
+	}
+	return strings.Join(fields, " ")
+}
 
-	return c.JSON(results)
+func newQueryID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return hex.EncodeToString(b)
+}
+
+// envInt reads an integer setting, falling back to def
+func envInt(name string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return n
+	}
+	return def
 }
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"strings"
+	"unicode"
+)
+
+// splitStatements splits a SQL script into its statements on top-level
+// semicolons. Semicolons inside string literals ('...', E'...'), quoted
+// identifiers, dollar-quoted bodies ($$...$$, $tag$...$tag$) and comments
+// (-- and nested /* */) do not end a statement. Statements consisting only
+// of comments and whitespace are dropped.
+//
+// SQL-standard function bodies (BEGIN ATOMIC ... END) are not recognized;
+// write those with a dollar-quoted body instead.
+func splitStatements(script string) []string {
+	var statements []string
+	start := 0
+	hasCode := false // Anything but comments and whitespace since start
+
+	flush := func(end int) {
+		if hasCode {
+			statements = append(statements, strings.TrimSpace(script[start:end]))
+		}
+		start = end + 1
+		hasCode = false
+	}
+
+	for i := 0; i < len(script); i++ {
+		ch := script[i]
+		switch {
+		case ch == ';':
+			flush(i)
+
+		case ch == '-' && i+1 < len(script) && script[i+1] == '-':
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				i = len(script)
+			} else {
+				i += end
+			}
+
+		case ch == '/' && i+1 < len(script) && script[i+1] == '*':
+			// Block comments nest in Postgres
+			depth := 1
+			i += 2
+			for ; i < len(script) && depth > 0; i++ {
+				if strings.HasPrefix(script[i:], "/*") {
+					depth++
+					i++
+				} else if strings.HasPrefix(script[i:], "*/") {
+					depth--
+					i++
+				}
+			}
+			i--
+
+		case ch == '\'':
+			hasCode = true
+			escapes := i > 0 && (script[i-1] == 'E' || script[i-1] == 'e') && (i < 2 || !isIdentChar(script[i-2]))
+			i = skipQuoted(script, i, '\'', escapes)
+
+		case ch == '"':
+			hasCode = true
+			i = skipQuoted(script, i, '"', false)
+
+		case ch == '$':
+			hasCode = true
+			if tag, ok := dollarTag(script, i); ok {
+				end := strings.Index(script[i+len(tag):], tag)
+				if end < 0 {
+					i = len(script)
+				} else {
+					i += len(tag) + end + len(tag) - 1
+				}
+			}
+
+		case !unicode.IsSpace(rune(ch)):
+			hasCode = true
+		}
+	}
+	if start < len(script) {
+		flush(len(script))
+	}
+	return statements
+}
+
+// skipQuoted returns the index of the quote closing the literal opened at
+// script[i]. Doubled quotes (and backslashes in E'...' strings) are escapes.
+func skipQuoted(script string, i int, quote byte, backslashEscapes bool) int {
+	for i++; i < len(script); i++ {
+		switch script[i] {
+		case '\\':
+			if backslashEscapes {
+				i++
+			}
+		case quote:
+			if i+1 < len(script) && script[i+1] == quote {
+				i++
+				continue
+			}
+			return i
+		}
+	}
+	return len(script)
+}
+
+// dollarTag returns the $tag$ starting at script[i], if any. A $ following
+// an identifier character ($1 parameters, names like a$b) starts no tag.
+func dollarTag(script string, i int) (string, bool) {
+	if i > 0 && isIdentChar(script[i-1]) {
+		return "", false
+	}
+	for j := i + 1; j < len(script); j++ {
+		ch := script[j]
+		if ch == '$' {
+			return script[i : j+1], true
+		}
+		if !isIdentChar(ch) || (j == i+1 && ch >= '0' && ch <= '9') {
+			return "", false
+		}
+	}
+	return "", false
+}
+
+func isIdentChar(ch byte) bool {
+	return ch == '_' || ch >= 0x80 || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9')
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{"empty", "", nil},
+		{"whitespace only", "  \n\t ", nil},
+		{"single without semicolon", "SELECT 1", []string{"SELECT 1"}},
+		{"single with semicolon", "SELECT 1;", []string{"SELECT 1"}},
+		{"several", "SELECT 1; SELECT 2;\nSELECT 3", []string{"SELECT 1", "SELECT 2", "SELECT 3"}},
+		{"empty statements", ";; SELECT 1;;", []string{"SELECT 1"}},
+		{"semicolon in string", "SELECT 'a;b'; SELECT 2", []string{"SELECT 'a;b'", "SELECT 2"}},
+		{"doubled quote", "SELECT 'it''s;'; SELECT 2", []string{"SELECT 'it''s;'", "SELECT 2"}},
+		{"backslash in standard string", `SELECT 'a\'; SELECT 2`, []string{`SELECT 'a\'`, "SELECT 2"}},
+		{"escape string", `SELECT E'a\';b'; SELECT 2`, []string{`SELECT E'a\';b'`, "SELECT 2"}},
+		{"identifier ending in e", `SELECT name'a\'; SELECT 2`, []string{`SELECT name'a\'`, "SELECT 2"}},
+		{"quoted identifier", `SELECT 1 AS "a;b"; SELECT 2`, []string{`SELECT 1 AS "a;b"`, "SELECT 2"}},
+		{"line comment", "SELECT 1; -- a; b\nSELECT 2", []string{"SELECT 1", "-- a; b\nSELECT 2"}},
+		{"trailing line comment", "SELECT 1; -- done;", []string{"SELECT 1"}},
+		{"block comment", "SELECT 1 /* ; */; SELECT 2", []string{"SELECT 1 /* ; */", "SELECT 2"}},
+		{"nested block comment", "SELECT 1 /* /* ; */ ; */; SELECT 2", []string{"SELECT 1 /* /* ; */ ; */", "SELECT 2"}},
+		{"comment only statement", "SELECT 1; /* nothing */ ;", []string{"SELECT 1"}},
+		{
+			"dollar quoted body",
+			"CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql; SELECT f()",
+			[]string{"CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql", "SELECT f()"},
+		},
+		{
+			"tagged dollar quote",
+			"DO $body$ BEGIN PERFORM '$$;'; END $body$; SELECT 2",
+			[]string{"DO $body$ BEGIN PERFORM '$$;'; END $body$", "SELECT 2"},
+		},
+		{"positional parameter", "PREPARE p AS SELECT $1; EXECUTE p(1)", []string{"PREPARE p AS SELECT $1", "EXECUTE p(1)"}},
+		{"dollar in identifier", "SELECT a$b$c; SELECT 2", []string{"SELECT a$b$c", "SELECT 2"}},
+		{"unterminated string", "SELECT 'a; SELECT 2", []string{"SELECT 'a; SELECT 2"}},
+		{"unterminated dollar quote", "DO $$ BEGIN; SELECT 2", []string{"DO $$ BEGIN; SELECT 2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitStatements(tt.script); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitStatements(%q) = %q, want %q", tt.script, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommandName(t *testing.T) {
+	tests := []struct {
+		tag, want string
+	}{
+		{"SELECT 3", "SELECT"},
+		{"INSERT 0 3", "INSERT"},
+		{"CREATE TABLE", "CREATE TABLE"},
+		{"ALTER DEFAULT PRIVILEGES", "ALTER DEFAULT PRIVILEGES"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := commandName(tt.tag); got != tt.want {
+			t.Errorf("commandName(%q) = %q, want %q", tt.tag, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+
+	"baas/internal/db"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// AnonymousSignIn creates an anonymous user and returns a tenant token for it.
+// The user can later link an email and password via PUT /:project/auth/user
+// without changing its id, so rows it created stay attached to it.
+func AnonymousSignIn(c *fiber.Ctx) error {
+	projectID := c.Params("project")
+	if !isValidProject(projectID) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+
+	settings, err := loadSettings(context.Background(), projectID)
+	if err != nil {
+		if err == errProjectNotFound {
+			return c.Status(404).JSON(fiber.Map{"error": "Project not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Could not load auth settings"})
+	}
+	if !settings.EnableAnonymousSignin {
+		return c.Status(403).JSON(fiber.Map{"error": "Anonymous sign-ins are disabled for this project"})
+	}
+
+	if _, err := runHooks(context.Background(), projectID, HookBeforeSignup, fiber.Map{"is_anonymous": true}); err != nil {
+		return respondHookError(c, err)
+	}
+
+	var user User
+	query := fmt.Sprintf("INSERT INTO %s.users (is_anonymous) VALUES (TRUE) RETURNING %s", projectID, userColumns)
+	if err := scanUser(db.Pool.QueryRow(context.Background(), query), &user); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not create anonymous user"})
+	}
+
+	extra, err := runHooks(context.Background(), projectID, HookAfterSignin, user)
+	if err != nil {
+		return respondHookError(c, err)
+	}
+
+	resp, err := startSession(c, projectID, user, extra)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not login"})
+	}
+
+	recordEvent(c, projectID, EventAnonymousSignin, user.ID, nil)
+	return c.JSON(resp)
+}
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"baas/internal/db"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Auth events recorded in the project's auth_audit_log table
+const (
+	EventSignup               = "signup"
+	EventUserCreated          = "user_created" // By an admin
+	EventSignin               = "signin"
+	EventSigninFailed         = "signin_failed"
+	EventAnonymousSignin      = "anonymous_signin"
+	EventTokenRefreshed       = "token_refreshed"
+	EventLogout               = "logout"
+	EventPasswordChanged      = "password_changed"
+	EventEmailConfirmed       = "email_confirmed"
+	EventEmailChanged         = "email_changed"
+	EventEmailChangeRequested = "email_change_requested"
+	EventIdentityLinked       = "identity_linked" // Anonymous user linked an email
+	EventUserUpdated          = "user_updated"    // By an admin
+	EventUserDeleted          = "user_deleted"    // By an admin
+	EventImpersonation        = "impersonation"   // Admin minted a token for the user
+)
+
+// recordEvent appends an auth event to the project's audit log.
+// Failures are only logged: auditing must never break the auth flow.
+func recordEvent(c *fiber.Ctx, projectID, event, userID string, payload fiber.Map) {
+	if payload == nil {
+		payload = fiber.Map{}
+	}
+	data, _ := json.Marshal(payload)
+
+	// Platform admins act through Protected() routes, end-users through tenant routes
+	var actorID *string
+	if admin, ok := c.Locals("admin_id").(string); ok && admin != "" {
+		actorID = &admin
+	}
+	var user *string
+	if userID != "" {
+		user = &userID
+	}
+
+	query := fmt.Sprintf(`
+		INSERT INTO %s.auth_audit_log (event, user_id, actor_id, ip, user_agent, payload)
+		VALUES ($1, $2, $3, $4, $5, $6)`, projectID)
+	_, err := db.Pool.Exec(context.Background(), query, event, user, actorID, c.IP(), c.Get(fiber.HeaderUserAgent), data)
+	if err != nil {
+		log.Printf("Could not record auth event %q for project %q: %v\n", event, projectID, err)
+	}
+}
+
+// ListAuditLogHandler returns auth events of a project (Admin only).
+// Filters: ?event=signin,signin_failed&user_id=...&since=RFC3339&until=RFC3339&limit=100&offset=0
+func ListAuditLogHandler(c *fiber.Ctx) error {
+	projectID := c.Params("project")
+	if !isValidProject(projectID) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+
+	conds := []string{}
+	values := []interface{}{}
+	add := func(expr string, v interface{}) {
+		values = append(values, v)
+		conds = append(conds, fmt.Sprintf(expr, len(values)))
+	}
+
+	if events := c.Query("event"); events != "" {
+		add("event = ANY($%d)", strings.Split(events, ","))
+	}
+	if userID := c.Query("user_id"); userID != "" {
+		add("user_id::text = $%d", userID)
+	}
+	if ip := c.Query("ip"); ip != "" {
+		add("ip = $%d", ip)
+	}
+	for _, f := range []struct{ param, expr string }{{"since", "created_at >= $%d"}, {"until", "created_at < $%d"}} {
+		if v := c.Query(f.param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "Invalid '" + f.param + "', expected RFC3339"})
+			}
+			add(f.expr, t)
+		}
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", "100"))
+	if err != nil || limit < 1 || limit > 1000 {
+		return c.Status(400).JSON(fiber.Map{"error": "limit must be between 1 and 1000"})
+	}
+	offset, err := strconv.Atoi(c.Query("offset", "0"))
+	if err != nil || offset < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid offset"})
+	}
+
+	where := ""
+	if len(conds) > 0 {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	}
+	query := fmt.Sprintf(`
+		SELECT id, event, user_id::text, actor_id, ip, user_agent, payload, created_at
+		FROM %s.auth_audit_log %s
+		ORDER BY created_at DESC, id DESC
+		LIMIT %d OFFSET %d`, projectID, where, limit, offset)
+
+	rows, err := db.Pool.Query(context.Background(), query, values...)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch audit log"})
+	}
+	defer rows.Close()
+
+	type Entry struct {
+		ID        int64                  `json:"id"`
+		Event     string                 `json:"event"`
+		UserID    *string                `json:"user_id"`
+		ActorID   *string                `json:"actor_id"`
+		IP        *string                `json:"ip"`
+		UserAgent *string                `json:"user_agent"`
+		Payload   map[string]interface{} `json:"payload"`
+		CreatedAt time.Time              `json:"created_at"`
+	}
+
+	entries := []Entry{}
+	for rows.Next() {
+		var e Entry
+		if err := rows.Scan(&e.ID, &e.Event, &e.UserID, &e.ActorID, &e.IP, &e.UserAgent, &e.Payload, &e.CreatedAt); err == nil {
+			entries = append(entries, e)
+		}
+	}
+	return c.JSON(entries)
+}
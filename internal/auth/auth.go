@@ -2,6 +2,8 @@ package auth
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"time"
 
@@ -86,6 +88,57 @@ func SignInHandler(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"token": t})
 }
 
+// Errors returned by ValidateTenantToken
+var (
+	ErrInvalidToken = errors.New("Invalid or expired token")
+	ErrWrongProject = errors.New("Access denied: Token not valid for this project")
+)
+
+// ValidateTenantToken checks a token against the rules of TenantProtected:
+// valid signature and expiry, and either a platform admin token or a tenant
+// token whose audience is the requested project.
+func ValidateTenantToken(tokenString, project string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return SecretKey, nil
+	})
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	// 1. Check if Platform Admin
+	if role, ok := claims["role"].(string); ok && role == "admin" {
+		return claims, nil
+	}
+
+	// 2. If not admin, check Tenant Audience
+	// CRITICAL: Check 'aud' (Audience) claim
+	// The audience must match the Project ID requested in the URL
+	tokenProject, ok := claims["aud"].(string)
+	if !ok || project != tokenProject {
+		return nil, ErrWrongProject
+	}
+	return claims, nil
+}
+
+// SessionActive reports whether the refresh token session a tenant token was
+// issued for is still valid (not revoked, e.g. by logout or a ban).
+// Tokens without a session (platform admins, impersonation) are always active.
+func SessionActive(ctx context.Context, project string, claims jwt.MapClaims) (bool, error) {
+	sessionID, _ := claims["session_id"].(string)
+	if sessionID == "" || !isValidProject(project) {
+		return true, nil
+	}
+	var active bool
+	query := fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM %s.auth_sessions WHERE id::text = $1 AND revoked_at IS NULL)", project)
+	err := db.Pool.QueryRow(ctx, query, sessionID).Scan(&active)
+	return active, err
+}
+
 // TenantProtected Middleware: Ensures token belongs to the specific Project
 func TenantProtected() fiber.Handler {
 	return func(c *fiber.Ctx) error {
@@ -101,38 +154,39 @@ func TenantProtected() fiber.Handler {
 			return c.Status(401).JSON(fiber.Map{"error": "Malformed token"})
 		}
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return SecretKey, nil
-		})
-
-		if err != nil || !token.Valid {
-			return c.Status(401).JSON(fiber.Map{"error": "Invalid or expired token"})
+		claims, err := ValidateTenantToken(tokenString, c.Params("project"))
+		if err != nil {
+			status := 401
+			if err == ErrWrongProject {
+				status = 403
+			}
+			return c.Status(status).JSON(fiber.Map{"error": err.Error()})
 		}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			return c.Status(401).JSON(fiber.Map{"error": "Invalid token claims"})
+		// Access tokens stay valid until they expire; logout and bans revoke
+		// the session they were issued for
+		active, err := SessionActive(c.Context(), c.Params("project"), claims)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Could not verify session"})
+		}
+		if !active {
+			return c.Status(401).JSON(fiber.Map{"error": "Session revoked"})
 		}
 
-		// 1. Check if Platform Admin
+		// Downstream handlers apply the claims to the database session (RLS)
+		c.Locals("claims", claims)
+
+		// Platform Admin
 		if role, ok := claims["role"].(string); ok && role == "admin" {
 			c.Locals("user_id", claims["sub"])
 			c.Locals("project_id", c.Params("project"))
 			return c.Next()
 		}
 
-		// 2. If not admin, check Tenant Audience
-		// CRITICAL: Check 'aud' (Audience) claim
-		// The audience must match the Project ID requested in the URL
-		requestedProject := c.Params("project")
-		tokenProject, ok := claims["aud"].(string)
-
-		if !ok || requestedProject != tokenProject {
-			return c.Status(403).JSON(fiber.Map{"error": "Access denied: Token not valid for this project"})
-		}
-
+		tokenProject := claims["aud"].(string)
 		c.Locals("user_id", claims["sub"])
 		c.Locals("project_id", tokenProject)
+		c.Locals("session_id", claims["session_id"])
 
 		return c.Next()
 	}
@@ -162,7 +216,15 @@ func Protected() fiber.Handler {
 		}
 
 		claims := token.Claims.(jwt.MapClaims)
+
+		// Tenant tokens (including impersonation tokens) share the signing key,
+		// so the role must be checked explicitly
+		if role, _ := claims["role"].(string); role != "admin" {
+			return c.Status(403).JSON(fiber.Map{"error": "Platform admin token required"})
+		}
+
 		c.Locals("user_id", claims["sub"])
+		c.Locals("admin_id", claims["sub"])
 
 		return c.Next()
 	}
@@ -0,0 +1,332 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"baas/internal/db"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Hook points
+const (
+	HookBeforeSignup = "before_signup"
+	HookAfterSignin  = "after_signin"
+)
+
+// hookTimeout bounds every hook invocation so a slow hook cannot hang auth
+const hookTimeout = 5 * time.Second
+
+// Hook is a project-defined extension of the auth flow.
+//
+// Both hook types receive the same JSON document:
+//
+//	{"hook_point": "...", "project": "...", "user": {...}, "claims": {...}}
+//
+// and answer with:
+//
+//	{"decision": "reject", "message": "..."}  to veto the signup / sign-in
+//	{"claims": {...}}                         to add claims (after_signin only)
+//
+// "http" hooks are POSTed the document with an X-Hanbase-Signature header
+// (hex HMAC-SHA256 of the body keyed with the hook secret). "sql" hooks name
+// a function in the project schema taking and returning jsonb.
+type Hook struct {
+	ID        string    `json:"id"`
+	HookPoint string    `json:"hook_point"`
+	Type      string    `json:"type"`
+	Target    string    `json:"target"`
+	Secret    *string   `json:"secret,omitempty"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type hookResult struct {
+	Decision string        `json:"decision"`
+	Message  string        `json:"message"`
+	Claims   jwt.MapClaims `json:"claims"`
+}
+
+// errHookRejected carries the message of a hook that vetoed the operation
+type errHookRejected struct{ message string }
+
+func (e errHookRejected) Error() string { return e.message }
+
+// reservedClaims cannot be overridden by hooks
+var reservedClaims = map[string]bool{
+	"sub": true, "aud": true, "exp": true, "iat": true, "nbf": true, "iss": true,
+	"role": true, "session_id": true, "is_anonymous": true, "impersonated_by": true,
+}
+
+// runHooks invokes the enabled hooks of a hook point in creation order and
+// returns the merged claims. A rejection is returned as errHookRejected; a
+// failing hook fails the operation (hooks are treated as policy).
+func runHooks(ctx context.Context, projectID, hookPoint string, user interface{}) (jwt.MapClaims, error) {
+	query := `
+		SELECT h.type, h.target, h.secret
+		FROM baas_system.auth_hooks h
+		JOIN baas_system.projects p ON p.id = h.project_id
+		WHERE p.slug = $1 AND h.hook_point = $2 AND h.enabled
+		ORDER BY h.created_at
+	`
+	rows, err := db.Pool.Query(ctx, query, projectID, hookPoint)
+	if err != nil {
+		return nil, err
+	}
+	type hookRow struct {
+		typ, target string
+		secret      *string
+	}
+	var hooks []hookRow
+	for rows.Next() {
+		var h hookRow
+		if err := rows.Scan(&h.typ, &h.target, &h.secret); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		hooks = append(hooks, h)
+	}
+	rows.Close()
+
+	claims := jwt.MapClaims{}
+	for _, h := range hooks {
+		doc, _ := json.Marshal(fiber.Map{
+			"hook_point": hookPoint,
+			"project":    projectID,
+			"user":       user,
+			"claims":     claims,
+		})
+
+		var res hookResult
+		switch h.typ {
+		case "http":
+			res, err = callHTTPHook(ctx, h.target, h.secret, doc)
+		case "sql":
+			res, err = callSQLHook(ctx, projectID, h.target, doc)
+		default:
+			err = fmt.Errorf("unknown hook type %q", h.typ)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s hook %q failed: %w", h.typ, h.target, err)
+		}
+
+		if res.Decision == "reject" {
+			if res.Message == "" {
+				res.Message = "Rejected by auth hook"
+			}
+			return nil, errHookRejected{res.Message}
+		}
+		for k, v := range res.Claims {
+			if !reservedClaims[k] {
+				claims[k] = v
+			}
+		}
+	}
+	return claims, nil
+}
+
+// hookClient calls HTTP hooks. Hook URLs are chosen by project owners, so it
+// refuses to connect to loopback, private, link-local, unspecified and
+// multicast addresses (checked after DNS resolution, for every address
+// dialed) and does not follow redirects.
+var hookClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: hookTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || !isPublicIP(ip) {
+					return fmt.Errorf("hook address %s is not allowed", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: hookTimeout,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// isPublicIP reports whether ip is a globally routable unicast address
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified())
+}
+
+func callHTTPHook(ctx context.Context, target string, secret *string, doc []byte) (hookResult, error) {
+	var res hookResult
+
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(doc))
+	if err != nil {
+		return res, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != nil && *secret != "" {
+		mac := hmac.New(sha256.New, []byte(*secret))
+		mac.Write(doc)
+		req.Header.Set("X-Hanbase-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return res, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return res, err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return res, nil // Empty body means "continue"
+	}
+	err = json.Unmarshal(body, &res)
+	return res, err
+}
+
+func callSQLHook(ctx context.Context, projectID, function string, doc []byte) (hookResult, error) {
+	var res hookResult
+
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+
+	// Runs as the project's role (not the server's), so the function can
+	// only do what the project's own SQL could
+	conn, err := db.ConnectProject(ctx, projectID)
+	if err != nil {
+		return res, err
+	}
+	defer conn.Close(context.Background())
+
+	var out []byte
+	query := fmt.Sprintf("SELECT %s.%s($1::jsonb)", projectID, function)
+	if err := conn.QueryRow(ctx, query, doc).Scan(&out); err != nil {
+		return res, err
+	}
+	if out == nil {
+		return res, nil
+	}
+	err = json.Unmarshal(out, &res)
+	return res, err
+}
+
+// respondHookError maps a runHooks error to an HTTP response
+func respondHookError(c *fiber.Ctx, err error) error {
+	var rejected errHookRejected
+	if errors.As(err, &rejected) {
+		return c.Status(403).JSON(fiber.Map{"error": rejected.message})
+	}
+	// The details (hook URL, the project's SQL errors) are for the logs only
+	log.Printf("Auth hook of project %q failed: %v\n", c.Params("project"), err)
+	return c.Status(502).JSON(fiber.Map{"error": "Auth hook failed"})
+}
+
+// ListHooksHandler lists the auth hooks of a project (Project owners only)
+func ListHooksHandler(c *fiber.Ctx) error {
+	query := `
+		SELECT h.id, h.hook_point, h.type, h.target, h.enabled, h.created_at
+		FROM baas_system.auth_hooks h
+		JOIN baas_system.projects p ON p.id = h.project_id
+		WHERE p.slug = $1
+		ORDER BY h.created_at
+	`
+	rows, err := db.Pool.Query(context.Background(), query, c.Params("project"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch hooks"})
+	}
+	defer rows.Close()
+
+	hooks := []Hook{}
+	for rows.Next() {
+		var h Hook
+		if err := rows.Scan(&h.ID, &h.HookPoint, &h.Type, &h.Target, &h.Enabled, &h.CreatedAt); err == nil {
+			hooks = append(hooks, h)
+		}
+	}
+	return c.JSON(hooks)
+}
+
+// CreateHookHandler registers an auth hook (Project owners only)
+func CreateHookHandler(c *fiber.Ctx) error {
+	var h Hook
+	h.Enabled = true
+	if err := c.BodyParser(&h); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if h.HookPoint != HookBeforeSignup && h.HookPoint != HookAfterSignin {
+		return c.Status(400).JSON(fiber.Map{"error": "hook_point must be 'before_signup' or 'after_signin'"})
+	}
+	switch h.Type {
+	case "http":
+		u, err := url.Parse(h.Target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return c.Status(400).JSON(fiber.Map{"error": "target must be an http(s) URL"})
+		}
+	case "sql":
+		if !isValidProject(h.Target) { // Same identifier rules as schema names
+			return c.Status(400).JSON(fiber.Map{"error": "target must be a function name in the project schema"})
+		}
+	default:
+		return c.Status(400).JSON(fiber.Map{"error": "type must be 'http' or 'sql'"})
+	}
+
+	query := `
+		INSERT INTO baas_system.auth_hooks (project_id, hook_point, type, target, secret, enabled)
+		SELECT id, $2, $3, $4, $5, $6 FROM baas_system.projects WHERE slug = $1
+		RETURNING id, created_at
+	`
+	err := db.Pool.QueryRow(context.Background(), query, c.Params("project"), h.HookPoint, h.Type, h.Target, h.Secret, h.Enabled).Scan(&h.ID, &h.CreatedAt)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not create hook"})
+	}
+
+	h.Secret = nil
+	return c.JSON(h)
+}
+
+// DeleteHookHandler removes an auth hook (Project owners only)
+func DeleteHookHandler(c *fiber.Ctx) error {
+	query := `
+		DELETE FROM baas_system.auth_hooks h
+		USING baas_system.projects p
+		WHERE p.id = h.project_id AND p.slug = $1 AND h.id::text = $2
+	`
+	tag, err := db.Pool.Exec(context.Background(), query, c.Params("project"), c.Params("id"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete hook"})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Hook not found"})
+	}
+	return c.JSON(fiber.Map{"message": "Hook deleted"})
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultImpersonationTTL = 15 * time.Minute
+	maxImpersonationTTL     = time.Hour
+)
+
+// ImpersonateUserHandler mints a short-lived tenant token for a project user
+// (Project owners only), so support engineers can reproduce RLS and data
+// issues as that user without knowing their password.
+// The token carries an "impersonated_by" claim, has no refresh token and is
+// recorded in the audit log.
+func ImpersonateUserHandler(c *fiber.Ctx) error {
+	projectID := c.Params("project")
+	if !isValidProject(projectID) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+	adminID, _ := c.Locals("admin_id").(string)
+
+	type Request struct {
+		TTLSeconds int    `json:"ttl_seconds"`
+		Reason     string `json:"reason"`
+	}
+	var req Request
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+	}
+
+	ttl := defaultImpersonationTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	if ttl > maxImpersonationTTL {
+		return c.Status(400).JSON(fiber.Map{"error": "ttl_seconds must be at most 3600"})
+	}
+
+	u, err := getUser(context.Background(), projectID, c.Params("id"))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	claims := tenantClaims(projectID, u, "", nil)
+	claims["impersonated_by"] = adminID
+	claims["exp"] = expiresAt.Unix()
+
+	t, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(SecretKey)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not issue token"})
+	}
+
+	recordEvent(c, projectID, EventImpersonation, u.ID, fiber.Map{
+		"expires_at": expiresAt,
+		"reason":     req.Reason,
+	})
+
+	return c.JSON(fiber.Map{
+		"access_token":    t,
+		"token_type":      "bearer",
+		"expires_in":      int(ttl.Seconds()),
+		"impersonated_by": adminID,
+		"user":            u,
+	})
+}
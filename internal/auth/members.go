@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"context"
+
+	"baas/internal/db"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequireProjectRole Middleware: Ensures the platform user (see Protected)
+// is a member of the :project with one of the given roles (any role when
+// none are given).
+// Projects without any member (created before memberships were recorded and
+// not yet given an owner by admin.MigrateProjects) are closed to everyone.
+func RequireProjectRole(roles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID, _ := c.Locals("admin_id").(string)
+		if userID == "" {
+			return c.Status(403).JSON(fiber.Map{"error": "Platform admin token required"})
+		}
+
+		query := `
+			SELECT (SELECT m.role FROM baas_system.project_members m WHERE m.project_id = p.id AND m.user_id::text = $2)
+			FROM baas_system.projects p
+			WHERE p.slug = $1
+		`
+		var role *string
+		err := db.Pool.QueryRow(context.Background(), query, c.Params("project"), userID).Scan(&role)
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Project not found"})
+		}
+
+		if role != nil {
+			if len(roles) == 0 {
+				c.Locals("project_role", *role)
+				return c.Next()
+			}
+			for _, r := range roles {
+				if *role == r {
+					c.Locals("project_role", *role)
+					return c.Next()
+				}
+			}
+		}
+		return c.Status(403).JSON(fiber.Map{"error": "Access denied: insufficient project role"})
+	}
+}
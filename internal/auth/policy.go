@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// validateEmail checks the address format and the project's domain lists.
+// It returns the normalized (lower-cased) address.
+func validateEmail(s Settings, email string) (string, error) {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != strings.TrimSpace(email) {
+		return "", errors.New("Invalid email address")
+	}
+	normalized := strings.ToLower(addr.Address)
+	domain := normalized[strings.LastIndex(normalized, "@")+1:]
+
+	for _, d := range s.EmailDenyDomains {
+		if domainMatches(domain, d) {
+			return "", errors.New("Email domain is not allowed")
+		}
+	}
+	if len(s.EmailAllowDomains) > 0 {
+		allowed := false
+		for _, d := range s.EmailAllowDomains {
+			if domainMatches(domain, d) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "", errors.New("Email domain is not allowed")
+		}
+	}
+	return normalized, nil
+}
+
+// domainMatches reports whether domain equals rule or is a subdomain of it
+func domainMatches(domain, rule string) bool {
+	return domain == rule || strings.HasSuffix(domain, "."+rule)
+}
+
+// validatePassword enforces the project's password policy
+func validatePassword(s Settings, password string) error {
+	if len(password) < s.PasswordMinLength {
+		return fmt.Errorf("Password must be at least %d characters", s.PasswordMinLength)
+	}
+	if len(password) > 72 {
+		return errors.New("Password must be at most 72 bytes")
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	if s.PasswordRequireLowercase && !lower {
+		return errors.New("Password must contain a lowercase letter")
+	}
+	if s.PasswordRequireUppercase && !upper {
+		return errors.New("Password must contain an uppercase letter")
+	}
+	if s.PasswordRequireDigit && !digit {
+		return errors.New("Password must contain a digit")
+	}
+	if s.PasswordRequireSymbol && !symbol {
+		return errors.New("Password must contain a symbol")
+	}
+
+	if s.CheckBreachedPasswords {
+		breached, err := isBreachedPassword(password)
+		if err != nil {
+			// Fail open: a missing list must not block every signup
+			log.Println("Breached password check skipped:", err)
+		} else if breached {
+			return errors.New("Password has appeared in a data breach, please choose another one")
+		}
+	}
+	return nil
+}
+
+// isBreachedPassword looks the password up in a local copy of the
+// "Pwned Passwords" range files. BREACHED_PASSWORDS_DIR must contain one file
+// per 5 character SHA-1 prefix (named "ABCDE" or "ABCDE.txt") whose lines are
+// "SUFFIX:COUNT", the format produced by the official downloader.
+func isBreachedPassword(password string) (bool, error) {
+	dir := os.Getenv("BREACHED_PASSWORDS_DIR")
+	if dir == "" {
+		return false, errors.New("BREACHED_PASSWORDS_DIR is not set")
+	}
+
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(dir, prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		f, err = os.Open(filepath.Join(dir, prefix))
+	}
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil // No breached hashes with this prefix
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			line = line[:i]
+		}
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"baas/internal/db"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// refreshTokenIdleTTL is how long an unused refresh token stays valid
+const refreshTokenIdleTTL = "30 days"
+
+// startSession creates a refresh token session for the user and returns
+// the token response sent to clients. extra holds claims added by
+// after_signin hooks; they are kept on the session so refreshed tokens
+// carry them too.
+func startSession(c *fiber.Ctx, projectID string, u User, extra jwt.MapClaims) (fiber.Map, error) {
+	if extra == nil {
+		extra = jwt.MapClaims{}
+	}
+	claims, _ := json.Marshal(extra)
+	refreshToken := randomToken()
+
+	var sessionID string
+	query := fmt.Sprintf(`
+		INSERT INTO %s.auth_sessions (user_id, refresh_token_hash, claims, ip, user_agent)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`, projectID)
+	err := db.Pool.QueryRow(context.Background(), query, u.ID, hashToken(refreshToken), claims, c.IP(), c.Get(fiber.HeaderUserAgent)).Scan(&sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return tokenResponse(projectID, u, sessionID, refreshToken, extra)
+}
+
+func tokenResponse(projectID string, u User, sessionID, refreshToken string, extra jwt.MapClaims) (fiber.Map, error) {
+	t, err := issueTenantToken(projectID, u, sessionID, extra)
+	if err != nil {
+		return nil, err
+	}
+	return fiber.Map{
+		"access_token":  t,
+		"token_type":    "bearer",
+		"expires_in":    int(tenantTokenTTL.Seconds()),
+		"refresh_token": refreshToken,
+		"user":          u,
+	}, nil
+}
+
+// RefreshTokenHandler exchanges a refresh token for a new access token.
+// Refresh tokens are single use: a new one is returned every time.
+func RefreshTokenHandler(c *fiber.Ctx) error {
+	projectID := c.Params("project")
+	if !isValidProject(projectID) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+	type Request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	var req Request
+	if err := c.BodyParser(&req); err != nil || req.RefreshToken == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "refresh_token required"})
+	}
+
+	ctx := context.Background()
+	newToken := randomToken()
+
+	var sessionID, userID string
+	var extra jwt.MapClaims
+	query := fmt.Sprintf(`
+		UPDATE %s.auth_sessions
+		SET refresh_token_hash = $2, refreshed_at = NOW()
+		WHERE refresh_token_hash = $1 AND revoked_at IS NULL
+		  AND refreshed_at > NOW() - INTERVAL '%s'
+		RETURNING id, user_id, claims`, projectID, refreshTokenIdleTTL)
+	err := db.Pool.QueryRow(ctx, query, hashToken(req.RefreshToken), hashToken(newToken)).Scan(&sessionID, &userID, &extra)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid or expired refresh token"})
+	}
+
+	u, err := getUser(ctx, projectID, userID)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid or expired refresh token"})
+	}
+	if u.isBanned() {
+		revokeSession(ctx, projectID, sessionID)
+		return c.Status(403).JSON(fiber.Map{"error": "User is banned"})
+	}
+
+	resp, err := tokenResponse(projectID, u, sessionID, newToken, extra)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not issue token"})
+	}
+
+	recordEvent(c, projectID, EventTokenRefreshed, u.ID, fiber.Map{"session_id": sessionID})
+	return c.JSON(resp)
+}
+
+// LogoutHandler revokes the session of the presented access token
+func LogoutHandler(c *fiber.Ctx) error {
+	projectID := c.Params("project")
+	if !isValidProject(projectID) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+	userID, _ := c.Locals("user_id").(string)
+	sessionID, _ := c.Locals("session_id").(string)
+	if sessionID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Token has no session"})
+	}
+
+	if err := revokeSession(context.Background(), projectID, sessionID); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not sign out"})
+	}
+
+	recordEvent(c, projectID, EventLogout, userID, fiber.Map{"session_id": sessionID})
+	return c.JSON(fiber.Map{"message": "Signed out"})
+}
+
+func revokeSession(ctx context.Context, projectID, sessionID string) error {
+	query := fmt.Sprintf("UPDATE %s.auth_sessions SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL", projectID)
+	_, err := db.Pool.Exec(ctx, query, sessionID)
+	return err
+}
+
+// revokeUserSessions signs a user out everywhere (e.g. when banned)
+func revokeUserSessions(ctx context.Context, projectID, userID string) error {
+	query := fmt.Sprintf("UPDATE %s.auth_sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", projectID)
+	_, err := db.Pool.Exec(ctx, query, userID)
+	return err
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"baas/internal/db"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// Settings holds the signup and password policy of a project
+type Settings struct {
+	DisableSignup            bool     `json:"disable_signup"`
+	EnableAnonymousSignin    bool     `json:"enable_anonymous_signin"`
+	RequireEmailConfirmation bool     `json:"require_email_confirmation"`
+	PasswordMinLength        int      `json:"password_min_length"`
+	PasswordRequireLowercase bool     `json:"password_require_lowercase"`
+	PasswordRequireUppercase bool     `json:"password_require_uppercase"`
+	PasswordRequireDigit     bool     `json:"password_require_digit"`
+	PasswordRequireSymbol    bool     `json:"password_require_symbol"`
+	CheckBreachedPasswords   bool     `json:"check_breached_passwords"`
+	EmailAllowDomains        []string `json:"email_allow_domains"`
+	EmailDenyDomains         []string `json:"email_deny_domains"`
+}
+
+// DefaultSettings is used for projects that never saved their auth settings
+func DefaultSettings() Settings {
+	return Settings{
+		PasswordMinLength: 6,
+		EmailAllowDomains: []string{},
+		EmailDenyDomains:  []string{},
+	}
+}
+
+// errProjectNotFound is returned when the :project param matches no project
+var errProjectNotFound = errors.New("project not found")
+
+// loadSettings fetches the auth settings of a project (by slug)
+func loadSettings(ctx context.Context, project string) (Settings, error) {
+	s := DefaultSettings()
+
+	var projectID string
+	err := db.Pool.QueryRow(ctx, "SELECT id FROM baas_system.projects WHERE slug = $1", project).Scan(&projectID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return s, errProjectNotFound
+		}
+		return s, err
+	}
+
+	query := `
+		SELECT disable_signup, enable_anonymous_signin, require_email_confirmation, password_min_length,
+		       password_require_lowercase, password_require_uppercase,
+		       password_require_digit, password_require_symbol,
+		       check_breached_passwords, email_allow_domains, email_deny_domains
+		FROM baas_system.auth_settings WHERE project_id = $1
+	`
+	err = db.Pool.QueryRow(ctx, query, projectID).Scan(
+		&s.DisableSignup, &s.EnableAnonymousSignin, &s.RequireEmailConfirmation, &s.PasswordMinLength,
+		&s.PasswordRequireLowercase, &s.PasswordRequireUppercase,
+		&s.PasswordRequireDigit, &s.PasswordRequireSymbol,
+		&s.CheckBreachedPasswords, &s.EmailAllowDomains, &s.EmailDenyDomains,
+	)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return s, err
+	}
+	return s, nil
+}
+
+// GetSettingsHandler returns the auth settings of a project (Admin only)
+func GetSettingsHandler(c *fiber.Ctx) error {
+	s, err := loadSettings(context.Background(), c.Params("project"))
+	if err != nil {
+		if errors.Is(err, errProjectNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Project not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to load auth settings"})
+	}
+	return c.JSON(s)
+}
+
+// UpdateSettingsHandler replaces the auth settings of a project (Admin only)
+func UpdateSettingsHandler(c *fiber.Ctx) error {
+	s := DefaultSettings()
+	if err := c.BodyParser(&s); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if s.PasswordMinLength < 1 || s.PasswordMinLength > 72 { // bcrypt only uses the first 72 bytes
+		return c.Status(400).JSON(fiber.Map{"error": "password_min_length must be between 1 and 72"})
+	}
+	s.EmailAllowDomains = normalizeDomains(s.EmailAllowDomains)
+	s.EmailDenyDomains = normalizeDomains(s.EmailDenyDomains)
+
+	query := `
+		INSERT INTO baas_system.auth_settings (
+			project_id, disable_signup, enable_anonymous_signin, require_email_confirmation, password_min_length,
+			password_require_lowercase, password_require_uppercase,
+			password_require_digit, password_require_symbol,
+			check_breached_passwords, email_allow_domains, email_deny_domains
+		)
+		SELECT id, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12 FROM baas_system.projects WHERE slug = $1
+		ON CONFLICT (project_id) DO UPDATE SET
+			disable_signup = EXCLUDED.disable_signup,
+			enable_anonymous_signin = EXCLUDED.enable_anonymous_signin,
+			require_email_confirmation = EXCLUDED.require_email_confirmation,
+			password_min_length = EXCLUDED.password_min_length,
+			password_require_lowercase = EXCLUDED.password_require_lowercase,
+			password_require_uppercase = EXCLUDED.password_require_uppercase,
+			password_require_digit = EXCLUDED.password_require_digit,
+			password_require_symbol = EXCLUDED.password_require_symbol,
+			check_breached_passwords = EXCLUDED.check_breached_passwords,
+			email_allow_domains = EXCLUDED.email_allow_domains,
+			email_deny_domains = EXCLUDED.email_deny_domains,
+			updated_at = NOW()
+	`
+	tag, err := db.Pool.Exec(context.Background(), query, c.Params("project"),
+		s.DisableSignup, s.EnableAnonymousSignin, s.RequireEmailConfirmation, s.PasswordMinLength,
+		s.PasswordRequireLowercase, s.PasswordRequireUppercase,
+		s.PasswordRequireDigit, s.PasswordRequireSymbol,
+		s.CheckBreachedPasswords, s.EmailAllowDomains, s.EmailDenyDomains,
+	)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to save auth settings"})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Project not found"})
+	}
+
+	return c.JSON(s)
+}
+
+func normalizeDomains(domains []string) []string {
+	out := []string{}
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(d), "@")))
+		if d != "" {
+			out = append(out, d)
+		}
+	}
+	return out
+}
@@ -2,13 +2,21 @@ package auth
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"time"
+	"log"
+	"net/url"
+	"strings"
 
 	"baas/internal/db"
+	"baas/internal/mail"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -20,6 +28,58 @@ import (
 // TenantSignUp handles end-user registration for a specific project
 func TenantSignUp(c *fiber.Ctx) error {
 	projectID := c.Params("project") // The schema name
+	if !isValidProject(projectID) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+	type Request struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	var req Request
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if req.Email == "" || req.Password == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Email and Password required"})
+	}
+
+	settings, err := loadSettings(context.Background(), projectID)
+	if err != nil {
+		if err == errProjectNotFound {
+			return c.Status(404).JSON(fiber.Map{"error": "Project not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Could not load auth settings"})
+	}
+	if settings.DisableSignup {
+		return c.Status(403).JSON(fiber.Map{"error": "Signups are disabled for this project"})
+	}
+
+	if _, err := runHooks(context.Background(), projectID, HookBeforeSignup, fiber.Map{"email": req.Email}); err != nil {
+		return respondHookError(c, err)
+	}
+
+	user, status, err := createTenantUser(projectID, settings, req.Email, req.Password, !settings.RequireEmailConfirmation)
+	if err != nil {
+		return c.Status(status).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	recordEvent(c, projectID, EventSignup, user.ID, fiber.Map{"email": user.Email})
+
+	if settings.RequireEmailConfirmation {
+		return c.JSON(fiber.Map{"id": user.ID, "email": user.Email, "message": "User registered, check your email to confirm the account"})
+	}
+	return c.JSON(fiber.Map{"id": user.ID, "email": user.Email, "message": "User registered successfully"})
+}
+
+// CreateUserHandler creates a user on behalf of the project (Admin only).
+// Works even when public signup is disabled, which makes it the way to
+// onboard users of invite-only projects. Admin-created users are confirmed.
+func CreateUserHandler(c *fiber.Ctx) error {
+	projectID := c.Params("project")
+	if !isValidProject(projectID) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
 	type Request struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
@@ -33,30 +93,136 @@ func TenantSignUp(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Email and Password required"})
 	}
 
+	settings, err := loadSettings(context.Background(), projectID)
+	if err != nil {
+		if err == errProjectNotFound {
+			return c.Status(404).JSON(fiber.Map{"error": "Project not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Could not load auth settings"})
+	}
+
+	user, status, err := createTenantUser(projectID, settings, req.Email, req.Password, true)
+	if err != nil {
+		return c.Status(status).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	recordEvent(c, projectID, EventUserCreated, user.ID, fiber.Map{"email": user.Email})
+
+	return c.JSON(fiber.Map{"id": user.ID, "email": user.Email, "message": "User created successfully"})
+}
+
+type tenantUser struct {
+	ID    string
+	Email string
+}
+
+// createTenantUser validates the credentials against the project's policy and
+// inserts the user. Unconfirmed users get a confirmation email.
+// On failure it returns the HTTP status to respond with.
+func createTenantUser(projectID string, settings Settings, rawEmail, password string, confirmed bool) (tenantUser, int, error) {
+	var user tenantUser
+
+	email, err := validateEmail(settings, rawEmail)
+	if err != nil {
+		return user, 400, err
+	}
+	if err := validatePassword(settings, password); err != nil {
+		return user, 400, err
+	}
+
 	// 1. Hash Password
-	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Could not hash password"})
+		return user, 500, errors.New("Could not hash password")
 	}
 
 	// 2. Insert into PROJECT's users table
 	// Schema: projectID.users
-	query := fmt.Sprintf("INSERT INTO %s.users (email, password_hash) VALUES ($1, $2) RETURNING id, email", projectID)
+	var token, tokenHash *string
+	if !confirmed {
+		t := randomToken()
+		h := hashToken(t)
+		token, tokenHash = &t, &h
+	}
+	query := fmt.Sprintf(`
+		INSERT INTO %s.users (email, password_hash, email_confirmed_at, confirmation_token, confirmation_sent_at)
+		VALUES ($1, $2, CASE WHEN $3 THEN NOW() END, $4, CASE WHEN $4::text IS NOT NULL THEN NOW() END)
+		RETURNING id, email`, projectID)
 
-	var userID string
-	var email string
-	// Security Reminder: Validate projectID format strictly!
-	err = db.Pool.QueryRow(context.Background(), query, req.Email, string(hash)).Scan(&userID, &email)
+	err = db.Pool.QueryRow(context.Background(), query, email, string(hash), confirmed, tokenHash).Scan(&user.ID, &user.Email)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Could not create user (email might be taken or project doesn't exist)"})
+		return user, 500, errors.New("Could not create user (email might be taken or project doesn't exist)")
 	}
 
-	return c.JSON(fiber.Map{"id": userID, "email": email, "message": "User registered successfully"})
+	if token != nil {
+		if err := sendConfirmationEmail(projectID, user.Email, *token); err != nil {
+			log.Println("Could not send confirmation email:", err)
+		}
+	}
+
+	return user, 200, nil
+}
+
+func sendConfirmationEmail(projectID, email, token string) error {
+	link := fmt.Sprintf("%s/%s/auth/verify?type=signup&token=%s", mail.PublicURL(), projectID, url.QueryEscape(token))
+	body := fmt.Sprintf("Follow this link to confirm your account:\n\n%s\n", link)
+	return mail.Send(email, "Confirm your account", body)
+}
+
+// VerifyHandler confirms an email address using the token sent by email.
+// Accepts GET (link in the email) and POST ({"token": "..."}).
+// ?type=email_change confirms a pending email change instead of a signup.
+func VerifyHandler(c *fiber.Ctx) error {
+	projectID := c.Params("project")
+	if !isValidProject(projectID) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+
+	token := c.Query("token")
+	if c.Method() == fiber.MethodPost {
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+		token = req.Token
+	}
+	if token == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Token required"})
+	}
+
+	event := EventEmailConfirmed
+	query := fmt.Sprintf(`
+		UPDATE %s.users
+		SET email_confirmed_at = NOW(), confirmation_token = NULL, updated_at = NOW()
+		WHERE confirmation_token = $1 AND confirmation_sent_at > NOW() - INTERVAL '24 hours'
+		RETURNING id`, projectID)
+	if c.Query("type") == "email_change" {
+		event = EventEmailChanged
+		query = fmt.Sprintf(`
+			UPDATE %s.users
+			SET email = email_change, email_confirmed_at = NOW(),
+			    email_change = NULL, email_change_token = NULL, updated_at = NOW()
+			WHERE email_change_token = $1 AND email_change_sent_at > NOW() - INTERVAL '24 hours'
+			RETURNING id`, projectID)
+	}
+
+	var userID string
+	if err := db.Pool.QueryRow(context.Background(), query, hashToken(token)).Scan(&userID); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid or expired token"})
+	}
+
+	recordEvent(c, projectID, event, userID, nil)
+	return c.JSON(fiber.Map{"id": userID, "message": "Email confirmed"})
 }
 
 // TenantSignIn handles end-user login for a specific project
 func TenantSignIn(c *fiber.Ctx) error {
 	projectID := c.Params("project")
+	if !isValidProject(projectID) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
 	type Request struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
@@ -66,51 +232,65 @@ func TenantSignIn(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
 
+	settings, err := loadSettings(context.Background(), projectID)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+	}
+
 	// 1. Fetch User from PROJECT's table
 	var id, hash string
-	query := fmt.Sprintf("SELECT id, password_hash FROM %s.users WHERE email = $1", projectID)
+	query := fmt.Sprintf("SELECT id, password_hash FROM %s.users WHERE lower(email) = lower($1)", projectID)
 
-	err := db.Pool.QueryRow(context.Background(), query, req.Email).Scan(&id, &hash)
+	err = db.Pool.QueryRow(context.Background(), query, strings.TrimSpace(req.Email)).Scan(&id, &hash)
 	if err != nil {
+		recordEvent(c, projectID, EventSigninFailed, "", fiber.Map{"email": req.Email, "reason": "unknown_email"})
 		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
 	}
 
 	// 2. Compare Password
 	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)); err != nil {
+		recordEvent(c, projectID, EventSigninFailed, id, fiber.Map{"email": req.Email, "reason": "wrong_password"})
 		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
 	}
 
-	// 3. Generate Tenant Scoped Token
+	user, err := getUser(context.Background(), projectID, id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not login"})
+	}
+	if settings.RequireEmailConfirmation && user.EmailConfirmedAt == nil {
+		recordEvent(c, projectID, EventSigninFailed, id, fiber.Map{"email": req.Email, "reason": "email_not_confirmed"})
+		return c.Status(403).JSON(fiber.Map{"error": "Email not confirmed"})
+	}
+	if user.isBanned() {
+		recordEvent(c, projectID, EventSigninFailed, id, fiber.Map{"email": req.Email, "reason": "banned"})
+		return c.Status(403).JSON(fiber.Map{"error": "User is banned"})
+	}
+
+	extra, err := runHooks(context.Background(), projectID, HookAfterSignin, user)
+	if err != nil {
+		recordEvent(c, projectID, EventSigninFailed, id, fiber.Map{"email": req.Email, "reason": "hook", "error": err.Error()})
+		return respondHookError(c, err)
+	}
+
+	// 3. Generate Tenant Scoped Token (and refresh token session)
 	// We include "aud" (audience) as projectID so we know which project this token belongs to
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub":  id,
-		"aud":  projectID,                                 // Scopes token to this project
-		"role": "authenticated",                           // Supabase style role
-		"exp":  time.Now().Add(time.Hour * 24 * 7).Unix(), // 1 week
-	})
-
-	t, err := token.SignedString(SecretKey)
+	resp, err := startSession(c, projectID, user, extra)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Could not login"})
 	}
 
-	return c.JSON(fiber.Map{
-		"access_token": t,
-		"token_type":   "bearer",
-		"expires_in":   3600 * 24 * 7,
-		"user": fiber.Map{
-			"id":    id,
-			"email": req.Email,
-			"aud":   projectID,
-		},
-	})
+	recordEvent(c, projectID, EventSignin, id, nil)
+	return c.JSON(resp)
 }
 
 // ListUsersHandler returns all users for a project (Admin only)
 func ListUsersHandler(c *fiber.Ctx) error {
 	projectID := c.Params("project")
+	if !isValidProject(projectID) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
 
-	query := fmt.Sprintf("SELECT id, email, created_at FROM %s.users ORDER BY created_at DESC", projectID)
+	query := fmt.Sprintf("SELECT %s FROM %s.users ORDER BY created_at DESC", userColumns, projectID)
 
 	rows, err := db.Pool.Query(context.Background(), query)
 	if err != nil {
@@ -118,16 +298,10 @@ func ListUsersHandler(c *fiber.Ctx) error {
 	}
 	defer rows.Close()
 
-	type User struct {
-		ID        string    `json:"id"`
-		Email     string    `json:"email"`
-		CreatedAt time.Time `json:"created_at"`
-	}
-
 	var users []User
 	for rows.Next() {
 		var u User
-		if err := rows.Scan(&u.ID, &u.Email, &u.CreatedAt); err == nil {
+		if err := scanUser(rows, &u); err == nil {
 			users = append(users, u)
 		}
 	}
@@ -137,12 +311,51 @@ func ListUsersHandler(c *fiber.Ctx) error {
 // DeleteUserHandler deletes a user from a project
 func DeleteUserHandler(c *fiber.Ctx) error {
 	projectID := c.Params("project")
+	if !isValidProject(projectID) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
 	userID := c.Params("id")
 
-	query := fmt.Sprintf("DELETE FROM %s.users WHERE id = $1", projectID)
-	_, err := db.Pool.Exec(context.Background(), query, userID)
+	var email *string
+	query := fmt.Sprintf("DELETE FROM %s.users WHERE id = $1 RETURNING email", projectID)
+	err := db.Pool.QueryRow(context.Background(), query, userID).Scan(&email)
 	if err != nil {
+		if err == pgx.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+		}
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete user"})
 	}
+
+	recordEvent(c, projectID, EventUserDeleted, userID, fiber.Map{"email": email})
 	return c.JSON(fiber.Map{"message": "User deleted"})
 }
+
+// isValidProject checks that the :project param is a safe schema name,
+// since it is interpolated into queries
+func isValidProject(s string) bool {
+	if len(s) == 0 || len(s) > 63 {
+		return false
+	}
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// randomToken returns a URL-safe random token for emailed links
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashToken is what gets stored for one-time tokens, so a database leak
+// does not leak usable links
+func hashToken(t string) string {
+	sum := sha256.Sum256([]byte(t))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,350 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"baas/internal/db"
+	"baas/internal/mail"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User is the public representation of a project end-user
+type User struct {
+	ID               string                 `json:"id"`
+	Email            string                 `json:"email"` // Empty for anonymous users
+	EmailConfirmedAt *time.Time             `json:"email_confirmed_at"`
+	UserMetadata     map[string]interface{} `json:"user_metadata"` // Editable by the user
+	AppMetadata      map[string]interface{} `json:"app_metadata"`  // Editable by admins only
+	BannedUntil      *time.Time             `json:"banned_until"`
+	IsAnonymous      bool                   `json:"is_anonymous"`
+	CreatedAt        time.Time              `json:"created_at"`
+	UpdatedAt        time.Time              `json:"updated_at"`
+}
+
+// userColumns must match the order scanned by scanUser
+const userColumns = "id, COALESCE(email, ''), email_confirmed_at, user_metadata, app_metadata, banned_until, is_anonymous, created_at, updated_at"
+
+func scanUser(row pgx.Row, u *User) error {
+	return row.Scan(&u.ID, &u.Email, &u.EmailConfirmedAt, &u.UserMetadata, &u.AppMetadata, &u.BannedUntil, &u.IsAnonymous, &u.CreatedAt, &u.UpdatedAt)
+}
+
+func getUser(ctx context.Context, projectID, userID string) (User, error) {
+	var u User
+	query := fmt.Sprintf("SELECT %s FROM %s.users WHERE id = $1", userColumns, projectID)
+	err := scanUser(db.Pool.QueryRow(ctx, query, userID), &u)
+	return u, err
+}
+
+// isBanned reports whether the user is currently banned
+func (u User) isBanned() bool {
+	return u.BannedUntil != nil && u.BannedUntil.After(time.Now())
+}
+
+// tenantTokenTTL is the lifetime of tenant access tokens
+const tenantTokenTTL = time.Hour * 24 * 7 // 1 week
+
+// issueTenantToken signs an access token for a project user.
+func issueTenantToken(projectID string, u User, sessionID string, extra jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, tenantClaims(projectID, u, sessionID, extra))
+	return token.SignedString(SecretKey)
+}
+
+// tenantClaims builds the claims of a tenant access token.
+// app_metadata is surfaced as claims so RLS policies can rely on it
+// (the user cannot change it, unlike user_metadata). extra holds claims
+// added by auth hooks.
+func tenantClaims(projectID string, u User, sessionID string, extra jwt.MapClaims) jwt.MapClaims {
+	claims := jwt.MapClaims{}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	claims["sub"] = u.ID
+	claims["aud"] = projectID        // Scopes token to this project
+	claims["role"] = "authenticated" // Supabase style role
+	claims["email"] = u.Email
+	claims["app_metadata"] = u.AppMetadata
+	claims["user_metadata"] = u.UserMetadata
+	claims["is_anonymous"] = u.IsAnonymous
+	if sessionID != "" {
+		claims["session_id"] = sessionID
+	}
+	claims["exp"] = time.Now().Add(tenantTokenTTL).Unix()
+	return claims
+}
+
+// GetUserHandler returns the signed-in user
+func GetUserHandler(c *fiber.Ctx) error {
+	projectID := c.Params("project")
+	if !isValidProject(projectID) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+	userID, _ := c.Locals("user_id").(string)
+
+	u, err := getUser(context.Background(), projectID, userID)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+	}
+	return c.JSON(u)
+}
+
+// UpdateUserHandler lets the signed-in user change their email, password and
+// user_metadata. Email and password changes require the current password;
+// a new email only becomes active once confirmed via the link sent to it.
+//
+// Anonymous users instead link an email and password (both required) to
+// their existing account, keeping their id; a fresh access token is returned
+// since the is_anonymous claim changes.
+func UpdateUserHandler(c *fiber.Ctx) error {
+	projectID := c.Params("project")
+	if !isValidProject(projectID) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+	userID, _ := c.Locals("user_id").(string)
+
+	type Request struct {
+		Email           string                 `json:"email"`
+		Password        string                 `json:"password"`
+		CurrentPassword string                 `json:"current_password"`
+		Data            map[string]interface{} `json:"data"` // Merged into user_metadata
+	}
+	var req Request
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	ctx := context.Background()
+	settings, err := loadSettings(ctx, projectID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not load auth settings"})
+	}
+
+	var hash string
+	var anonymous bool
+	query := fmt.Sprintf("SELECT COALESCE(password_hash, ''), is_anonymous FROM %s.users WHERE id = $1", projectID)
+	if err := db.Pool.QueryRow(ctx, query, userID).Scan(&hash, &anonymous); err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+	}
+
+	linking := anonymous && (req.Email != "" || req.Password != "")
+	if linking {
+		if req.Email == "" || req.Password == "" {
+			return c.Status(400).JSON(fiber.Map{"error": "Email and Password required to link an anonymous account"})
+		}
+	} else if req.Email != "" || req.Password != "" {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.CurrentPassword)) != nil {
+			return c.Status(401).JSON(fiber.Map{"error": "Current password is incorrect"})
+		}
+	}
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	defer tx.Rollback(ctx)
+
+	if req.Password != "" {
+		if err := validatePassword(settings, req.Password); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		newHash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Could not hash password"})
+		}
+		query := fmt.Sprintf("UPDATE %s.users SET password_hash = $2, updated_at = NOW() WHERE id = $1", projectID)
+		if _, err := tx.Exec(ctx, query, userID, string(newHash)); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Could not update password"})
+		}
+	}
+
+	if req.Data != nil {
+		data, _ := json.Marshal(req.Data)
+		query := fmt.Sprintf("UPDATE %s.users SET user_metadata = user_metadata || $2::jsonb, updated_at = NOW() WHERE id = $1", projectID)
+		if _, err := tx.Exec(ctx, query, userID, data); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Could not update user metadata"})
+		}
+	}
+
+	var emailToken string
+	var newEmail string
+	if req.Email != "" {
+		newEmail, err = validateEmail(settings, req.Email)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		var taken bool
+		query := fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM %s.users WHERE lower(email) = $1 AND id <> $2)", projectID)
+		if err := tx.QueryRow(ctx, query, newEmail, userID).Scan(&taken); err != nil || taken {
+			return c.Status(400).JSON(fiber.Map{"error": "Email address is already in use"})
+		}
+
+		if linking {
+			// The anonymous account becomes a regular one right away;
+			// confirmation follows the project's signup rules.
+			var tokenHash *string
+			if settings.RequireEmailConfirmation {
+				emailToken = randomToken()
+				h := hashToken(emailToken)
+				tokenHash = &h
+			}
+			query = fmt.Sprintf(`
+				UPDATE %s.users
+				SET email = $2, is_anonymous = FALSE,
+				    email_confirmed_at = CASE WHEN $3::text IS NULL THEN NOW() END,
+				    confirmation_token = $3, confirmation_sent_at = CASE WHEN $3::text IS NOT NULL THEN NOW() END,
+				    updated_at = NOW()
+				WHERE id = $1`, projectID)
+			if _, err := tx.Exec(ctx, query, userID, newEmail, tokenHash); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Could not link email"})
+			}
+		} else {
+			emailToken = randomToken()
+			query = fmt.Sprintf(`
+				UPDATE %s.users
+				SET email_change = $2, email_change_token = $3, email_change_sent_at = NOW(), updated_at = NOW()
+				WHERE id = $1`, projectID)
+			if _, err := tx.Exec(ctx, query, userID, newEmail, hashToken(emailToken)); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Could not update email"})
+			}
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+	}
+
+	if emailToken != "" {
+		if linking {
+			err = sendConfirmationEmail(projectID, newEmail, emailToken)
+		} else {
+			link := fmt.Sprintf("%s/%s/auth/verify?type=email_change&token=%s", mail.PublicURL(), projectID, url.QueryEscape(emailToken))
+			body := fmt.Sprintf("Follow this link to confirm your new email address:\n\n%s\n", link)
+			err = mail.Send(newEmail, "Confirm your new email", body)
+		}
+		if err != nil {
+			log.Println("Could not send confirmation email:", err)
+		}
+	}
+
+	u, err := getUser(ctx, projectID, userID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch user"})
+	}
+
+	if req.Password != "" && !linking {
+		recordEvent(c, projectID, EventPasswordChanged, userID, nil)
+	}
+	if req.Email != "" && !linking {
+		recordEvent(c, projectID, EventEmailChangeRequested, userID, fiber.Map{"new_email": newEmail})
+	}
+
+	resp := fiber.Map{"user": u}
+	if linking {
+		// Replace the anonymous session so no token claims is_anonymous anymore
+		if sessionID, _ := c.Locals("session_id").(string); sessionID != "" {
+			revokeSession(ctx, projectID, sessionID)
+		}
+		resp, err = startSession(c, projectID, u, nil)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Could not issue token"})
+		}
+		recordEvent(c, projectID, EventIdentityLinked, userID, fiber.Map{"provider": "email", "email": newEmail})
+	}
+	if emailToken != "" {
+		resp["message"] = "Check your email address to confirm the change"
+	}
+	return c.JSON(resp)
+}
+
+// AdminUpdateUserHandler edits a project user (Admin only): banning,
+// confirming the email and editing user_metadata / app_metadata.
+func AdminUpdateUserHandler(c *fiber.Ctx) error {
+	projectID := c.Params("project")
+	if !isValidProject(projectID) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+	userID := c.Params("id")
+
+	type Request struct {
+		BanDuration  *string                `json:"ban_duration"` // e.g. "24h", "none" lifts the ban
+		EmailConfirm *bool                  `json:"email_confirm"`
+		UserMetadata map[string]interface{} `json:"user_metadata"` // Merged
+		AppMetadata  map[string]interface{} `json:"app_metadata"`  // Merged
+	}
+	var req Request
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	sets := []string{}
+	values := []interface{}{userID}
+	add := func(expr string, v interface{}) {
+		values = append(values, v)
+		sets = append(sets, fmt.Sprintf(expr, len(values)))
+	}
+
+	if req.BanDuration != nil {
+		if *req.BanDuration == "none" {
+			sets = append(sets, "banned_until = NULL")
+		} else {
+			d, err := time.ParseDuration(*req.BanDuration)
+			if err != nil || d <= 0 {
+				return c.Status(400).JSON(fiber.Map{"error": "Invalid ban_duration"})
+			}
+			add("banned_until = $%d", time.Now().Add(d))
+		}
+	}
+	if req.EmailConfirm != nil {
+		if *req.EmailConfirm {
+			sets = append(sets, "email_confirmed_at = COALESCE(email_confirmed_at, NOW()), confirmation_token = NULL")
+		} else {
+			sets = append(sets, "email_confirmed_at = NULL")
+		}
+	}
+	if req.UserMetadata != nil {
+		data, _ := json.Marshal(req.UserMetadata)
+		add("user_metadata = user_metadata || $%d::jsonb", data)
+	}
+	if req.AppMetadata != nil {
+		data, _ := json.Marshal(req.AppMetadata)
+		add("app_metadata = app_metadata || $%d::jsonb", data)
+	}
+
+	if len(sets) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Nothing to update"})
+	}
+	sets = append(sets, "updated_at = NOW()")
+
+	var u User
+	query := fmt.Sprintf("UPDATE %s.users SET %s WHERE id = $1 RETURNING %s", projectID, strings.Join(sets, ", "), userColumns)
+	if err := scanUser(db.Pool.QueryRow(context.Background(), query, values...), &u); err != nil {
+		if err == pgx.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update user"})
+	}
+
+	// A banned user must not be able to refresh existing sessions
+	if u.isBanned() {
+		if err := revokeUserSessions(context.Background(), projectID, u.ID); err != nil {
+			log.Println("Could not revoke sessions of banned user:", err)
+		}
+	}
+
+	recordEvent(c, projectID, EventUserUpdated, u.ID, fiber.Map{
+		"ban_duration":  req.BanDuration,
+		"email_confirm": req.EmailConfirm,
+		"user_metadata": req.UserMetadata,
+		"app_metadata":  req.AppMetadata,
+	})
+	return c.JSON(u)
+}
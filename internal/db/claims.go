@@ -0,0 +1,49 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// WithClaims runs fn in a transaction scoped to the given JWT claims.
+// Tenant tokens (role "authenticated") switch to the project's TenantRole,
+// so row level security policies apply to them (the server's own role owns
+// the tables and would bypass RLS), and expose their claims to RLS policies
+// via current_setting('request.jwt.claims') and
+// current_setting('request.jwt.claim.sub'). Platform admin tokens (or nil
+// claims) keep the server's role.
+func WithClaims(ctx context.Context, project string, claims map[string]interface{}, fn func(tx pgx.Tx) error) error {
+	return pgx.BeginFunc(ctx, Pool, func(tx pgx.Tx) error {
+		if err := SetClaims(ctx, tx, project, claims); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+// SetClaims applies the claims to the current transaction (see WithClaims)
+func SetClaims(ctx context.Context, tx pgx.Tx, project string, claims map[string]interface{}) error {
+	if claims == nil {
+		return nil
+	}
+	if role, _ := claims["role"].(string); role == "admin" {
+		return nil
+	}
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return err
+	}
+	sub, _ := claims["sub"].(string)
+
+	_, err = tx.Exec(ctx, `
+		SELECT set_config('request.jwt.claims', $1, true),
+		       set_config('request.jwt.claim.sub', $2, true)`, string(data), sub)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, "SET LOCAL ROLE "+pgx.Identifier{TenantRole(project)}.Sanitize())
+	return err
+}
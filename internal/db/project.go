@@ -0,0 +1,58 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ProjectRole is the login role owning the user objects of a project schema.
+// The SQL editor and SQL auth hooks connect as it (see ConnectProject)
+// instead of switching roles on a pooled connection, so a RESET ROLE in the
+// project's SQL cannot get back to the server's role.
+func ProjectRole(schema string) string {
+	return projectRoleName(schema, "owner")
+}
+
+// TenantRole is the role tenant requests of a project run as (see
+// WithClaims). It is a member of the cluster-wide "authenticated" role, so
+// policies written "TO authenticated" apply, but only it is granted access to
+// the project's tables: a tenant token of one project cannot reach another's.
+func TenantRole(schema string) string {
+	return projectRoleName(schema, "authenticated")
+}
+
+func projectRoleName(schema, suffix string) string {
+	// Unquoted identifiers are folded to lower case
+	name := "hanbase_" + strings.ToLower(schema) + "_" + suffix
+	if len(name) > 63 { // Postgres identifier limit; truncating could collide
+		sum := sha256.Sum256([]byte(strings.ToLower(schema)))
+		name = name[:63-len(suffix)-10] + "_" + hex.EncodeToString(sum[:4]) + "_" + suffix
+	}
+	return name
+}
+
+// ConnectProject opens a connection as the project's role, with the
+// search_path set to the project schema. The caller must close it.
+func ConnectProject(ctx context.Context, schema string) (*pgx.Conn, error) {
+	var password *string
+	err := Pool.QueryRow(ctx,
+		"SELECT db_password FROM baas_system.projects WHERE db_schema = $1", schema).Scan(&password)
+	if err != nil {
+		return nil, err
+	}
+	if password == nil {
+		return nil, fmt.Errorf("project %s has no database role yet", schema)
+	}
+
+	config := Pool.Config().ConnConfig.Copy()
+	config.User = ProjectRole(schema)
+	config.Password = *password
+	config.RuntimeParams["search_path"] = schema
+	config.RuntimeParams["application_name"] = "hanbase_project"
+	return pgx.ConnectConfig(ctx, config)
+}
@@ -0,0 +1,56 @@
+package mail
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// Send delivers a plain text email using the SMTP_* environment settings.
+// When SMTP_HOST is not set (local development) the message is only logged.
+func Send(to, subject, body string) error {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		log.Printf("Mail (SMTP_HOST not set, not sent)\nTo: %s\nSubject: %s\n\n%s\n", to, subject, body)
+		return nil
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = "no-reply@hanbase.local"
+	}
+
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USER"); user != "" {
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASS"), host)
+	}
+
+	// Header injection guard: addresses and subject must be single-line
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("invalid mail header")
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		from, to, subject, body)
+
+	return smtp.SendMail(host+":"+port, auth, from, []string{to}, []byte(msg))
+}
+
+// PublicURL returns the externally reachable base URL of the API,
+// used to build links in emails.
+func PublicURL() string {
+	if u := os.Getenv("PUBLIC_URL"); u != "" {
+		return strings.TrimRight(u, "/")
+	}
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "3000"
+	}
+	return "http://localhost:" + port
+}
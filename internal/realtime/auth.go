@@ -0,0 +1,145 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"baas/internal/auth"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// authHandshakeTimeout bounds how long a client may wait before sending
+	// its token when it did not pass one in the URL
+	authHandshakeTimeout = 10 * time.Second
+	// sessionCheckInterval is how often revoked sessions are detected
+	sessionCheckInterval = 30 * time.Second
+)
+
+// clientMessage is a protocol message sent by a client
+type clientMessage struct {
+	Type    string `json:"type"`
+	Token   string `json:"token,omitempty"`   // "auth"
+	Channel string `json:"channel,omitempty"` // "join", "leave"
+	Since   int64  `json:"since,omitempty"`   // "replay"
+}
+
+// authenticate validates the client's token with the same rules as
+// auth.TenantProtected. The token is read from ?token= (or ?apikey=), the
+// Authorization header, or else from a first {"type":"auth","token":"..."}
+// message.
+func (c *Client) authenticate() (jwt.MapClaims, error) {
+	token := c.Conn.Query("token")
+	if token == "" {
+		token = c.Conn.Query("apikey")
+	}
+	if token == "" {
+		token = strings.TrimPrefix(c.Conn.Headers("Authorization"), "Bearer ")
+	}
+
+	if token == "" {
+		c.Conn.SetReadDeadline(time.Now().Add(authHandshakeTimeout))
+		_, message, err := c.Conn.ReadMessage()
+		if err != nil {
+			return nil, errors.New("Authentication timeout")
+		}
+		c.Conn.SetReadDeadline(time.Time{})
+
+		var msg clientMessage
+		if err := json.Unmarshal(message, &msg); err != nil || msg.Type != "auth" {
+			return nil, errors.New("First message must be an auth message")
+		}
+		token = msg.Token
+	}
+
+	return checkToken(token, c.Slug)
+}
+
+// checkToken validates a client token for a project and its session
+func checkToken(token, slug string) (jwt.MapClaims, error) {
+	claims, err := auth.ValidateTenantToken(token, slug)
+	if err != nil {
+		return nil, err
+	}
+	active, err := auth.SessionActive(context.Background(), projectSchema(slug), claims)
+	if err != nil {
+		return nil, errors.New("Could not verify session")
+	}
+	if !active {
+		return nil, errors.New("Session revoked")
+	}
+	return claims, nil
+}
+
+// refreshAuth replaces the connection's token, e.g. after the client
+// refreshed its access token. The new token must belong to the same user.
+func (c *Client) refreshAuth(token string) {
+	claims, err := auth.ValidateTenantToken(token, c.Slug)
+	if err == nil && claims["sub"] != c.getClaims()["sub"] {
+		err = errors.New("Token belongs to another user")
+	}
+	if err == nil {
+		active, checkErr := auth.SessionActive(context.Background(), c.ProjectID, claims)
+		switch {
+		case checkErr != nil:
+			err = errors.New("Could not verify session")
+		case !active:
+			err = errors.New("Session revoked")
+		}
+	}
+	if err != nil {
+		c.closeWith(websocket.ClosePolicyViolation, err.Error())
+		return
+	}
+
+	c.setClaims(claims)
+	c.writeJSON(fiber.Map{"type": "auth_ok", "expires_at": claims["exp"]})
+}
+
+// watchAuth closes the connection once its token expires or its session is
+// revoked. Runs until done is closed.
+func (c *Client) watchAuth(done <-chan struct{}) {
+	expiryTicker := time.NewTicker(time.Second)
+	defer expiryTicker.Stop()
+	sessionTicker := time.NewTicker(sessionCheckInterval)
+	defer sessionTicker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+
+		case <-expiryTicker.C:
+			exp, err := c.getClaims().GetExpirationTime()
+			if err == nil && exp != nil && time.Now().After(exp.Time) {
+				c.closeWith(websocket.ClosePolicyViolation, "Token expired")
+				return
+			}
+
+		case <-sessionTicker.C:
+			active, err := auth.SessionActive(context.Background(), c.ProjectID, c.getClaims())
+			if err == nil && !active {
+				c.closeWith(websocket.ClosePolicyViolation, "Session revoked")
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) getClaims() jwt.MapClaims {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.claims
+}
+
+func (c *Client) setClaims(claims jwt.MapClaims) {
+	c.mu.Lock()
+	c.claims = claims
+	c.mu.Unlock()
+}
@@ -6,11 +6,13 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"time"
 
 	"baas/internal/db"
 
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
 )
 
 // Hub manages clients and broadcasts messages
@@ -20,19 +22,44 @@ type Hub struct {
 	register   chan *Client
 	unregister chan *Client
 	broadcast  chan Message
-	mu         sync.RWMutex
+	deliver    chan delivery
+	presence   chan presenceUpdate
+	relay      chan relayMessage
+	// Tracked presence map[ProjectID]map[channel]map[*Client]presenceEntry,
+	// only accessed by Run
+	tracked map[string]map[string]map[*Client]presenceEntry
+	cluster *cluster // nil unless EnableCluster was called
+	mu      sync.RWMutex
 }
 
 type Client struct {
 	Hub       *Hub
-	Conn      *websocket.Conn
-	ProjectID string
+	Conn      *websocket.Conn // nil for SSE clients
+	Slug      string          // Project as named in the URL, which tokens and settings refer to
+	ProjectID string          // Project schema (see projectSchema), which events carry
+	Ref       string          // Identifies the connection, e.g. as presence key
 	Send      chan []byte
+
+	mu        sync.RWMutex
+	claims    jwt.MapClaims       // Validated token claims, replaced on refresh
+	channels  map[string]*channel // Joined channels by name
+	writeMu   sync.Mutex          // Serializes writes to Conn / transport
+	limiter   *rateLimiter        // Incoming message rate
+	transport transport
+}
+
+// delivery is the outcome of dispatching a Message: what each client receives
+type delivery struct {
+	ProjectID string
+	out       map[*Client][][]byte
 }
 
+// Message is a change event to fan out to the subscribers of a project
 type Message struct {
 	ProjectID string
-	Payload   []byte
+	Event     *ChangeEvent
+	Payload   []byte // Raw event JSON
+	Cursor    int64  // Outbox position, 0 without outbox
 }
 
 var MainHub = &Hub{
@@ -40,9 +67,24 @@ var MainHub = &Hub{
 	register:   make(chan *Client),
 	unregister: make(chan *Client),
 	broadcast:  make(chan Message),
+	deliver:    make(chan delivery),
+	presence:   make(chan presenceUpdate),
+	relay:      make(chan relayMessage),
+	tracked:    make(map[string]map[string]map[*Client]presenceEntry),
 }
 
 func (h *Hub) Run() {
+	go h.dispatch()
+
+	var clusterIn chan clusterMessage
+	var clusterTick <-chan time.Time
+	if h.cluster != nil {
+		clusterIn = h.cluster.inbound
+		ticker := time.NewTicker(clusterHeartbeat)
+		defer ticker.Stop()
+		clusterTick = ticker.C
+	}
+
 	for {
 		select {
 		case client := <-h.register:
@@ -55,72 +97,257 @@ func (h *Hub) Run() {
 
 		case client := <-h.unregister:
 			h.mu.Lock()
-			if _, ok := h.clients[client.ProjectID]; ok {
-				if _, ok := h.clients[client.ProjectID][client]; ok {
-					delete(h.clients[client.ProjectID], client)
-					close(client.Send)
-				}
-			}
+			h.removeLocked(client)
 			h.mu.Unlock()
 
-		case message := <-h.broadcast:
-			h.mu.RLock()
-			if clients, ok := h.clients[message.ProjectID]; ok {
-				for client := range clients {
-					select {
-					case client.Send <- message.Payload:
-					default:
-						close(client.Send)
-						delete(clients, client)
+		case d := <-h.deliver:
+			h.mu.Lock()
+			clients := h.clients[d.ProjectID]
+			for client, msgs := range d.out {
+				// Skip clients that disconnected during dispatch
+				if !clients[client] {
+					continue
+				}
+				for _, out := range msgs {
+					if !h.sendLocked(client, out) {
+						break
 					}
 				}
 			}
-			h.mu.RUnlock()
+			h.mu.Unlock()
+
+		case u := <-h.presence:
+			h.mu.Lock()
+			h.applyPresenceLocked(u)
+			h.mu.Unlock()
+
+		case m := <-h.relay:
+			h.mu.Lock()
+			h.relayLocked(m)
+			h.mu.Unlock()
+
+		case msg := <-clusterIn:
+			h.mu.Lock()
+			h.applyClusterLocked(msg)
+			h.mu.Unlock()
+
+		case <-clusterTick:
+			h.mu.Lock()
+			h.clusterTickLocked()
+			h.mu.Unlock()
+		}
+	}
+}
+
+// sendLocked queues a message for a client, applying the slow consumer
+// policy when its queue is full. Reports whether the client is still
+// connected. h.mu must be held.
+func (h *Hub) sendLocked(client *Client, msg []byte) bool {
+	select {
+	case client.Send <- msg:
+		return true
+	default:
+	}
+
+	switch slowConsumerPolicy {
+	case PolicyDropOldest:
+		select {
+		case <-client.Send:
+		default:
 		}
+	case PolicyCoalesce:
+		coalesceQueue(client.Send)
+	}
+
+	select {
+	case client.Send <- msg:
+		return true
+	default:
+		h.removeLocked(client)
+		return false
+	}
+}
+
+// coalesceQueue drops the queued broadcasts superseded by a later broadcast
+// with the same channel, event and sender. Only the hub sends to the queue,
+// so refilling it cannot block.
+func coalesceQueue(queue chan []byte) {
+	var pending [][]byte
+	for len(queue) > 0 {
+		select {
+		case msg := <-queue:
+			pending = append(pending, msg)
+		default:
+		}
+	}
+
+	latest := make(map[string]int, len(pending))
+	keys := make([]string, len(pending))
+	for i, msg := range pending {
+		keys[i] = coalesceKey(msg)
+		if keys[i] != "" {
+			latest[keys[i]] = i
+		}
+	}
+	for i, msg := range pending {
+		if keys[i] == "" || latest[keys[i]] == i {
+			queue <- msg
+		}
+	}
+}
+
+// coalesceKey identifies the broadcasts that replace each other, "" for
+// messages that must all be delivered
+func coalesceKey(msg []byte) string {
+	var m serverMessage
+	if err := json.Unmarshal(msg, &m); err != nil || m.Type != "broadcast" {
+		return ""
+	}
+	var p broadcastPayload
+	if err := json.Unmarshal(m.Payload, &p); err != nil {
+		return ""
+	}
+	return m.Channel + "\x00" + p.Event + "\x00" + p.From
+}
+
+// removeLocked unregisters a client and ends its presence. h.mu must be held.
+func (h *Hub) removeLocked(client *Client) {
+	clients, ok := h.clients[client.ProjectID]
+	if !ok || !clients[client] {
+		return
 	}
+	delete(clients, client)
+	close(client.Send)
+	h.untrackAllLocked(client)
 }
 
-// ListenToPostgres listens for NOTIFY events from the database
+// dispatch resolves the recipients of each change event (subscriptions and
+// row level security, see resolveDeliveries) outside of the Run loop, so
+// the database lookups do not hold up registrations. Events stay in order.
+func (h *Hub) dispatch() {
+	seen := newRecentIDs(4096)
+	for message := range h.broadcast {
+		if message.Event.ID != "" && !seen.add(message.Event.ID) {
+			continue // Already delivered
+		}
+		if err := storeOutbox(context.Background(), &message); err != nil {
+			log.Println("Realtime: could not store event in outbox:", err)
+		}
+
+		h.mu.RLock()
+		clients := make([]*Client, 0, len(h.clients[message.ProjectID]))
+		for client := range h.clients[message.ProjectID] {
+			clients = append(clients, client)
+		}
+		h.mu.RUnlock()
+		if len(clients) == 0 {
+			continue
+		}
+
+		out := resolveDeliveries(context.Background(), message, clients)
+		if len(out) > 0 {
+			h.deliver <- delivery{ProjectID: message.ProjectID, out: out}
+		}
+	}
+}
+
+// recentIDs remembers the last n change event ids
+type recentIDs struct {
+	ids  map[string]bool
+	ring []string
+	next int
+}
+
+func newRecentIDs(n int) *recentIDs {
+	return &recentIDs{ids: make(map[string]bool, n), ring: make([]string, n)}
+}
+
+// add records an id, reporting false if it was already known
+func (r *recentIDs) add(id string) bool {
+	if r.ids[id] {
+		return false
+	}
+	delete(r.ids, r.ring[r.next])
+	r.ring[r.next] = id
+	r.next = (r.next + 1) % len(r.ring)
+	r.ids[id] = true
+	return true
+}
+
+// Listener reconnection backoff
+const (
+	listenerMinBackoff = time.Second
+	listenerMaxBackoff = 30 * time.Second
+)
+
+// ListenToPostgres listens for NOTIFY events from the database, reconnecting
+// with exponential backoff when the connection is lost
 func ListenToPostgres() {
-	conn, err := db.Pool.Acquire(context.Background())
+	backoff := listenerMinBackoff
+	for {
+		start := time.Now()
+		err := listenOnce(context.Background())
+		health.disconnected(err)
+
+		// A connection that worked for a while resets the backoff
+		if time.Since(start) > listenerMaxBackoff {
+			backoff = listenerMinBackoff
+		}
+		log.Printf("Realtime: listener stopped: %v (reconnecting in %s)\n", err, backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, listenerMaxBackoff)
+	}
+}
+
+func listenOnce(ctx context.Context) error {
+	conn, err := db.Pool.Acquire(ctx)
 	if err != nil {
-		log.Fatalf("Error acquiring connection for listener: %v\n", err)
+		return err
 	}
+	// Failed connections are closed so the pool discards them on release
 	defer conn.Release()
 
 	// Listen to a global channel or per-project channels
 	// For MVP, we listen to a global 'db_events' channel
-	_, err = conn.Conn().Exec(context.Background(), "LISTEN db_events")
-	if err != nil {
-		log.Fatalf("Error listening to postgres channel: %v\n", err)
+	if _, err := conn.Conn().Exec(ctx, "LISTEN db_events"); err != nil {
+		conn.Conn().Close(ctx)
+		return err
 	}
 
 	fmt.Println("Realtime: Listening for Postgres events...")
+	health.connected("notify")
 
 	for {
-		notification, err := conn.Conn().WaitForNotification(context.Background())
+		notification, err := conn.Conn().WaitForNotification(ctx)
 		if err != nil {
-			log.Println("Error waiting for notification:", err)
+			conn.Conn().Close(ctx)
+			return err
+		}
+		health.event()
+
+		body, ok := verifyNotification(notification.Payload)
+		if !ok {
+			log.Println("Realtime: dropping unsigned db_events notification from backend", notification.PID)
 			continue
 		}
 
 		// Parse notification to get ProjectID (schema)
-		// Assuming payload format: {"schema": "project_xyz", "table": "users", "data": {...}}
-		var payload map[string]interface{}
-		if err := json.Unmarshal([]byte(notification.Payload), &payload); err != nil {
+		// Payload format: see ChangeEvent
+		var event ChangeEvent
+		if err := json.Unmarshal(body, &event); err != nil {
 			log.Println("Error parsing notification payload:", err)
 			continue
 		}
 
-		projectID, ok := payload["schema"].(string)
-		if !ok {
+		if event.Schema == "" {
 			// fallback or ignore
 			continue
 		}
 
 		MainHub.broadcast <- Message{
-			ProjectID: projectID,
-			Payload:   []byte(notification.Payload),
+			ProjectID: event.Schema,
+			Event:     &event,
+			Payload:   body,
 		}
 	}
 }
@@ -134,43 +361,173 @@ func WebSocketHandler(c *fiber.Ctx) error {
 	return fiber.ErrUpgradeRequired
 }
 
-// RealtimeEndpoint handles the websocket connection
+// RealtimeEndpoint handles the websocket connection.
+// The client must authenticate with a tenant JWT (see authenticate) before it
+// is registered with the hub.
 func RealtimeEndpoint(c *websocket.Conn) {
-	projectID := c.Params("project") // /ws/:project
+	slug := c.Params("project") // /ws/:project
+	projectID := projectSchema(slug)
 
 	client := &Client{
 		Hub:       MainHub,
 		Conn:      c,
+		Slug:      slug,
 		ProjectID: projectID,
-		Send:      make(chan []byte, 256),
+		Ref:       newRef(),
+		Send:      make(chan []byte, sendQueueSize),
+		limiter:   newRateLimiter(clientMessageRate),
+		transport: wsTransport{c},
 	}
+	c.SetReadLimit(maxMessageBytes)
+
+	claims, err := client.authenticate()
+	if err != nil {
+		client.closeWith(websocket.ClosePolicyViolation, err.Error())
+		return
+	}
+	if MainHub.connections(projectID) >= maxConnectionsPerProject {
+		client.closeWith(websocket.CloseTryAgainLater, "Too many connections for this project")
+		return
+	}
+	client.setClaims(claims)
+	client.writeJSON(fiber.Map{"type": "auth_ok", "expires_at": claims["exp"]})
 
 	client.Hub.register <- client
 
+	done := make(chan struct{})
+	defer close(done)
+	go client.watchAuth(done)
+
+	// Heartbeat: any frame (pongs included) extends the read deadline
+	c.SetReadDeadline(time.Now().Add(pongTimeout))
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
+
 	// Write Pump
 	go func() {
+		ticker := time.NewTicker(pingInterval)
 		defer func() {
+			ticker.Stop()
 			client.Hub.unregister <- client
 			client.Conn.Close()
 		}()
 		for {
-			message, ok := <-client.Send
-			if !ok {
-				return
-			}
-			if err := client.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
-				return
+			select {
+			case message, ok := <-client.Send:
+				if !ok {
+					return
+				}
+				client.writeMu.Lock()
+				err := client.Conn.WriteMessage(websocket.TextMessage, message)
+				client.writeMu.Unlock()
+				if err != nil {
+					return
+				}
+
+			case <-ticker.C:
+				client.writeMu.Lock()
+				err := client.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingInterval))
+				client.writeMu.Unlock()
+				if err != nil {
+					return
+				}
 			}
 		}
 	}()
 
-	// Read Pump (Keep alive)
+	// Read Pump
 	for {
-		_, _, err := c.ReadMessage()
+		_, message, err := c.ReadMessage()
 		if err != nil {
 			client.Hub.unregister <- client
 			client.Conn.Close()
 			break
 		}
+		c.SetReadDeadline(time.Now().Add(pongTimeout))
+
+		if !client.limiter.allow() {
+			client.writeJSON(fiber.Map{"type": "error", "message": "Rate limit exceeded, message dropped"})
+			continue
+		}
+		client.handleMessage(message)
 	}
 }
+
+// connections returns the number of connected clients of a project
+func (h *Hub) connections(project string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients[project])
+}
+
+// handleMessage dispatches a protocol message sent by the client
+func (c *Client) handleMessage(message []byte) {
+	var msg clientMessage
+	if err := json.Unmarshal(message, &msg); err != nil {
+		c.writeJSON(fiber.Map{"type": "error", "message": "Invalid message"})
+		return
+	}
+
+	switch msg.Type {
+	case "auth":
+		c.refreshAuth(msg.Token)
+	case "join":
+		c.join(message)
+	case "leave":
+		c.leave(msg.Channel)
+	case "track":
+		c.track(message)
+	case "untrack":
+		c.untrack(msg.Channel)
+	case "broadcast":
+		c.broadcast(message)
+	case "replay":
+		c.replay(msg.Since)
+	default:
+		c.writeJSON(fiber.Map{"type": "error", "message": "Unknown message type: " + msg.Type})
+	}
+}
+
+// transport carries the messages written outside of the hub's queue
+// (replies, errors) and closes the connection: a WebSocket or an SSE stream
+type transport interface {
+	write(msg []byte) error
+	close(code int, reason string)
+}
+
+// wsTransport is the WebSocket transport
+type wsTransport struct {
+	conn *websocket.Conn
+}
+
+func (t wsTransport) write(msg []byte) error {
+	return t.conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+// close sends a close frame telling the client why
+func (t wsTransport) close(code int, reason string) {
+	t.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	t.conn.Close()
+}
+
+// writeRaw sends an encoded protocol message directly
+func (c *Client) writeRaw(msg []byte) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.transport.write(msg)
+}
+
+// writeJSON sends a protocol message directly (outside of the hub's queue)
+func (c *Client) writeJSON(v interface{}) {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	c.writeRaw(msg)
+}
+
+// closeWith closes the connection telling the client why
+func (c *Client) closeWith(code int, reason string) {
+	c.transport.close(code, reason)
+}
@@ -0,0 +1,198 @@
+package realtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ChangeEvent is a database change notification.
+// Wire format (NOTIFY db_events payload, signed, see verifyNotification):
+//
+//	{"id": "...", "schema": "project_xyz", "table": "todos", "type": "UPDATE",
+//	 "data": {...new row, or old row for DELETE...}, "old": {...}}
+//
+// "id", "type" and "old" are optional; events with an id are delivered once
+// even if several sources report them. payloads without a type only match
+// subscriptions that accept every event. Events emitted by the
+// hanbase_notify_change trigger that would exceed the 8000 byte NOTIFY limit
+// have "truncated": true and no row data.
+type ChangeEvent struct {
+	ID        string                 `json:"id,omitempty"`
+	Schema    string                 `json:"schema"`
+	Table     string                 `json:"table"`
+	Type      string                 `json:"type,omitempty"`
+	Data      map[string]interface{} `json:"data"`
+	Old       map[string]interface{} `json:"old,omitempty"`
+	Truncated bool                   `json:"truncated,omitempty"`
+}
+
+// projectSchema returns the schema of a project slug. Schemas are created
+// with the slug unquoted, so Postgres folds it to lower case, and change
+// events carry the folded name whatever the case of the URL.
+func projectSchema(slug string) string {
+	return strings.ToLower(slug)
+}
+
+// changeSubscription selects the change events a channel receives
+type changeSubscription struct {
+	Schema string   `json:"schema"` // Defaults to the project schema
+	Table  string   `json:"table"`  // "" or "*" means every table
+	Events []string `json:"events"` // INSERT / UPDATE / DELETE, empty or "*" means all
+	Filter string   `json:"filter"` // e.g. "status=eq.open"
+
+	filter *rowFilter
+}
+
+// prepare validates the subscription for a project and parses its filter
+func (s *changeSubscription) prepare(projectID string) error {
+	if s.Schema == "" {
+		s.Schema = projectID
+	}
+	s.Schema = projectSchema(s.Schema)
+	if s.Schema != projectID {
+		return fmt.Errorf("schema must be %q", projectID)
+	}
+	for i, e := range s.Events {
+		e = strings.ToUpper(e)
+		switch e {
+		case "INSERT", "UPDATE", "DELETE", "*":
+		default:
+			return fmt.Errorf("unknown event %q", e)
+		}
+		s.Events[i] = e
+	}
+	if s.Filter != "" {
+		f, err := parseRowFilter(s.Filter)
+		if err != nil {
+			return err
+		}
+		s.filter = f
+	}
+	return nil
+}
+
+func (s *changeSubscription) matches(e *ChangeEvent) bool {
+	if e.Schema != s.Schema {
+		return false
+	}
+	if s.Table != "" && s.Table != "*" && e.Table != s.Table {
+		return false
+	}
+	if len(s.Events) > 0 {
+		ok := false
+		for _, ev := range s.Events {
+			if ev == "*" || ev == e.Type {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if s.filter != nil && !s.filter.matches(e.Data) {
+		return false
+	}
+	return true
+}
+
+// rowFilter is a single PostgREST style condition: column=op.value
+// Supported operators: eq, neq, lt, lte, gt, gte, in.(a,b), is.null
+type rowFilter struct {
+	column string
+	op     string
+	values []string
+}
+
+func parseRowFilter(s string) (*rowFilter, error) {
+	column, rest, ok := strings.Cut(s, "=")
+	if !ok || column == "" {
+		return nil, fmt.Errorf("invalid filter %q, expected column=op.value", s)
+	}
+	op, value, ok := strings.Cut(rest, ".")
+	if !ok {
+		return nil, fmt.Errorf("invalid filter %q, expected column=op.value", s)
+	}
+
+	f := &rowFilter{column: column, op: op}
+	switch op {
+	case "eq", "neq", "lt", "lte", "gt", "gte":
+		f.values = []string{value}
+	case "in":
+		if !strings.HasPrefix(value, "(") || !strings.HasSuffix(value, ")") {
+			return nil, fmt.Errorf("invalid filter %q, expected in.(a,b)", s)
+		}
+		for _, v := range strings.Split(value[1:len(value)-1], ",") {
+			f.values = append(f.values, strings.TrimSpace(v))
+		}
+	case "is":
+		if value != "null" {
+			return nil, fmt.Errorf("invalid filter %q, only is.null is supported", s)
+		}
+	default:
+		return nil, fmt.Errorf("unknown filter operator %q", op)
+	}
+	return f, nil
+}
+
+func (f *rowFilter) matches(row map[string]interface{}) bool {
+	v, present := row[f.column]
+	if f.op == "is" {
+		return present && v == nil
+	}
+	if !present || v == nil {
+		return false
+	}
+
+	switch f.op {
+	case "in":
+		for _, want := range f.values {
+			if compareValue(v, want) == 0 {
+				return true
+			}
+		}
+		return false
+	case "eq":
+		return compareValue(v, f.values[0]) == 0
+	case "neq":
+		return compareValue(v, f.values[0]) != 0
+	case "lt":
+		return compareValue(v, f.values[0]) < 0
+	case "lte":
+		return compareValue(v, f.values[0]) <= 0
+	case "gt":
+		return compareValue(v, f.values[0]) > 0
+	case "gte":
+		return compareValue(v, f.values[0]) >= 0
+	}
+	return false
+}
+
+// compareValue compares a decoded JSON value with a filter literal,
+// numerically when both are numbers and as text otherwise
+func compareValue(v interface{}, literal string) int {
+	var text string
+	switch t := v.(type) {
+	case float64:
+		if n, err := strconv.ParseFloat(literal, 64); err == nil {
+			switch {
+			case t < n:
+				return -1
+			case t > n:
+				return 1
+			}
+			return 0
+		}
+		text = strconv.FormatFloat(t, 'f', -1, 64)
+	case string:
+		text = t
+	case bool:
+		text = strconv.FormatBool(t)
+	default:
+		b, _ := json.Marshal(t)
+		text = string(b)
+	}
+	return strings.Compare(text, literal)
+}
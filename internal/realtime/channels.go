@@ -0,0 +1,167 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// channel is a named topic a client joined. A client only receives the
+// change events matching the postgres_changes of its channels.
+type channel struct {
+	name         string
+	changes      []changeSubscription
+	config       channelConfig
+	canBroadcast bool // Granted by the channel rules when joining
+}
+
+// channelConfig holds the client's options for a channel
+type channelConfig struct {
+	Broadcast struct {
+		Self bool `json:"self"` // Receive own broadcasts
+		Ack  bool `json:"ack"`  // Confirm broadcasts with broadcast_ack
+	} `json:"broadcast"`
+}
+
+// joinMessage is the payload of a "join" protocol message:
+//
+//	{"type": "join", "channel": "open-todos",
+//	 "postgres_changes": [{"table": "todos", "events": ["INSERT", "UPDATE"], "filter": "status=eq.open"}],
+//	 "config": {"broadcast": {"self": false, "ack": true}}}
+type joinMessage struct {
+	Channel         string               `json:"channel"`
+	PostgresChanges []changeSubscription `json:"postgres_changes"`
+	Config          channelConfig        `json:"config"`
+}
+
+// serverMessage is what the hub delivers for a channel
+type serverMessage struct {
+	Type    string          `json:"type"`
+	Channel string          `json:"channel"`
+	Payload json.RawMessage `json:"payload"`
+	Cursor  int64           `json:"cursor,omitempty"` // Outbox position of change events
+}
+
+func (c *Client) join(raw []byte) {
+	var msg joinMessage
+	if err := json.Unmarshal(raw, &msg); err != nil || msg.Channel == "" {
+		c.writeJSON(fiber.Map{"type": "error", "message": "join requires a channel"})
+		return
+	}
+
+	if err := c.joinChannel(msg); err != nil {
+		c.writeJSON(fiber.Map{"type": "error", "channel": msg.Channel, "message": err.Error()})
+		return
+	}
+	c.writeJSON(fiber.Map{"type": "joined", "channel": msg.Channel})
+	c.Hub.presence <- presenceUpdate{client: c, channel: msg.Channel, sync: true}
+}
+
+// joinChannel validates and authorizes a join and adds the channel
+func (c *Client) joinChannel(msg joinMessage) error {
+	if err := c.checkJoinLimits(msg.Channel, len(msg.PostgresChanges)); err != nil {
+		return err
+	}
+
+	allowed, err := authorizeChannel(context.Background(), c.Slug, msg.Channel, c.getClaims())
+	if err != nil {
+		// The error may quote the rule function or the project's data
+		log.Printf("Realtime: channel rules of %s for %q failed: %v\n", c.ProjectID, msg.Channel, err)
+		return errors.New("Could not evaluate the channel rules")
+	}
+	if !allowed[ActionJoin] {
+		return errors.New("Not allowed to join this channel")
+	}
+
+	ch := &channel{name: msg.Channel, config: msg.Config, canBroadcast: allowed[ActionBroadcast]}
+	for _, sub := range msg.PostgresChanges {
+		if err := sub.prepare(c.ProjectID); err != nil {
+			return err
+		}
+		if err := sub.checkDeleteFilter(context.Background()); err != nil {
+			return err
+		}
+		ch.changes = append(ch.changes, sub)
+	}
+
+	// Joining an existing channel name replaces its configuration
+	c.mu.Lock()
+	if c.channels == nil {
+		c.channels = make(map[string]*channel)
+	}
+	c.channels[ch.name] = ch
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Client) leave(name string) {
+	c.mu.Lock()
+	_, ok := c.channels[name]
+	delete(c.channels, name)
+	c.mu.Unlock()
+
+	if !ok {
+		c.writeJSON(fiber.Map{"type": "error", "channel": name, "message": "not joined"})
+		return
+	}
+	c.Hub.presence <- presenceUpdate{client: c, channel: name}
+	c.writeJSON(fiber.Map{"type": "left", "channel": name})
+}
+
+// checkJoinLimits enforces the channel and subscription limits for joining
+// (or re-joining) a channel with n postgres_changes subscriptions
+func (c *Client) checkJoinLimits(name string, n int) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	channels, subscriptions := 0, n
+	for existing, ch := range c.channels {
+		if existing == name {
+			continue // Replaced by the join
+		}
+		channels++
+		subscriptions += len(ch.changes)
+	}
+	if channels+1 > maxChannelsPerConn {
+		return fmt.Errorf("Too many channels (max %d)", maxChannelsPerConn)
+	}
+	if subscriptions > maxSubscriptionsPerConn {
+		return fmt.Errorf("Too many postgres_changes subscriptions (max %d)", maxSubscriptionsPerConn)
+	}
+	return nil
+}
+
+// joined reports whether the client joined a channel
+func (c *Client) joined(name string) bool {
+	return c.channel(name) != nil
+}
+
+// channel returns a joined channel, or nil
+func (c *Client) channel(name string) *channel {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.channels[name]
+}
+
+// matchChanges returns the messages to deliver to the client for a change
+// event: one per joined channel with a matching subscription.
+func (c *Client) matchChanges(e *ChangeEvent, payload json.RawMessage, cursor int64) [][]byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var out [][]byte
+	for _, ch := range c.channels {
+		for i := range ch.changes {
+			if ch.changes[i].matches(e) {
+				msg, _ := json.Marshal(serverMessage{Type: "postgres_changes", Channel: ch.name, Payload: payload, Cursor: cursor})
+				out = append(out, msg)
+				break
+			}
+		}
+	}
+	return out
+}
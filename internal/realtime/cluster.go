@@ -0,0 +1,281 @@
+package realtime
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"baas/internal/db"
+)
+
+// Cluster mode (REALTIME_CLUSTER=true) lets several API instances serve the
+// same projects. Instances exchange client broadcasts and presence over the
+// Postgres NOTIFY channel clusterChannel (signed, see signNotification), so
+// no extra infrastructure is needed:
+//
+//	{"instance": "...", "kind": "broadcast", "project": "...", "channel": "...", "payload": <message>}
+//	{"instance": "...", "kind": "presence", "project": "...", "channel": "...", "joins": {...}, "leaves": {...}}
+//	{"instance": "...", "kind": "change", "project": "...", "payload": <ChangeEvent>}
+//	{"instance": "...", "kind": "sync" | "alive"}
+//
+// Database changes from the NOTIFY source reach every instance directly.
+// The replication source can only run on the instance holding the slot, so
+// that instance forwards its changes as "change" messages. Change events
+// carry an id and are deduplicated (see Hub.dispatch), e.g. when another
+// instance takes over the slot and replays unconfirmed changes.
+//
+// Instances announce themselves every clusterHeartbeat; the presence of an
+// instance not heard of for clusterTimeout is dropped. A starting instance
+// asks the others for their presence with "sync".
+
+const (
+	clusterChannel   = "hanbase_cluster"
+	clusterHeartbeat = 10 * time.Second
+	clusterTimeout   = 3 * clusterHeartbeat
+	// NOTIFY payloads are limited to 8000 bytes, including the signature
+	maxClusterPayload = 7800
+)
+
+type clusterMessage struct {
+	Instance string                   `json:"instance"`
+	Kind     string                   `json:"kind"`
+	Project  string                   `json:"project,omitempty"`
+	Channel  string                   `json:"channel,omitempty"`
+	Payload  json.RawMessage          `json:"payload,omitempty"`
+	Joins    map[string]presenceEntry `json:"joins,omitempty"`
+	Leaves   map[string]presenceEntry `json:"leaves,omitempty"`
+}
+
+// cluster is a hub's link to the other instances
+type cluster struct {
+	hub      *Hub
+	id       string
+	outbound chan []byte
+	inbound  chan clusterMessage
+
+	// Only accessed by Run
+	instances map[string]time.Time                                 // Last heard of, by instance
+	remote    map[string]map[string]map[string]remotePresenceEntry // Project, channel, ref
+}
+
+type remotePresenceEntry struct {
+	instance string
+	entry    presenceEntry
+}
+
+// EnableCluster turns on cluster mode. Must be called before Run.
+func (h *Hub) EnableCluster() {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	h.cluster = &cluster{
+		hub:       h,
+		id:        hex.EncodeToString(b),
+		outbound:  make(chan []byte, 1024),
+		inbound:   make(chan clusterMessage, 256),
+		instances: make(map[string]time.Time),
+		remote:    make(map[string]map[string]map[string]remotePresenceEntry),
+	}
+	go h.cluster.publishLoop()
+	go h.cluster.listen()
+}
+
+// publish queues a message for the other instances. Messages over the NOTIFY
+// size limit, or exceeding the queue, are dropped.
+func (c *cluster) publish(msg clusterMessage) {
+	if c == nil {
+		return
+	}
+	msg.Instance = c.id
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	if len(b) > maxClusterPayload {
+		log.Printf("Realtime: %s message too large for cluster fan-out (%d bytes)\n", msg.Kind, len(b))
+		return
+	}
+	select {
+	case c.outbound <- b:
+	default:
+		log.Println("Realtime: cluster queue full, dropping", msg.Kind, "message")
+	}
+}
+
+// publishChange forwards a change event from the replication source, without
+// its row data if it is too large (like the NOTIFY trigger does)
+func (c *cluster) publishChange(event *ChangeEvent) {
+	if c == nil {
+		return
+	}
+	payload, _ := json.Marshal(event)
+	if len(payload) > maxClusterPayload-200 {
+		truncated := *event
+		truncated.Data, truncated.Old, truncated.Truncated = nil, nil, true
+		payload, _ = json.Marshal(&truncated)
+	}
+	c.publish(clusterMessage{Kind: "change", Project: event.Schema, Payload: payload})
+}
+
+func (c *cluster) publishLoop() {
+	for msg := range c.outbound {
+		payload, err := signNotification(msg)
+		if err == nil {
+			_, err = db.Pool.Exec(context.Background(), "SELECT pg_notify($1, $2)", clusterChannel, payload)
+		}
+		if err != nil {
+			log.Println("Realtime: cluster publish failed:", err)
+		}
+	}
+}
+
+// listen receives the other instances' messages, reconnecting on failure
+func (c *cluster) listen() {
+	for {
+		if err := c.listenOnce(); err != nil {
+			log.Println("Realtime: cluster listener stopped:", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (c *cluster) listenOnce() error {
+	ctx := context.Background()
+	conn, err := db.Pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+clusterChannel); err != nil {
+		return err
+	}
+	fmt.Println("Realtime: Cluster mode, instance", c.id)
+	c.publish(clusterMessage{Kind: "sync"})
+
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		body, ok := verifyNotification(notification.Payload)
+		if !ok {
+			log.Println("Realtime: dropping unsigned cluster message from backend", notification.PID)
+			continue
+		}
+		var msg clusterMessage
+		if err := json.Unmarshal(body, &msg); err != nil || msg.Instance == c.id {
+			continue
+		}
+
+		if msg.Kind == "change" {
+			// Goes straight to dispatch, like the local change sources
+			var event ChangeEvent
+			if err := json.Unmarshal(msg.Payload, &event); err == nil && event.Schema != "" {
+				c.hub.broadcast <- Message{ProjectID: event.Schema, Event: &event, Payload: msg.Payload}
+			}
+		}
+		c.inbound <- msg
+	}
+}
+
+// applyClusterLocked handles a message from another instance. h.mu must be held.
+func (h *Hub) applyClusterLocked(msg clusterMessage) {
+	c := h.cluster
+	c.instances[msg.Instance] = time.Now()
+
+	switch msg.Kind {
+	case "broadcast":
+		h.relayLocked(relayMessage{project: msg.Project, channel: msg.Channel, out: msg.Payload})
+
+	case "presence":
+		diff := presenceDiff{Joins: map[string]presenceEntry{}, Leaves: map[string]presenceEntry{}}
+		channels := c.remote[msg.Project]
+		for ref, entry := range msg.Leaves {
+			if _, ok := channels[msg.Channel][ref]; ok {
+				delete(channels[msg.Channel], ref)
+				diff.Leaves[ref] = entry
+			}
+		}
+		for ref, entry := range msg.Joins {
+			if known, ok := channels[msg.Channel][ref]; ok && string(known.entry.State) == string(entry.State) {
+				continue // Repeated by a sync
+			}
+			if channels == nil {
+				channels = make(map[string]map[string]remotePresenceEntry)
+				c.remote[msg.Project] = channels
+			}
+			if channels[msg.Channel] == nil {
+				channels[msg.Channel] = make(map[string]remotePresenceEntry)
+			}
+			channels[msg.Channel][ref] = remotePresenceEntry{instance: msg.Instance, entry: entry}
+			diff.Joins[ref] = entry
+		}
+		h.cleanupRemoteLocked(msg.Project, msg.Channel)
+		if len(diff.Joins) > 0 || len(diff.Leaves) > 0 {
+			h.sendPresenceDiffLocked(msg.Project, msg.Channel, diff)
+		}
+
+	case "sync":
+		for project, channels := range h.tracked {
+			for channel, present := range channels {
+				joins := make(map[string]presenceEntry, len(present))
+				for client, entry := range present {
+					joins[client.Ref] = entry
+				}
+				c.publish(clusterMessage{Kind: "presence", Project: project, Channel: channel, Joins: joins})
+			}
+		}
+	}
+}
+
+// clusterTickLocked announces this instance and expires the presence of
+// instances that went away. h.mu must be held.
+func (h *Hub) clusterTickLocked() {
+	c := h.cluster
+	c.publish(clusterMessage{Kind: "alive"})
+
+	for instance, seen := range c.instances {
+		if time.Since(seen) < clusterTimeout {
+			continue
+		}
+		delete(c.instances, instance)
+		for project, channels := range c.remote {
+			for channel, present := range channels {
+				leaves := map[string]presenceEntry{}
+				for ref, r := range present {
+					if r.instance == instance {
+						leaves[ref] = r.entry
+						delete(present, ref)
+					}
+				}
+				h.cleanupRemoteLocked(project, channel)
+				if len(leaves) > 0 {
+					h.sendPresenceDiffLocked(project, channel, presenceDiff{Joins: map[string]presenceEntry{}, Leaves: leaves})
+				}
+			}
+		}
+	}
+}
+
+func (h *Hub) cleanupRemoteLocked(project, channel string) {
+	remote := h.cluster.remote
+	if len(remote[project][channel]) == 0 {
+		delete(remote[project], channel)
+	}
+	if len(remote[project]) == 0 {
+		delete(remote, project)
+	}
+}
+
+// remotePresence returns the presence other instances reported for a channel
+func (c *cluster) remotePresence(project, channel string) map[string]remotePresenceEntry {
+	if c == nil {
+		return nil
+	}
+	return c.remote[project][channel]
+}
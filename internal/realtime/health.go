@@ -0,0 +1,70 @@
+package realtime
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// sourceHealth tracks the state of the change source (NOTIFY listener or
+// replication stream)
+type sourceHealth struct {
+	mu          sync.RWMutex
+	Source      string
+	Connected   bool
+	Since       *time.Time // Connected or disconnected since
+	LastEventAt *time.Time
+	LastError   string
+	Reconnects  int
+}
+
+var health = &sourceHealth{}
+
+func (s *sourceHealth) connected(source string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.Source, s.Connected, s.Since = source, true, &now
+}
+
+func (s *sourceHealth) disconnected(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.Connected {
+		s.Reconnects++
+	}
+	s.Connected, s.Since = false, &now
+	if err != nil {
+		s.LastError = err.Error()
+	}
+}
+
+func (s *sourceHealth) event() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.LastEventAt = &now
+}
+
+// HealthHandler reports the realtime change source status, with 503 while
+// it is disconnected
+func HealthHandler(c *fiber.Ctx) error {
+	health.mu.RLock()
+	defer health.mu.RUnlock()
+
+	status := 200
+	if !health.Connected {
+		status = 503
+	}
+	return c.Status(status).JSON(fiber.Map{
+		"source":        health.Source,
+		"connected":     health.Connected,
+		"since":         health.Since,
+		"last_event_at": health.LastEventAt,
+		"last_error":    health.LastError,
+		"reconnects":    health.Reconnects,
+		"outbox":        outboxSize > 0,
+	})
+}
@@ -0,0 +1,96 @@
+package realtime
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Connection settings and limits, configured through the environment
+var (
+	// Ping frames are sent every pingInterval; a connection that sent
+	// nothing (not even a pong) for pongTimeout is closed
+	pingInterval = time.Duration(envInt("REALTIME_PING_INTERVAL", 30)) * time.Second
+	pongTimeout  = time.Duration(envInt("REALTIME_PONG_TIMEOUT", 60)) * time.Second
+
+	// Size of a client's outgoing queue, and what happens when it is full
+	// (one of the Policy constants, PolicyDisconnect when unset)
+	sendQueueSize      = envInt("REALTIME_SEND_QUEUE", 256)
+	slowConsumerPolicy = os.Getenv("REALTIME_SLOW_CONSUMER")
+
+	maxMessageBytes          = int64(envInt("REALTIME_MAX_MESSAGE_BYTES", 64*1024))
+	maxChannelsPerConn       = envInt("REALTIME_MAX_CHANNELS", 100)
+	maxSubscriptionsPerConn  = envInt("REALTIME_MAX_SUBSCRIPTIONS", 100)
+	maxConnectionsPerProject = envInt("REALTIME_MAX_CONNECTIONS_PER_PROJECT", 10000)
+	// Messages a connection may send per second, and broadcasts per project
+	clientMessageRate    = envInt("REALTIME_CLIENT_MESSAGES_PER_SECOND", 50)
+	projectBroadcastRate = envInt("REALTIME_PROJECT_BROADCASTS_PER_SECOND", 1000)
+)
+
+// Slow consumer policies: what the hub does when a client's queue is full
+const (
+	// PolicyDisconnect closes the connection (default)
+	PolicyDisconnect = "disconnect"
+	// PolicyDropOldest discards the oldest queued message
+	PolicyDropOldest = "drop_oldest"
+	// PolicyCoalesce keeps only the latest queued broadcast per channel,
+	// event and sender (e.g. cursor positions), disconnecting if that does
+	// not free any space
+	PolicyCoalesce = "coalesce"
+)
+
+// envInt reads an integer setting, falling back to def
+func envInt(name string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return n
+	}
+	return def
+}
+
+// rateLimiter is a token bucket allowing rate events per second, with
+// bursts of up to one second worth of events. A rate <= 0 disables it.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (l *rateLimiter) allow() bool {
+	if l.rate <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+var (
+	projectLimitersMu sync.Mutex
+	projectLimiters   = make(map[string]*rateLimiter)
+)
+
+// projectBroadcastLimiter returns the broadcast limiter of a project
+func projectBroadcastLimiter(project string) *rateLimiter {
+	projectLimitersMu.Lock()
+	defer projectLimitersMu.Unlock()
+	l, ok := projectLimiters[project]
+	if !ok {
+		l = newRateLimiter(projectBroadcastRate)
+		projectLimiters[project] = l
+	}
+	return l
+}
@@ -0,0 +1,123 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+
+	"baas/internal/db"
+)
+
+// Outbox: with REALTIME_OUTBOX_SIZE set, the last change events of each
+// project are kept in <project>.realtime_outbox and delivered with their
+// position ("cursor"). A client that reconnects joins its channels again and
+// asks for what it missed:
+//
+//	-> {"type": "replay", "since": 1234}
+//	<- postgres_changes messages with cursor > 1234, for the joined channels
+//	<- {"type": "replay_done", "cursor": 1300}
+//
+// Replayed and live events may overlap; clients should skip cursors they
+// already processed.
+
+// outboxSize is the number of change events kept per project, 0 disables
+// the outbox
+var outboxSize = envInt("REALTIME_OUTBOX_SIZE", 0)
+
+// outboxPruneEvery is how often (in events stored by this instance) old
+// outbox entries are removed
+const outboxPruneEvery = 100
+
+var (
+	outboxStoredMu sync.Mutex
+	outboxStored   = make(map[string]int) // Events stored per project since the last prune
+)
+
+// storeOutbox appends a change event to its project's outbox and sets the
+// message's cursor. Events already stored (same id, e.g. received by several
+// cluster instances) keep their first cursor.
+func storeOutbox(ctx context.Context, m *Message) error {
+	if outboxSize <= 0 || !isValidIdentifier(m.ProjectID) {
+		return nil
+	}
+
+	var eventID *string
+	if m.Event.ID != "" {
+		eventID = &m.Event.ID
+	}
+	// DO UPDATE (unlike DO NOTHING) returns the row a concurrent insert of
+	// the same event committed, once it has
+	query := fmt.Sprintf(`
+		INSERT INTO %s.realtime_outbox (event_id, event) VALUES ($1, $2::jsonb)
+		ON CONFLICT (event_id) DO UPDATE SET event_id = EXCLUDED.event_id
+		RETURNING seq`, m.ProjectID)
+	if err := db.Pool.QueryRow(ctx, query, eventID, string(m.Payload)).Scan(&m.Cursor); err != nil {
+		return err
+	}
+
+	outboxStoredMu.Lock()
+	outboxStored[m.ProjectID]++
+	prune := outboxStored[m.ProjectID] >= outboxPruneEvery
+	if prune {
+		outboxStored[m.ProjectID] = 0
+	}
+	outboxStoredMu.Unlock()
+	if !prune {
+		return nil
+	}
+
+	// Sequence values are skipped (conflicting or rolled back inserts), so
+	// keep the newest outboxSize rows rather than a range of seq
+	query = fmt.Sprintf(`
+		DELETE FROM %s.realtime_outbox
+		WHERE seq < (SELECT seq FROM %s.realtime_outbox ORDER BY seq DESC OFFSET $1 LIMIT 1)`,
+		m.ProjectID, m.ProjectID)
+	_, err := db.Pool.Exec(ctx, query, outboxSize-1)
+	return err
+}
+
+// replay sends the stored change events after a cursor that match the
+// client's channels
+func (c *Client) replay(since int64) {
+	if outboxSize <= 0 {
+		c.writeJSON(fiber.Map{"type": "error", "message": "Replay is not enabled"})
+		return
+	}
+	if !isValidIdentifier(c.ProjectID) {
+		return
+	}
+
+	ctx := context.Background()
+	query := fmt.Sprintf("SELECT seq, event FROM %s.realtime_outbox WHERE seq > $1 ORDER BY seq LIMIT %d", c.ProjectID, outboxSize)
+	rows, err := db.Pool.Query(ctx, query, since)
+	if err != nil {
+		c.writeJSON(fiber.Map{"type": "error", "message": "Replay failed"})
+		return
+	}
+	var messages []Message
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.Cursor, &m.Payload); err != nil {
+			continue
+		}
+		var event ChangeEvent
+		if err := json.Unmarshal(m.Payload, &event); err != nil {
+			continue
+		}
+		m.ProjectID, m.Event = c.ProjectID, &event
+		messages = append(messages, m)
+	}
+	rows.Close()
+
+	cursor := since
+	for _, m := range messages {
+		for _, out := range resolveDeliveries(ctx, m, []*Client{c})[c] {
+			c.writeRaw(out)
+		}
+		cursor = m.Cursor
+	}
+	c.writeJSON(fiber.Map{"type": "replay_done", "cursor": cursor})
+}
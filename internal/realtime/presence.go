@@ -0,0 +1,170 @@
+package realtime
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Presence: clients track a JSON state on a joined channel and everyone on
+// the channel is told who is present.
+//
+//	-> {"type": "track", "channel": "doc-1", "state": {"name": "Ana", "cursor": 12}}
+//	-> {"type": "untrack", "channel": "doc-1"}
+//	<- {"type": "presence_state", "channel": "doc-1", "payload": {"<ref>": {"user_id": "...", "state": {...}}}}
+//	<- {"type": "presence_diff", "channel": "doc-1", "payload": {"joins": {...}, "leaves": {...}}}
+//
+// presence_state is sent after joining a channel, presence_diff whenever a
+// client tracks (again), untracks, leaves the channel or disconnects. Entries
+// are keyed by connection ref, so a user with two tabs is present twice.
+
+// presenceEntry is a client's tracked state on a channel
+type presenceEntry struct {
+	UserID interface{}     `json:"user_id"`
+	State  json.RawMessage `json:"state"`
+}
+
+// presenceUpdate asks the hub loop to change or report presence
+type presenceUpdate struct {
+	client  *Client
+	channel string
+	state   json.RawMessage // nil untracks
+	sync    bool            // Only send the channel's presence_state to client
+}
+
+type presenceDiff struct {
+	Joins  map[string]presenceEntry `json:"joins"`
+	Leaves map[string]presenceEntry `json:"leaves"`
+}
+
+type presenceMessage struct {
+	Type    string      `json:"type"`
+	Channel string      `json:"channel"`
+	Payload interface{} `json:"payload"`
+}
+
+func (c *Client) track(raw []byte) {
+	var msg struct {
+		Channel string          `json:"channel"`
+		State   json.RawMessage `json:"state"`
+	}
+	if err := json.Unmarshal(raw, &msg); err != nil || msg.Channel == "" {
+		c.writeJSON(fiber.Map{"type": "error", "message": "track requires a channel"})
+		return
+	}
+	if !c.joined(msg.Channel) {
+		c.writeJSON(fiber.Map{"type": "error", "channel": msg.Channel, "message": "not joined"})
+		return
+	}
+	if len(msg.State) == 0 || string(msg.State) == "null" {
+		msg.State = json.RawMessage("{}")
+	}
+	c.Hub.presence <- presenceUpdate{client: c, channel: msg.Channel, state: msg.State}
+}
+
+func (c *Client) untrack(channel string) {
+	c.Hub.presence <- presenceUpdate{client: c, channel: channel}
+}
+
+// applyPresenceLocked handles a presenceUpdate. h.mu must be held.
+func (h *Hub) applyPresenceLocked(u presenceUpdate) {
+	project := u.client.ProjectID
+	if !h.clients[project][u.client] {
+		return // Disconnected meanwhile
+	}
+	present := h.tracked[project][u.channel]
+
+	if u.sync {
+		remote := h.cluster.remotePresence(project, u.channel)
+		state := make(map[string]presenceEntry, len(present)+len(remote))
+		for client, entry := range present {
+			state[client.Ref] = entry
+		}
+		for ref, r := range remote {
+			state[ref] = r.entry
+		}
+		h.sendLocked(u.client, presenceJSON("presence_state", u.channel, state))
+		return
+	}
+
+	diff := presenceDiff{Joins: map[string]presenceEntry{}, Leaves: map[string]presenceEntry{}}
+	if previous, ok := present[u.client]; ok {
+		diff.Leaves[u.client.Ref] = previous
+		delete(present, u.client)
+	}
+	if u.state != nil {
+		if present == nil {
+			if h.tracked[project] == nil {
+				h.tracked[project] = make(map[string]map[*Client]presenceEntry)
+			}
+			present = make(map[*Client]presenceEntry)
+			h.tracked[project][u.channel] = present
+		}
+		entry := presenceEntry{UserID: u.client.getClaims()["sub"], State: u.state}
+		present[u.client] = entry
+		diff.Joins[u.client.Ref] = entry
+	}
+	if len(diff.Joins) == 0 && len(diff.Leaves) == 0 {
+		return
+	}
+	h.cleanupPresenceLocked(project, u.channel)
+	h.broadcastPresenceLocked(project, u.channel, diff)
+}
+
+// untrackAllLocked ends a disconnected client's presence on every channel.
+// h.mu must be held.
+func (h *Hub) untrackAllLocked(client *Client) {
+	for channel, present := range h.tracked[client.ProjectID] {
+		entry, ok := present[client]
+		if !ok {
+			continue
+		}
+		delete(present, client)
+		h.cleanupPresenceLocked(client.ProjectID, channel)
+		h.broadcastPresenceLocked(client.ProjectID, channel, presenceDiff{
+			Joins:  map[string]presenceEntry{},
+			Leaves: map[string]presenceEntry{client.Ref: entry},
+		})
+	}
+}
+
+func (h *Hub) cleanupPresenceLocked(project, channel string) {
+	if len(h.tracked[project][channel]) == 0 {
+		delete(h.tracked[project], channel)
+	}
+	if len(h.tracked[project]) == 0 {
+		delete(h.tracked, project)
+	}
+}
+
+// broadcastPresenceLocked announces a change of local presence, to this
+// instance's clients and to the cluster. h.mu must be held.
+func (h *Hub) broadcastPresenceLocked(project, channel string, diff presenceDiff) {
+	h.sendPresenceDiffLocked(project, channel, diff)
+	h.cluster.publish(clusterMessage{Kind: "presence", Project: project, Channel: channel, Joins: diff.Joins, Leaves: diff.Leaves})
+}
+
+// sendPresenceDiffLocked sends a presence_diff to the project's clients that
+// joined the channel. h.mu must be held.
+func (h *Hub) sendPresenceDiffLocked(project, channel string, diff presenceDiff) {
+	msg := presenceJSON("presence_diff", channel, diff)
+	for client := range h.clients[project] {
+		if client.joined(channel) {
+			h.sendLocked(client, msg)
+		}
+	}
+}
+
+func presenceJSON(kind, channel string, payload interface{}) []byte {
+	b, _ := json.Marshal(presenceMessage{Type: kind, Channel: channel, Payload: payload})
+	return b
+}
+
+// newRef returns a random connection reference
+func newRef() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
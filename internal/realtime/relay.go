@@ -0,0 +1,85 @@
+package realtime
+
+import (
+	"encoding/json"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Client broadcast: ephemeral messages (cursors, typing indicators...)
+// relayed to the other clients that joined a channel. Nothing is stored.
+//
+//	-> {"type": "broadcast", "channel": "doc-1", "event": "cursor", "payload": {"x": 10}, "ref": "42"}
+//	<- {"type": "broadcast", "channel": "doc-1", "payload": {"event": "cursor", "payload": {"x": 10}, "from": "<ref>"}}
+//	<- {"type": "broadcast_ack", "channel": "doc-1", "ref": "42"}  (config.broadcast.ack)
+//
+// The sender receives its own messages only with config.broadcast.self.
+
+// relayMessage is a client broadcast for the hub loop to fan out
+type relayMessage struct {
+	project string
+	sender  *Client // nil when relayed from another instance
+	channel string
+	out     []byte
+}
+
+type broadcastPayload struct {
+	Event   string          `json:"event"`
+	Payload json.RawMessage `json:"payload"`
+	From    string          `json:"from"`
+}
+
+func (c *Client) broadcast(raw []byte) {
+	var msg struct {
+		Channel string          `json:"channel"`
+		Event   string          `json:"event"`
+		Payload json.RawMessage `json:"payload"`
+		Ref     string          `json:"ref"`
+	}
+	if err := json.Unmarshal(raw, &msg); err != nil || msg.Channel == "" || msg.Event == "" {
+		c.writeJSON(fiber.Map{"type": "error", "message": "broadcast requires a channel and an event"})
+		return
+	}
+
+	ch := c.channel(msg.Channel)
+	if ch == nil {
+		c.writeJSON(fiber.Map{"type": "error", "channel": msg.Channel, "message": "not joined"})
+		return
+	}
+	if !ch.canBroadcast {
+		c.writeJSON(fiber.Map{"type": "error", "channel": msg.Channel, "message": "Not allowed to broadcast on this channel"})
+		return
+	}
+
+	if !projectBroadcastLimiter(c.ProjectID).allow() {
+		c.writeJSON(fiber.Map{"type": "error", "channel": msg.Channel, "message": "Project broadcast rate limit exceeded"})
+		return
+	}
+
+	if len(msg.Payload) == 0 {
+		msg.Payload = json.RawMessage("null")
+	}
+	payload, _ := json.Marshal(broadcastPayload{Event: msg.Event, Payload: msg.Payload, From: c.Ref})
+	out, _ := json.Marshal(serverMessage{Type: "broadcast", Channel: msg.Channel, Payload: payload})
+
+	c.Hub.relay <- relayMessage{project: c.ProjectID, sender: c, channel: msg.Channel, out: out}
+	c.Hub.cluster.publish(clusterMessage{Kind: "broadcast", Project: c.ProjectID, Channel: msg.Channel, Payload: out})
+
+	if ch.config.Broadcast.Ack {
+		c.writeJSON(fiber.Map{"type": "broadcast_ack", "channel": msg.Channel, "ref": msg.Ref})
+	}
+}
+
+// relayLocked fans a client broadcast out to the channel. h.mu must be held.
+func (h *Hub) relayLocked(m relayMessage) {
+	for client := range h.clients[m.project] {
+		ch := client.channel(m.channel)
+		if ch == nil {
+			continue
+		}
+		if client == m.sender && !ch.config.Broadcast.Self {
+			continue
+		}
+		h.sendLocked(client, m.out)
+	}
+}
@@ -0,0 +1,424 @@
+package realtime
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"baas/internal/db"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Logical replication change source, selected with REALTIME_SOURCE=replication.
+// Unlike LISTEN/NOTIFY it has no payload size limit and does not lose events
+// while disconnected: the replication slot retains WAL until the consumed
+// position (LSN) is confirmed.
+//
+// Tables are added to the publication by SetRealtimeTableHandler, which also
+// sets REPLICA IDENTITY FULL so updates and deletes carry the full old row.
+// Requires wal_level=logical.
+
+const (
+	// RealtimePublication is the publication realtime-enabled tables belong to
+	RealtimePublication = "hanbase_realtime"
+
+	standbyStatusInterval = 10 * time.Second
+	replicationRetryDelay = 5 * time.Second
+)
+
+// Postgres epoch used by the replication protocol's timestamps
+var pgEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ListenToReplication consumes the realtime replication slot and feeds
+// MainHub, reconnecting after failures.
+func ListenToReplication() {
+	slot := os.Getenv("REALTIME_SLOT")
+	if slot == "" {
+		slot = "hanbase_realtime"
+	}
+
+	if err := syncPublication(context.Background()); err != nil {
+		log.Println("Realtime: could not sync publication:", err)
+	}
+
+	for {
+		err := consumeReplication(context.Background(), slot)
+		health.disconnected(err)
+		log.Printf("Realtime: replication stream stopped: %v (retrying in %s)\n", err, replicationRetryDelay)
+		time.Sleep(replicationRetryDelay)
+	}
+}
+
+func consumeReplication(ctx context.Context, slot string) error {
+	// The slot is created on the regular pool so its existence can be checked
+	// first; it starts at the current WAL position.
+	_, err := db.Pool.Exec(ctx, `
+		SELECT pg_create_logical_replication_slot($1, 'pgoutput')
+		WHERE NOT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)`, slot)
+	if err != nil {
+		return fmt.Errorf("create slot: %w", err)
+	}
+
+	config, err := pgconn.ParseConfig(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return err
+	}
+	config.RuntimeParams["replication"] = "database"
+
+	conn, err := pgconn.ConnectConfig(ctx, config)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	// LSN 0/0 resumes from the slot's confirmed position
+	conn.Frontend().Send(&pgproto3.Query{String: fmt.Sprintf(
+		"START_REPLICATION SLOT %s LOGICAL 0/0 (proto_version '1', publication_names '%s')",
+		slot, RealtimePublication)})
+	if err := conn.Frontend().Flush(); err != nil {
+		return err
+	}
+	for {
+		msg, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			return err
+		}
+		if e, ok := msg.(*pgproto3.ErrorResponse); ok {
+			return fmt.Errorf("start replication: %s", e.Message)
+		}
+		if _, ok := msg.(*pgproto3.CopyBothResponse); ok {
+			break
+		}
+	}
+
+	fmt.Println("Realtime: Consuming logical replication slot", slot)
+	health.connected("replication")
+
+	decoder := newPgoutputDecoder()
+	var confirmed uint64 // Last LSN whose changes were handed to the hub
+	nextStatus := time.Now().Add(standbyStatusInterval)
+
+	for {
+		if time.Now().After(nextStatus) {
+			if err := sendStandbyStatus(conn, confirmed); err != nil {
+				return err
+			}
+			nextStatus = time.Now().Add(standbyStatusInterval)
+		}
+
+		recvCtx, cancel := context.WithDeadline(ctx, nextStatus)
+		msg, err := conn.ReceiveMessage(recvCtx)
+		cancel()
+		if err != nil {
+			if pgconn.Timeout(err) {
+				continue
+			}
+			return err
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.ErrorResponse:
+			return fmt.Errorf("replication: %s", msg.Message)
+
+		case *pgproto3.CopyData:
+			if len(msg.Data) == 0 {
+				continue
+			}
+			switch msg.Data[0] {
+			case 'k': // Primary keepalive: walEnd(8) serverTime(8) replyRequested(1)
+				if len(msg.Data) < 18 {
+					continue
+				}
+				// With no transaction in progress everything up to walEnd was
+				// seen; without confirming it, WAL of other databases or of
+				// tables outside the publication would be retained forever
+				walEnd := binary.BigEndian.Uint64(msg.Data[1:9])
+				if walEnd > confirmed && decoder.idle() {
+					confirmed = walEnd
+				}
+				if msg.Data[17] == 1 {
+					nextStatus = time.Time{} // Reply right away
+				}
+
+			case 'w': // XLogData: walStart(8) walEnd(8) serverTime(8) data
+				if len(msg.Data) < 25 {
+					continue
+				}
+				walStart := binary.BigEndian.Uint64(msg.Data[1:9])
+				event, commitLSN, err := decoder.decode(msg.Data[25:])
+				if err != nil {
+					log.Println("Realtime: could not decode pgoutput message:", err)
+				}
+				if event != nil {
+					health.event()
+					// The change's LSN identifies it across instances and replays
+					event.ID = fmt.Sprintf("%X", walStart)
+					publishChange(event)
+				}
+				if commitLSN != 0 {
+					confirmed = commitLSN
+				} else if walStart > confirmed && event == nil && decoder.idle() {
+					confirmed = walStart
+				}
+			}
+		}
+	}
+}
+
+// sendStandbyStatus confirms that WAL up to lsn was processed, letting the
+// server recycle it (and resume after it on reconnect)
+func sendStandbyStatus(conn *pgconn.PgConn, lsn uint64) error {
+	buf := make([]byte, 34)
+	buf[0] = 'r'
+	binary.BigEndian.PutUint64(buf[1:], lsn)  // Written
+	binary.BigEndian.PutUint64(buf[9:], lsn)  // Flushed
+	binary.BigEndian.PutUint64(buf[17:], lsn) // Applied
+	binary.BigEndian.PutUint64(buf[25:], uint64(time.Since(pgEpoch).Microseconds()))
+	buf[33] = 0
+
+	conn.Frontend().Send(&pgproto3.CopyData{Data: buf})
+	return conn.Frontend().Flush()
+}
+
+func publishChange(event *ChangeEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Println("Realtime: could not encode change:", err)
+		return
+	}
+	MainHub.broadcast <- Message{
+		ProjectID: event.Schema,
+		Event:     event,
+		Payload:   payload,
+	}
+	MainHub.cluster.publishChange(event)
+}
+
+// pgoutput (protocol version 1) decoding
+
+type relationColumn struct {
+	name    string
+	typeOID uint32
+}
+
+type relation struct {
+	schema  string
+	table   string
+	columns []relationColumn
+}
+
+type pgoutputDecoder struct {
+	relations map[uint32]*relation
+	inTx      bool
+}
+
+func newPgoutputDecoder() *pgoutputDecoder {
+	return &pgoutputDecoder{relations: make(map[uint32]*relation)}
+}
+
+// idle reports whether the decoder is between transactions
+func (d *pgoutputDecoder) idle() bool { return !d.inTx }
+
+// decode handles one pgoutput message. It returns the change event for
+// row messages, and the end LSN for commit messages.
+func (d *pgoutputDecoder) decode(data []byte) (*ChangeEvent, uint64, error) {
+	if len(data) == 0 {
+		return nil, 0, nil
+	}
+	r := &byteReader{buf: data[1:]}
+
+	switch data[0] {
+	case 'B': // Begin
+		d.inTx = true
+		return nil, 0, nil
+
+	case 'C': // Commit: flags(1) commitLSN(8) endLSN(8) commitTime(8)
+		d.inTx = false
+		r.uint8()
+		r.uint64()
+		end := r.uint64()
+		return nil, end, r.err
+
+	case 'R': // Relation
+		id := r.uint32()
+		rel := &relation{schema: r.string(), table: r.string()}
+		r.uint8() // Replica identity
+		n := int(r.uint16())
+		for i := 0; i < n && r.err == nil; i++ {
+			r.uint8() // Flags
+			col := relationColumn{name: r.string(), typeOID: r.uint32()}
+			r.uint32() // Type modifier
+			rel.columns = append(rel.columns, col)
+		}
+		if r.err == nil {
+			d.relations[id] = rel
+		}
+		return nil, 0, r.err
+
+	case 'I': // Insert: relID(4) 'N' tuple
+		rel, err := d.relation(r.uint32())
+		if err != nil {
+			return nil, 0, err
+		}
+		r.uint8()
+		row := d.tuple(r, rel, nil)
+		return &ChangeEvent{Schema: rel.schema, Table: rel.table, Type: "INSERT", Data: row}, 0, r.err
+
+	case 'U': // Update: relID(4) ['K'|'O' tuple] 'N' tuple
+		rel, err := d.relation(r.uint32())
+		if err != nil {
+			return nil, 0, err
+		}
+		var old map[string]interface{}
+		kind := r.uint8()
+		if kind == 'K' || kind == 'O' {
+			old = d.tuple(r, rel, nil)
+			r.uint8() // 'N'
+		}
+		row := d.tuple(r, rel, old)
+		return &ChangeEvent{Schema: rel.schema, Table: rel.table, Type: "UPDATE", Data: row, Old: old}, 0, r.err
+
+	case 'D': // Delete: relID(4) 'K'|'O' tuple
+		rel, err := d.relation(r.uint32())
+		if err != nil {
+			return nil, 0, err
+		}
+		r.uint8()
+		old := d.tuple(r, rel, nil)
+		return &ChangeEvent{Schema: rel.schema, Table: rel.table, Type: "DELETE", Data: old, Old: old}, 0, r.err
+	}
+
+	// Origin, Type, Truncate and Message carry nothing for subscribers
+	return nil, 0, nil
+}
+
+func (d *pgoutputDecoder) relation(id uint32) (*relation, error) {
+	rel, ok := d.relations[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown relation %d", id)
+	}
+	return rel, nil
+}
+
+// tuple decodes TupleData into a row. Unchanged TOAST values are taken from
+// fallback (the old row) when available.
+func (d *pgoutputDecoder) tuple(r *byteReader, rel *relation, fallback map[string]interface{}) map[string]interface{} {
+	n := int(r.uint16())
+	row := make(map[string]interface{}, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		kind := r.uint8()
+		if i >= len(rel.columns) {
+			if kind == 't' {
+				r.bytes(int(r.uint32()))
+			}
+			continue
+		}
+		col := rel.columns[i]
+		switch kind {
+		case 'n':
+			row[col.name] = nil
+		case 'u':
+			if v, ok := fallback[col.name]; ok {
+				row[col.name] = v
+			}
+		case 't':
+			row[col.name] = d.value(col.typeOID, r.bytes(int(r.uint32())))
+		}
+	}
+	return row
+}
+
+// value decodes a text-format column value the way row_to_json renders it
+// (and the NOTIFY source delivers it): numbers, booleans and json as such,
+// everything else as text
+func (d *pgoutputDecoder) value(oid uint32, text []byte) interface{} {
+	switch oid {
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.Float4OID, pgtype.Float8OID, pgtype.NumericOID:
+		if n, err := strconv.ParseFloat(string(text), 64); err == nil {
+			return n
+		}
+	case pgtype.BoolOID:
+		return string(text) == "t"
+	case pgtype.JSONOID, pgtype.JSONBOID:
+		var v interface{}
+		if err := json.Unmarshal(text, &v); err == nil {
+			return v
+		}
+	}
+	return string(text)
+}
+
+// byteReader reads big-endian protocol fields, remembering the first error
+type byteReader struct {
+	buf []byte
+	err error
+}
+
+func (r *byteReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.buf) < n {
+		r.err = fmt.Errorf("short pgoutput message")
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *byteReader) uint8() byte {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *byteReader) uint16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *byteReader) uint32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *byteReader) uint64() uint64 {
+	if b := r.take(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *byteReader) bytes(n int) []byte {
+	return r.take(n)
+}
+
+// string reads a NUL-terminated string
+func (r *byteReader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	for i, b := range r.buf {
+		if b == 0 {
+			s := string(r.buf[:i])
+			r.buf = r.buf[i+1:]
+			return s
+		}
+	}
+	r.err = fmt.Errorf("unterminated string in pgoutput message")
+	return ""
+}
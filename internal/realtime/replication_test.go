@@ -0,0 +1,178 @@
+package realtime
+
+import (
+	"reflect"
+	"testing"
+)
+
+// pgoutput v1 messages, laid out as the server streams them, for
+//
+//	CREATE TABLE myapp.todos (id bigint PRIMARY KEY, title text, done boolean, meta jsonb);
+//	ALTER TABLE myapp.todos REPLICA IDENTITY FULL;
+//
+// (relation OID 16385). Fields are big-endian; strings are NUL-terminated;
+// tuple columns are 'n' (null), 'u' (unchanged TOAST) or 't' + int32
+// length + text.
+const (
+	msgRelation = "R" + "\x00\x00\x40\x01" + "myapp\x00" + "todos\x00" + "f" + "\x00\x04" +
+		"\x01" + "id\x00" + "\x00\x00\x00\x14" + "\xff\xff\xff\xff" +
+		"\x00" + "title\x00" + "\x00\x00\x00\x19" + "\xff\xff\xff\xff" +
+		"\x00" + "done\x00" + "\x00\x00\x00\x10" + "\xff\xff\xff\xff" +
+		"\x00" + "meta\x00" + "\x00\x00\x0e\xda" + "\xff\xff\xff\xff"
+
+	msgBegin = "B" + "\x00\x00\x00\x00\x01\x6b\x37\x78" + "\x00\x02\xb9\x5e\x3a\x4c\x10\x00" + "\x00\x00\x02\xf1"
+
+	msgCommit = "C" + "\x00" + "\x00\x00\x00\x00\x01\x6b\x37\x48" + "\x00\x00\x00\x00\x01\x6b\x37\x78" +
+		"\x00\x02\xb9\x5e\x3a\x4c\x10\x00"
+
+	// INSERT (42, 'buy milk', false, NULL)
+	msgInsert = "I" + "\x00\x00\x40\x01" + "N" + "\x00\x04" +
+		"t\x00\x00\x00\x02" + "42" +
+		"t\x00\x00\x00\x08" + "buy milk" +
+		"t\x00\x00\x00\x01" + "f" +
+		"n"
+
+	// UPDATE SET done = true, with the old row and meta unchanged (TOAST)
+	msgUpdate = "U" + "\x00\x00\x40\x01" +
+		"O" + "\x00\x04" +
+		"t\x00\x00\x00\x02" + "42" +
+		"t\x00\x00\x00\x08" + "buy milk" +
+		"t\x00\x00\x00\x01" + "f" +
+		"t\x00\x00\x00\x0c" + `{"big": "x"}` +
+		"N" + "\x00\x04" +
+		"t\x00\x00\x00\x02" + "42" +
+		"t\x00\x00\x00\x08" + "buy milk" +
+		"t\x00\x00\x00\x01" + "t" +
+		"u"
+
+	// The same update without the old row (REPLICA IDENTITY DEFAULT)
+	msgUpdateNoOld = "U" + "\x00\x00\x40\x01" +
+		"N" + "\x00\x04" +
+		"t\x00\x00\x00\x02" + "42" +
+		"n" +
+		"t\x00\x00\x00\x01" + "t" +
+		"u"
+
+	msgDelete = "D" + "\x00\x00\x40\x01" +
+		"O" + "\x00\x04" +
+		"t\x00\x00\x00\x02" + "42" +
+		"t\x00\x00\x00\x08" + "buy milk" +
+		"t\x00\x00\x00\x01" + "t" +
+		"n"
+
+	msgOrigin = "O" + "\x00\x00\x00\x00\x01\x6b\x37\x48" + "node_a\x00"
+)
+
+func TestPgoutputDecoder(t *testing.T) {
+	row := map[string]interface{}{"id": float64(42), "title": "buy milk", "done": false, "meta": nil}
+	oldRow := map[string]interface{}{"id": float64(42), "title": "buy milk", "done": false, "meta": map[string]interface{}{"big": "x"}}
+	newRow := map[string]interface{}{"id": float64(42), "title": "buy milk", "done": true, "meta": map[string]interface{}{"big": "x"}}
+	deleted := map[string]interface{}{"id": float64(42), "title": "buy milk", "done": true, "meta": nil}
+
+	tests := []struct {
+		name     string
+		messages []string // Decoded in order; the last one is checked
+		want     *ChangeEvent
+		wantLSN  uint64
+		wantErr  bool
+	}{
+		{"relation", []string{msgRelation}, nil, 0, false},
+		{"insert", []string{msgRelation, msgInsert}, &ChangeEvent{Schema: "myapp", Table: "todos", Type: "INSERT", Data: row}, 0, false},
+		{"update", []string{msgRelation, msgUpdate}, &ChangeEvent{Schema: "myapp", Table: "todos", Type: "UPDATE", Data: newRow, Old: oldRow}, 0, false},
+		{
+			"update without old row", []string{msgRelation, msgUpdateNoOld},
+			&ChangeEvent{Schema: "myapp", Table: "todos", Type: "UPDATE", Data: map[string]interface{}{"id": float64(42), "title": nil, "done": true}},
+			0, false,
+		},
+		{"delete", []string{msgRelation, msgDelete}, &ChangeEvent{Schema: "myapp", Table: "todos", Type: "DELETE", Data: deleted, Old: deleted}, 0, false},
+		{"begin", []string{msgBegin}, nil, 0, false},
+		{"commit", []string{msgBegin, msgRelation, msgInsert, msgCommit}, nil, 0x16b3778, false},
+		{"origin", []string{msgOrigin}, nil, 0, false},
+		{"empty", []string{""}, nil, 0, false},
+
+		{"unknown relation", []string{msgInsert}, nil, 0, true},
+		{"truncated relation", []string{msgRelation[:20]}, nil, 0, true},
+		{"relation of a failed message is not kept", []string{msgRelation[:20], msgInsert}, nil, 0, true},
+		{"truncated insert", []string{msgRelation, msgInsert[:len(msgInsert)-6]}, nil, 0, true},
+		{"value longer than the message", []string{msgRelation, msgInsert[:9] + "\x7f\xff\xff\xff" + "42"}, nil, 0, true},
+		{"truncated update", []string{msgRelation, msgUpdate[:40]}, nil, 0, true},
+		{"truncated delete", []string{msgRelation, msgDelete[:8]}, nil, 0, true},
+		{"truncated commit", []string{msgCommit[:12]}, nil, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newPgoutputDecoder()
+			var (
+				event *ChangeEvent
+				lsn   uint64
+				err   error
+			)
+			for i, msg := range tt.messages {
+				event, lsn, err = d.decode([]byte(msg))
+				if err != nil && i < len(tt.messages)-1 && !tt.wantErr {
+					t.Fatalf("decode(message %d): %v", i, err)
+				}
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("decode: want an error, got %+v", event)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(event, tt.want) {
+				t.Errorf("decode = %+v, want %+v", event, tt.want)
+			}
+			if lsn != tt.wantLSN {
+				t.Errorf("decode LSN = %X, want %X", lsn, tt.wantLSN)
+			}
+		})
+	}
+}
+
+func TestPgoutputDecoderIdle(t *testing.T) {
+	d := newPgoutputDecoder()
+	steps := []struct {
+		msg  string
+		idle bool
+	}{
+		{msgRelation, true},
+		{msgBegin, false},
+		{msgInsert, false},
+		{msgCommit, true},
+	}
+	for _, s := range steps {
+		if _, _, err := d.decode([]byte(s.msg)); err != nil {
+			t.Fatalf("decode(%q): %v", s.msg[:1], err)
+		}
+		if d.idle() != s.idle {
+			t.Errorf("idle() after %q = %v, want %v", s.msg[:1], d.idle(), s.idle)
+		}
+	}
+}
+
+func TestPgoutputValue(t *testing.T) {
+	d := newPgoutputDecoder()
+	tests := []struct {
+		oid  uint32
+		text string
+		want interface{}
+	}{
+		{20, "9007199254740992", float64(9007199254740992)},
+		{1700, "1.50", 1.5},
+		{701, "NaN-ish", "NaN-ish"},
+		{16, "t", true},
+		{16, "f", false},
+		{114, `[1, "a"]`, []interface{}{float64(1), "a"}},
+		{3802, `{not json`, `{not json`},
+		{1184, "2024-01-31 13:45:00+00", "2024-01-31 13:45:00+00"},
+	}
+	for _, tt := range tests {
+		if got := d.value(tt.oid, []byte(tt.text)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("value(%d, %q) = %#v, want %#v", tt.oid, tt.text, got, tt.want)
+		}
+	}
+}
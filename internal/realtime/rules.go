@@ -0,0 +1,179 @@
+package realtime
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"baas/internal/db"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// Channel actions rules can restrict
+const (
+	ActionJoin      = "join"
+	ActionBroadcast = "broadcast"
+)
+
+const ruleTimeout = 5 * time.Second
+
+// ChannelRule restricts an action on the channels matching Pattern ("*",
+// "prefix*" or an exact name) to the tenant clients for which CheckFunction,
+// a function in the project schema, returns true:
+//
+//	CREATE FUNCTION room_member(channel text, action text) RETURNS boolean ...
+//
+// The function runs as the client (see db.WithClaims), so it can read
+// current_setting('request.jwt.claim.sub'). Every matching rule must pass;
+// actions without matching rules are allowed. Platform admins bypass rules.
+type ChannelRule struct {
+	ID            string    `json:"id"`
+	Pattern       string    `json:"pattern"`
+	Action        string    `json:"action"`
+	CheckFunction string    `json:"check_function"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func (r *ChannelRule) matches(channel string) bool {
+	if prefix, ok := strings.CutSuffix(r.Pattern, "*"); ok {
+		return strings.HasPrefix(channel, prefix)
+	}
+	return r.Pattern == channel
+}
+
+// authorizeChannel evaluates the rules of a project for a channel and
+// returns the allowed actions
+func authorizeChannel(ctx context.Context, project, channel string, claims jwt.MapClaims) (map[string]bool, error) {
+	allowed := map[string]bool{ActionJoin: true, ActionBroadcast: true}
+	if role, _ := claims["role"].(string); role == "admin" {
+		return allowed, nil
+	}
+
+	if !isValidIdentifier(project) {
+		return nil, fmt.Errorf("invalid project %q", project)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ruleTimeout)
+	defer cancel()
+
+	query := `
+		SELECT r.pattern, r.action, r.check_function
+		FROM baas_system.realtime_channel_rules r
+		JOIN baas_system.projects p ON p.id = r.project_id
+		WHERE p.slug = $1
+	`
+	rows, err := db.Pool.Query(ctx, query, project)
+	if err != nil {
+		return nil, err
+	}
+	var rules []ChannelRule
+	for rows.Next() {
+		var r ChannelRule
+		if err := rows.Scan(&r.Pattern, &r.Action, &r.CheckFunction); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if r.matches(channel) {
+			rules = append(rules, r)
+		}
+	}
+	rows.Close()
+	if len(rules) == 0 {
+		return allowed, nil
+	}
+
+	err = db.WithClaims(ctx, project, claims, func(tx pgx.Tx) error {
+		for _, r := range rules {
+			if !allowed[r.Action] {
+				continue
+			}
+			var ok *bool
+			query := fmt.Sprintf("SELECT %s.%s($1, $2)", project, r.CheckFunction)
+			if err := tx.QueryRow(ctx, query, channel, r.Action).Scan(&ok); err != nil {
+				return fmt.Errorf("channel rule %q failed: %w", r.CheckFunction, err)
+			}
+			allowed[r.Action] = ok != nil && *ok
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return allowed, nil
+}
+
+// ListChannelRulesHandler lists the realtime channel rules of a project
+func ListChannelRulesHandler(c *fiber.Ctx) error {
+	query := `
+		SELECT r.id, r.pattern, r.action, r.check_function, r.created_at
+		FROM baas_system.realtime_channel_rules r
+		JOIN baas_system.projects p ON p.id = r.project_id
+		WHERE p.slug = $1
+		ORDER BY r.created_at
+	`
+	rows, err := db.Pool.Query(context.Background(), query, c.Params("project"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch channel rules"})
+	}
+	defer rows.Close()
+
+	rules := []ChannelRule{}
+	for rows.Next() {
+		var r ChannelRule
+		if err := rows.Scan(&r.ID, &r.Pattern, &r.Action, &r.CheckFunction, &r.CreatedAt); err == nil {
+			rules = append(rules, r)
+		}
+	}
+	return c.JSON(rules)
+}
+
+// CreateChannelRuleHandler adds a realtime channel rule
+// Body: {"pattern": "room:*", "action": "broadcast", "check_function": "room_member"}
+func CreateChannelRuleHandler(c *fiber.Ctx) error {
+	var r ChannelRule
+	if err := c.BodyParser(&r); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if r.Pattern == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "pattern is required"})
+	}
+	if r.Action != ActionJoin && r.Action != ActionBroadcast {
+		return c.Status(400).JSON(fiber.Map{"error": "action must be 'join' or 'broadcast'"})
+	}
+	if !isValidIdentifier(r.CheckFunction) {
+		return c.Status(400).JSON(fiber.Map{"error": "check_function must be a function name in the project schema"})
+	}
+
+	query := `
+		INSERT INTO baas_system.realtime_channel_rules (project_id, pattern, action, check_function)
+		SELECT id, $2, $3, $4 FROM baas_system.projects WHERE slug = $1
+		RETURNING id, created_at
+	`
+	err := db.Pool.QueryRow(context.Background(), query, c.Params("project"), r.Pattern, r.Action, r.CheckFunction).Scan(&r.ID, &r.CreatedAt)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not create channel rule"})
+	}
+	return c.JSON(r)
+}
+
+// DeleteChannelRuleHandler removes a realtime channel rule. Connected
+// clients keep the permissions granted when they joined.
+func DeleteChannelRuleHandler(c *fiber.Ctx) error {
+	query := `
+		DELETE FROM baas_system.realtime_channel_rules r
+		USING baas_system.projects p
+		WHERE p.id = r.project_id AND p.slug = $1 AND r.id::text = $2
+	`
+	tag, err := db.Pool.Exec(context.Background(), query, c.Params("project"), c.Params("id"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete channel rule"})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Channel rule not found"})
+	}
+	return c.JSON(fiber.Map{"message": "Channel rule deleted"})
+}
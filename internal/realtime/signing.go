@@ -0,0 +1,74 @@
+package realtime
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"baas/internal/db"
+)
+
+// Every role that can connect to the database can NOTIFY, project roles
+// included, so the db_events and cluster payloads are signed:
+//
+//	<hex HMAC-SHA256 of the JSON>:<JSON>
+//
+// keyed with baas_system.realtime_signing_key (see system_schema.sql), which
+// only the server's role can read. Unsigned payloads are dropped.
+
+var signing struct {
+	mu  sync.Mutex
+	key []byte
+}
+
+// signingKey loads the key on first use; failures are retried on the next call
+func signingKey() ([]byte, error) {
+	signing.mu.Lock()
+	defer signing.mu.Unlock()
+	if signing.key != nil {
+		return signing.key, nil
+	}
+	var key []byte
+	err := db.Pool.QueryRow(context.Background(),
+		"SELECT key FROM baas_system.realtime_signing_key").Scan(&key)
+	if err != nil {
+		return nil, err
+	}
+	signing.key = key
+	return key, nil
+}
+
+func notificationMAC(key []byte, body string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(body))
+	return mac.Sum(nil)
+}
+
+// signNotification returns the NOTIFY payload for a JSON message
+func signNotification(body []byte) (string, error) {
+	key, err := signingKey()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(notificationMAC(key, string(body))) + ":" + string(body), nil
+}
+
+// verifyNotification returns the JSON of a signed NOTIFY payload
+func verifyNotification(payload string) ([]byte, bool) {
+	key, err := signingKey()
+	if err != nil {
+		return nil, false
+	}
+	sig, body, ok := strings.Cut(payload, ":")
+	if !ok {
+		return nil, false
+	}
+	mac, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, notificationMAC(key, body)) {
+		return nil, false
+	}
+	return []byte(body), true
+}
@@ -0,0 +1,203 @@
+package realtime
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// SSEHandler streams realtime events as Server-Sent Events, for clients that
+// cannot use WebSockets. It delivers the same messages as RealtimeEndpoint,
+// each as an event named after its "type", with the outbox cursor as event id:
+//
+//	GET /:project/realtime/sse?token=...&channels=[{"channel": "todos", "postgres_changes": [{"table": "todos"}]}]
+//
+//	id: 1234
+//	event: postgres_changes
+//	data: {"type": "postgres_changes", "channel": "todos", "payload": {...}, "cursor": 1234}
+//
+// The token is read from ?token= (or ?apikey=) or the Authorization header.
+// channels takes the join messages of the WebSocket protocol. With the
+// outbox enabled, a reconnecting EventSource sends Last-Event-ID (or pass
+// ?last_event_id=) and the missed change events are replayed first.
+// The stream ends with a "close" event when the token expires or the
+// session is revoked.
+func SSEHandler(c *fiber.Ctx) error {
+	slug := c.Params("project")
+	project := projectSchema(slug)
+
+	token := c.Query("token")
+	if token == "" {
+		token = c.Query("apikey")
+	}
+	if token == "" {
+		token = strings.TrimPrefix(c.Get("Authorization"), "Bearer ")
+	}
+	claims, err := checkToken(token, slug)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var joins []joinMessage
+	if raw := c.Query("channels"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &joins); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "channels must be a JSON array of join messages"})
+		}
+	}
+
+	var since int64
+	if id := c.Get("Last-Event-ID", c.Query("last_event_id")); id != "" {
+		if since, err = strconv.ParseInt(id, 10, 64); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid Last-Event-ID"})
+		}
+	}
+
+	if MainHub.connections(project) >= maxConnectionsPerProject {
+		return c.Status(503).JSON(fiber.Map{"error": "Too many connections for this project"})
+	}
+
+	stream := newSSETransport()
+	client := &Client{
+		Hub:       MainHub,
+		Slug:      slug,
+		ProjectID: project,
+		Ref:       newRef(),
+		Send:      make(chan []byte, sendQueueSize),
+		limiter:   newRateLimiter(clientMessageRate),
+		transport: stream,
+	}
+	client.setClaims(claims)
+
+	for _, join := range joins {
+		if join.Channel == "" {
+			return c.Status(400).JSON(fiber.Map{"error": "join requires a channel"})
+		}
+		if err := client.joinChannel(join); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error(), "channel": join.Channel})
+		}
+	}
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	c.Set("X-Accel-Buffering", "no") // Disable proxy buffering (nginx)
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		client.Hub.register <- client
+		defer func() {
+			stream.shutdown()
+			client.Hub.unregister <- client
+		}()
+
+		done := make(chan struct{})
+		defer close(done)
+		go client.watchAuth(done)
+
+		writeSSE(w, mustJSON(fiber.Map{"type": "auth_ok", "expires_at": claims["exp"]}))
+		for _, join := range joins {
+			writeSSE(w, mustJSON(fiber.Map{"type": "joined", "channel": join.Channel}))
+			client.Hub.presence <- presenceUpdate{client: client, channel: join.Channel, sync: true}
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+		if since > 0 {
+			go client.replay(since)
+		}
+
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for {
+			var err error
+			select {
+			case msg, ok := <-client.Send:
+				if !ok {
+					return
+				}
+				err = writeSSE(w, msg)
+			case msg := <-stream.out:
+				err = writeSSE(w, msg)
+			case <-stream.closed:
+				// Deliver what was written before closing (the close event)
+				for {
+					select {
+					case msg := <-stream.out:
+						writeSSE(w, msg)
+					default:
+						w.Flush()
+						return
+					}
+				}
+			case <-ticker.C:
+				_, err = w.WriteString(": ping\n\n")
+			}
+			if err == nil {
+				err = w.Flush()
+			}
+			if err != nil {
+				return // Client went away
+			}
+		}
+	})
+	return nil
+}
+
+// writeSSE writes a protocol message as an event
+func writeSSE(w *bufio.Writer, msg []byte) error {
+	var head struct {
+		Type   string `json:"type"`
+		Cursor int64  `json:"cursor"`
+	}
+	json.Unmarshal(msg, &head)
+
+	if head.Cursor > 0 {
+		fmt.Fprintf(w, "id: %d\n", head.Cursor)
+	}
+	if head.Type != "" {
+		fmt.Fprintf(w, "event: %s\n", head.Type)
+	}
+	_, err := fmt.Fprintf(w, "data: %s\n\n", msg)
+	return err
+}
+
+func mustJSON(v interface{}) []byte {
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// sseTransport hands direct writes to the stream goroutine, which owns the
+// response writer
+type sseTransport struct {
+	out    chan []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newSSETransport() *sseTransport {
+	return &sseTransport{out: make(chan []byte, 16), closed: make(chan struct{})}
+}
+
+func (t *sseTransport) write(msg []byte) error {
+	select {
+	case t.out <- msg:
+		return nil
+	case <-t.closed:
+		return fmt.Errorf("stream closed")
+	}
+}
+
+// close ends the stream with a "close" event
+func (t *sseTransport) close(code int, reason string) {
+	t.write(mustJSON(fiber.Map{"type": "close", "code": code, "reason": reason}))
+	t.shutdown()
+}
+
+func (t *sseTransport) shutdown() {
+	t.once.Do(func() { close(t.closed) })
+}
@@ -0,0 +1,163 @@
+package realtime
+
+import (
+	"context"
+	"fmt"
+
+	"baas/internal/admin"
+	"baas/internal/db"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// realtimeTrigger is the name of the trigger attaching
+// <schema>.hanbase_notify_change() to a table
+const realtimeTrigger = "hanbase_realtime"
+
+// ListRealtimeTablesHandler lists the project's tables and whether change
+// notifications are enabled for them
+func ListRealtimeTablesHandler(c *fiber.Ctx) error {
+	project := projectSchema(c.Params("project"))
+
+	query := `
+		SELECT t.table_name,
+		       EXISTS (
+		           SELECT 1 FROM pg_trigger tg
+		           WHERE tg.tgrelid = format('%I.%I', t.table_schema, t.table_name)::regclass
+		             AND tg.tgname = $2
+		       )
+		FROM information_schema.tables t
+		WHERE t.table_schema = $1 AND t.table_type = 'BASE TABLE'
+		ORDER BY t.table_name
+	`
+	rows, err := db.Pool.Query(c.Context(), query, project, realtimeTrigger)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	type Table struct {
+		Name    string `json:"table"`
+		Enabled bool   `json:"enabled"`
+	}
+
+	tables := []Table{}
+	for rows.Next() {
+		var t Table
+		if err := rows.Scan(&t.Name, &t.Enabled); err == nil && !admin.IsInternalTable(t.Name) {
+			tables = append(tables, t)
+		}
+	}
+	return c.JSON(tables)
+}
+
+// SetRealtimeTableHandler enables or disables change notifications for a
+// table by installing or dropping the realtime trigger.
+// Body: {"enabled": true}
+func SetRealtimeTableHandler(c *fiber.Ctx) error {
+	project := projectSchema(c.Params("project"))
+	table := c.Params("table")
+
+	if !isValidIdentifier(project) || !isValidIdentifier(table) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project or table name"})
+	}
+	if admin.IsInternalTable(table) {
+		return c.Status(400).JSON(fiber.Map{"error": "Realtime cannot be enabled for internal tables"})
+	}
+
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if err := setRealtime(context.Background(), project, table, req.Enabled); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"table": table, "enabled": req.Enabled})
+}
+
+// setRealtime installs or drops the NOTIFY trigger and adds or removes the
+// table from the replication publication, so either change source (see
+// REALTIME_SOURCE) picks it up
+func setRealtime(ctx context.Context, project, table string, enabled bool) error {
+	stmt := fmt.Sprintf("DROP TRIGGER IF EXISTS %s ON %s.%s", realtimeTrigger, project, table)
+	if enabled {
+		stmt = fmt.Sprintf(`
+			CREATE OR REPLACE TRIGGER %s
+			AFTER INSERT OR UPDATE OR DELETE ON %s.%s
+			FOR EACH ROW EXECUTE FUNCTION %s.hanbase_notify_change()`,
+			realtimeTrigger, project, table, project)
+	}
+	if _, err := db.Pool.Exec(ctx, stmt); err != nil {
+		return err
+	}
+	return setPublished(ctx, project, table, enabled)
+}
+
+// setPublished adds or removes a table from RealtimePublication. Published
+// tables use REPLICA IDENTITY FULL so updates and deletes carry the old row.
+func setPublished(ctx context.Context, project, table string, enabled bool) error {
+	var published bool
+	err := db.Pool.QueryRow(ctx, `
+		SELECT EXISTS(SELECT 1 FROM pg_publication_tables
+		              WHERE pubname = $1 AND schemaname = $2 AND tablename = $3)`,
+		RealtimePublication, project, table).Scan(&published)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case enabled && !published:
+		if _, err := db.Pool.Exec(ctx, fmt.Sprintf("ALTER TABLE %s.%s REPLICA IDENTITY FULL", project, table)); err != nil {
+			return err
+		}
+		_, err = db.Pool.Exec(ctx, fmt.Sprintf("ALTER PUBLICATION %s ADD TABLE %s.%s", RealtimePublication, project, table))
+	case !enabled && published:
+		_, err = db.Pool.Exec(ctx, fmt.Sprintf("ALTER PUBLICATION %s DROP TABLE %s.%s", RealtimePublication, project, table))
+	}
+	return err
+}
+
+// syncPublication publishes the tables realtime was enabled for before the
+// replication source was in use
+func syncPublication(ctx context.Context) error {
+	rows, err := db.Pool.Query(ctx, `
+		SELECT n.nspname, c.relname
+		FROM pg_trigger tg
+		JOIN pg_class c ON c.oid = tg.tgrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE tg.tgname = $1`, realtimeTrigger)
+	if err != nil {
+		return err
+	}
+	type table struct{ schema, name string }
+	var tables []table
+	for rows.Next() {
+		var t table
+		if err := rows.Scan(&t.schema, &t.name); err == nil {
+			tables = append(tables, t)
+		}
+	}
+	rows.Close()
+
+	for _, t := range tables {
+		if err := setPublished(ctx, t.schema, t.name, true); err != nil {
+			return fmt.Errorf("publish %s.%s: %w", t.schema, t.name, err)
+		}
+	}
+	return nil
+}
+
+func isValidIdentifier(s string) bool {
+	if len(s) == 0 || len(s) > 63 {
+		return false
+	}
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '_' {
+			return false
+		}
+	}
+	return true
+}
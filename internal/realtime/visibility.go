@@ -0,0 +1,229 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"baas/internal/db"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// Row level security for realtime: a tenant client only receives a change if
+// it could SELECT the row through the REST API. Rows are re-queried by
+// primary key under the client's claims (see db.WithClaims), once per
+// distinct claim set.
+//
+// Deleted rows cannot be re-queried, so deletes are delivered to clients
+// with SELECT privilege on the table but only carry the primary key. For
+// the same reason the "old" record of updates is reduced to the primary key.
+// Subscription filters are evaluated on the full row first, except for
+// deletes from tables with row level security: the client may not have been
+// allowed to see the other columns, so only primary key filters are accepted
+// for them (see checkDeleteFilter). Platform admin connections bypass RLS like they do over
+// REST.
+
+const visibilityTimeout = 5 * time.Second
+
+// tableInfo is what the visibility check needs to know about a table
+type tableInfo struct {
+	rowSecurity bool
+	primaryKey  []string
+}
+
+func loadTableInfo(ctx context.Context, schema, table string) (*tableInfo, error) {
+	info := &tableInfo{}
+	err := db.Pool.QueryRow(ctx, `
+		SELECT c.relrowsecurity,
+		       ARRAY(
+		           SELECT a.attname::text FROM pg_index i
+		           JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+		           WHERE i.indrelid = c.oid AND i.indisprimary
+		           ORDER BY a.attnum
+		       )
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1 AND c.relname = $2`, schema, table).Scan(&info.rowSecurity, &info.primaryKey)
+	return info, err
+}
+
+// checkDeleteFilter rejects a subscription to deletes from a table with row
+// level security whose filter could never match them (see above)
+func (s *changeSubscription) checkDeleteFilter(ctx context.Context) error {
+	if s.filter == nil || s.Table == "" || s.Table == "*" {
+		return nil
+	}
+	deletes := len(s.Events) == 0
+	for _, e := range s.Events {
+		deletes = deletes || e == "*" || e == "DELETE"
+	}
+	if !deletes {
+		return nil
+	}
+	info, err := loadTableInfo(ctx, s.Schema, s.Table)
+	if err != nil || !info.rowSecurity {
+		return nil // Unknown tables simply never match
+	}
+	for _, col := range info.primaryKey {
+		if col == s.filter.column {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s has row level security: filters on DELETE events must use the primary key (subscribe to them separately)", s.Table)
+}
+
+// resolveDeliveries returns the messages each client receives for a change
+// event, after subscription matching and visibility checks
+func resolveDeliveries(ctx context.Context, m Message, clients []*Client) map[*Client][][]byte {
+	ctx, cancel := context.WithTimeout(ctx, visibilityTimeout)
+	defer cancel()
+
+	out := make(map[*Client][][]byte)
+	var tenants []*Client
+	for _, client := range clients {
+		if role, _ := client.getClaims()["role"].(string); role == "admin" {
+			if msgs := client.matchChanges(m.Event, m.Payload, m.Cursor); len(msgs) > 0 {
+				out[client] = msgs
+			}
+			continue
+		}
+		tenants = append(tenants, client)
+	}
+	if len(tenants) == 0 {
+		return out
+	}
+
+	info, err := loadTableInfo(ctx, m.Event.Schema, m.Event.Table)
+	if err != nil {
+		log.Printf("Realtime: could not load %s.%s for visibility checks: %v\n", m.Event.Schema, m.Event.Table, err)
+		return out
+	}
+	event := redactForTenants(m.Event, info)
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return out
+	}
+
+	// Filters see the whole row unless RLS could have hidden it
+	match := m.Event
+	if info.rowSecurity {
+		match = event
+	}
+
+	// Group the matching clients by claim set
+	groups := make(map[string][]*Client)
+	pending := make(map[*Client][][]byte)
+	for _, client := range tenants {
+		msgs := client.matchChanges(match, payload, m.Cursor)
+		if len(msgs) == 0 {
+			continue
+		}
+		key := claimsKey(client.getClaims())
+		groups[key] = append(groups[key], client)
+		pending[client] = msgs
+	}
+
+	for _, group := range groups {
+		if !rowVisible(ctx, group[0].getClaims(), event, info) {
+			continue
+		}
+		for _, client := range group {
+			out[client] = pending[client]
+		}
+	}
+	return out
+}
+
+// redactForTenants reduces the records RLS cannot be checked for to their
+// primary key
+func redactForTenants(e *ChangeEvent, info *tableInfo) *ChangeEvent {
+	redacted := *e
+	if e.Old != nil {
+		redacted.Old = pickColumns(e.Old, info.primaryKey)
+	}
+	if e.Type == "DELETE" && e.Data != nil {
+		redacted.Data = pickColumns(e.Data, info.primaryKey)
+	}
+	return &redacted
+}
+
+func pickColumns(row map[string]interface{}, columns []string) map[string]interface{} {
+	picked := make(map[string]interface{}, len(columns))
+	for _, col := range columns {
+		if v, ok := row[col]; ok {
+			picked[col] = v
+		}
+	}
+	return picked
+}
+
+// claimsKey identifies the claims RLS policies can depend on. Timing claims
+// differ between tokens of the same session and are left out.
+func claimsKey(claims jwt.MapClaims) string {
+	rest := make(map[string]interface{}, len(claims))
+	for k, v := range claims {
+		switch k {
+		case "exp", "iat", "nbf", "jti":
+		default:
+			rest[k] = v
+		}
+	}
+	b, _ := json.Marshal(rest) // Map keys are sorted
+	return string(b)
+}
+
+// rowVisible reports whether a client with the given claims can see the
+// changed row. Errors (e.g. permission denied) count as not visible.
+func rowVisible(ctx context.Context, claims jwt.MapClaims, e *ChangeEvent, info *tableInfo) bool {
+	table := pgx.Identifier{e.Schema, e.Table}.Sanitize()
+
+	var where []string
+	var args []interface{}
+	if e.Type != "DELETE" && e.Data != nil && len(info.primaryKey) > 0 {
+		for _, col := range info.primaryKey {
+			v, ok := e.Data[col]
+			if !ok || v == nil {
+				where = nil
+				break
+			}
+			args = append(args, textValue(v))
+			where = append(where, pgx.Identifier{col}.Sanitize()+"::text = $"+strconv.Itoa(len(args)))
+		}
+	}
+
+	visible := false
+	err := db.WithClaims(ctx, e.Schema, claims, func(tx pgx.Tx) error {
+		if where != nil {
+			query := "SELECT EXISTS(SELECT 1 FROM " + table + " WHERE " + strings.Join(where, " AND ") + ")"
+			return tx.QueryRow(ctx, query, args...).Scan(&visible)
+		}
+
+		// The row cannot be looked up: require SELECT on the table, and for
+		// inserts/updates that no policy could have hidden it
+		if e.Type != "DELETE" && info.rowSecurity {
+			return nil
+		}
+		return tx.QueryRow(ctx, "SELECT has_table_privilege($1, 'SELECT')", table).Scan(&visible)
+	})
+	return err == nil && visible
+}
+
+// textValue renders a decoded JSON value the way Postgres casts it to text
+func textValue(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
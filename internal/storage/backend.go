@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by backends for missing objects
+var ErrNotFound = errors.New("object not found")
+
+// Backend stores object contents. Keys are slash separated paths
+// ("<project>/<bucket>/<object name>") validated by the handlers.
+type Backend interface {
+	// Put stores the contents of r under key, replacing any existing object
+	Put(ctx context.Context, key string, r io.Reader) (ObjectStat, error)
+	// Get opens an object for reading
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectStat, error)
+	Stat(ctx context.Context, key string) (ObjectStat, error)
+	Delete(ctx context.Context, key string) error
+	Copy(ctx context.Context, src, dst string) error
+	Move(ctx context.Context, src, dst string) error
+}
+
+// ObjectStat describes stored contents
+type ObjectStat struct {
+	Size    int64
+	ETag    string // Hex MD5 of the contents, only set by Put
+	ModTime time.Time
+}
+
+// LocalBackend stores objects as files below a root directory
+type LocalBackend struct {
+	Root string
+}
+
+func NewLocalBackend(root string) *LocalBackend {
+	return &LocalBackend{Root: root}
+}
+
+func (b *LocalBackend) path(key string) string {
+	return filepath.Join(b.Root, filepath.FromSlash(key))
+}
+
+// Put writes to a temporary file first so readers never see partial contents
+func (b *LocalBackend) Put(ctx context.Context, key string, r io.Reader) (ObjectStat, error) {
+	path := b.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return ObjectStat{}, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return ObjectStat{}, err
+	}
+	defer os.Remove(tmp.Name()) // No-op after the rename
+
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return ObjectStat{}, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return ObjectStat{}, err
+	}
+	return ObjectStat{Size: size, ETag: hex.EncodeToString(hash.Sum(nil)), ModTime: time.Now()}, nil
+}
+
+func (b *LocalBackend) Get(ctx context.Context, key string) (io.ReadCloser, ObjectStat, error) {
+	f, err := os.Open(b.path(key))
+	if err != nil {
+		return nil, ObjectStat{}, notFound(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, ObjectStat{}, err
+	}
+	return f, ObjectStat{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (b *LocalBackend) Stat(ctx context.Context, key string) (ObjectStat, error) {
+	info, err := os.Stat(b.path(key))
+	if err != nil {
+		return ObjectStat{}, notFound(err)
+	}
+	return ObjectStat{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (b *LocalBackend) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(b.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	b.pruneDirs(key)
+	return nil
+}
+
+func (b *LocalBackend) Copy(ctx context.Context, src, dst string) error {
+	f, err := os.Open(b.path(src))
+	if err != nil {
+		return notFound(err)
+	}
+	defer f.Close()
+	_, err = b.Put(ctx, dst, f)
+	return err
+}
+
+func (b *LocalBackend) Move(ctx context.Context, src, dst string) error {
+	path := b.path(dst)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(b.path(src), path); err != nil {
+		return notFound(err)
+	}
+	b.pruneDirs(src)
+	return nil
+}
+
+// pruneDirs removes the directories left empty by deleting key, up to the
+// bucket directory
+func (b *LocalBackend) pruneDirs(key string) {
+	parts := strings.Split(key, "/")
+	for i := len(parts) - 1; i > 2; i-- {
+		if os.Remove(b.path(strings.Join(parts[:i], "/"))) != nil {
+			return // Not empty
+		}
+	}
+}
+
+func notFound(err error) error {
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// PartialBackend keeps the contents of resumable uploads until they are
+// complete. Ids are the upload ids.
+type PartialBackend interface {
+	CreatePart(ctx context.Context, id string) error
+	// AppendPart writes r at the end of the part, which must be offset
+	// bytes long, and returns the new size
+	AppendPart(ctx context.Context, id string, offset int64, r io.Reader) (int64, error)
+	PartSize(ctx context.Context, id string) (int64, error)
+	// CompletePart turns the part into the object stored under key
+	CompletePart(ctx context.Context, id, key string) (ObjectStat, error)
+	DeletePart(ctx context.Context, id string) error
+}
+
+// errOffsetMismatch is returned by AppendPart for a wrong offset
+var errOffsetMismatch = errors.New("upload offset mismatch")
+
+// partPath keeps partial uploads outside of the project directories
+func (b *LocalBackend) partPath(id string) string {
+	return filepath.Join(b.Root, ".uploads", id)
+}
+
+func (b *LocalBackend) CreatePart(ctx context.Context, id string) error {
+	path := b.partPath(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (b *LocalBackend) AppendPart(ctx context.Context, id string, offset int64, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(b.partPath(id), os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, notFound(err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() != offset {
+		return info.Size(), errOffsetMismatch
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+	// Keep what was received if the client goes away midway, so the
+	// upload can resume from there
+	n, err := io.Copy(f, r)
+	return offset + n, err
+}
+
+func (b *LocalBackend) PartSize(ctx context.Context, id string) (int64, error) {
+	info, err := os.Stat(b.partPath(id))
+	if err != nil {
+		return 0, notFound(err)
+	}
+	return info.Size(), nil
+}
+
+func (b *LocalBackend) CompletePart(ctx context.Context, id, key string) (ObjectStat, error) {
+	part := b.partPath(id)
+	f, err := os.Open(part)
+	if err != nil {
+		return ObjectStat{}, notFound(err)
+	}
+	hash := md5.New()
+	size, err := io.Copy(hash, f)
+	f.Close()
+	if err != nil {
+		return ObjectStat{}, err
+	}
+
+	path := b.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return ObjectStat{}, err
+	}
+	if err := os.Rename(part, path); err != nil {
+		return ObjectStat{}, err
+	}
+	return ObjectStat{Size: size, ETag: hex.EncodeToString(hash.Sum(nil)), ModTime: time.Now()}, nil
+}
+
+func (b *LocalBackend) DeletePart(ctx context.Context, id string) error {
+	if err := os.Remove(b.partPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"baas/internal/db"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// Bucket groups objects. Objects of public buckets can be downloaded
+// without a token through /object/public/...
+type Bucket struct {
+	ID               string    `json:"id"`
+	Public           bool      `json:"public"`
+	FileSizeLimit    *int64    `json:"file_size_limit"`
+	AllowedMimeTypes []string  `json:"allowed_mime_types"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+const bucketColumns = "id, public, file_size_limit, allowed_mime_types, created_at, updated_at"
+
+func scanBucket(row pgx.Row) (*Bucket, error) {
+	var b Bucket
+	err := row.Scan(&b.ID, &b.Public, &b.FileSizeLimit, &b.AllowedMimeTypes, &b.CreatedAt, &b.UpdatedAt)
+	return &b, err
+}
+
+// getBucket loads a bucket, nil if it does not exist
+func getBucket(ctx context.Context, project, id string) (*Bucket, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s.storage_buckets WHERE id = $1", bucketColumns, project)
+	b, err := scanBucket(db.Pool.QueryRow(ctx, query, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return b, err
+}
+
+// allowsMimeType checks a content type against the bucket's allowed types,
+// which may end with a wildcard ("image/*")
+func (b *Bucket) allowsMimeType(mimeType string) bool {
+	if len(b.AllowedMimeTypes) == 0 {
+		return true
+	}
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	mimeType = strings.TrimSpace(strings.ToLower(mimeType))
+	for _, allowed := range b.AllowedMimeTypes {
+		allowed = strings.ToLower(allowed)
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok && strings.HasPrefix(mimeType, prefix) {
+			return true
+		}
+		if allowed == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+// sizeLimit is the largest object the bucket accepts
+func (b *Bucket) sizeLimit() int64 {
+	if b.FileSizeLimit != nil && *b.FileSizeLimit < int64(MaxUploadBytes) {
+		return *b.FileSizeLimit
+	}
+	return int64(MaxUploadBytes)
+}
+
+// ListBucketsHandler lists the buckets of a project
+func ListBucketsHandler(c *fiber.Ctx) error {
+	project := c.Params("project")
+	if !isValidIdentifier(project) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s.storage_buckets ORDER BY id", bucketColumns, project)
+	rows, err := db.Pool.Query(context.Background(), query)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch buckets"})
+	}
+	defer rows.Close()
+
+	buckets := []*Bucket{}
+	for rows.Next() {
+		if b, err := scanBucket(rows); err == nil {
+			buckets = append(buckets, b)
+		}
+	}
+	return c.JSON(buckets)
+}
+
+// GetBucketHandler returns a bucket
+func GetBucketHandler(c *fiber.Ctx) error {
+	project := c.Params("project")
+	if !isValidIdentifier(project) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+	b, err := getBucket(context.Background(), project, c.Params("bucket"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch bucket"})
+	}
+	if b == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Bucket not found"})
+	}
+	return c.JSON(b)
+}
+
+type bucketRequest struct {
+	ID               string   `json:"id"`
+	Public           *bool    `json:"public"`
+	FileSizeLimit    *int64   `json:"file_size_limit"`
+	AllowedMimeTypes []string `json:"allowed_mime_types"`
+}
+
+// CreateBucketHandler creates a bucket (Platform admin)
+// Body: {"id": "avatars", "public": true, "file_size_limit": 1048576, "allowed_mime_types": ["image/*"]}
+func CreateBucketHandler(c *fiber.Ctx) error {
+	project := c.Params("project")
+	if !isValidIdentifier(project) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+
+	var req bucketRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if !isValidBucketName(req.ID) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid bucket name: use lowercase letters, digits, '-', '_' and '.'"})
+	}
+	public := req.Public != nil && *req.Public
+
+	query := fmt.Sprintf(`
+		INSERT INTO %s.storage_buckets (id, public, file_size_limit, allowed_mime_types)
+		VALUES ($1, $2, $3, $4)
+		RETURNING %s`, project, bucketColumns)
+	b, err := scanBucket(db.Pool.QueryRow(context.Background(), query, req.ID, public, req.FileSizeLimit, req.AllowedMimeTypes))
+	if err != nil {
+		return c.Status(409).JSON(fiber.Map{"error": "Could not create bucket (name might be taken)"})
+	}
+	return c.Status(201).JSON(b)
+}
+
+// UpdateBucketHandler changes a bucket's settings (Platform admin).
+// Omitted fields are left unchanged.
+func UpdateBucketHandler(c *fiber.Ctx) error {
+	project := c.Params("project")
+	if !isValidIdentifier(project) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+
+	var req bucketRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	query := fmt.Sprintf(`
+		UPDATE %s.storage_buckets SET
+			public = COALESCE($2, public),
+			file_size_limit = COALESCE($3, file_size_limit),
+			allowed_mime_types = COALESCE($4, allowed_mime_types),
+			updated_at = NOW()
+		WHERE id = $1
+		RETURNING %s`, project, bucketColumns)
+	b, err := scanBucket(db.Pool.QueryRow(context.Background(), query, c.Params("bucket"), req.Public, req.FileSizeLimit, req.AllowedMimeTypes))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(404).JSON(fiber.Map{"error": "Bucket not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not update bucket"})
+	}
+	return c.JSON(b)
+}
+
+// DeleteBucketHandler deletes an empty bucket (Platform admin)
+func DeleteBucketHandler(c *fiber.Ctx) error {
+	project := c.Params("project")
+	if !isValidIdentifier(project) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s.storage_buckets WHERE id = $1", project)
+	tag, err := db.Pool.Exec(context.Background(), query, c.Params("bucket"))
+	if err != nil {
+		// Foreign key violation: objects remain
+		return c.Status(409).JSON(fiber.Map{"error": "Bucket is not empty"})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Bucket not found"})
+	}
+	return c.JSON(fiber.Map{"message": "Bucket deleted"})
+}
+
+// EmptyBucketHandler deletes every object of a bucket (Platform admin)
+func EmptyBucketHandler(c *fiber.Ctx) error {
+	project := c.Params("project")
+	bucket := c.Params("bucket")
+	if !isValidIdentifier(project) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+
+	ctx := context.Background()
+	query := fmt.Sprintf("DELETE FROM %s.storage_objects WHERE bucket_id = $1 RETURNING name", project)
+	rows, err := db.Pool.Query(ctx, query, bucket)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not empty bucket"})
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not empty bucket"})
+	}
+
+	for _, name := range names {
+		deleteContents(ctx, project, bucket, name)
+	}
+	return c.JSON(fiber.Map{"message": "Bucket emptied", "deleted": len(names)})
+}
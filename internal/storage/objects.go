@@ -0,0 +1,613 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"strings"
+	"time"
+
+	"baas/internal/db"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// Object is the metadata of a stored file
+type Object struct {
+	ID        string          `json:"id"`
+	BucketID  string          `json:"bucket_id"`
+	Name      string          `json:"name"`
+	Owner     *string         `json:"owner"`
+	Size      int64           `json:"size"`
+	MimeType  string          `json:"mime_type"`
+	ETag      string          `json:"etag"`
+	Metadata  json.RawMessage `json:"metadata"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+const objectColumns = "id, bucket_id, name, owner::text, size, mime_type, etag, metadata, created_at, updated_at"
+
+func scanObject(row pgx.Row) (*Object, error) {
+	var o Object
+	err := row.Scan(&o.ID, &o.BucketID, &o.Name, &o.Owner, &o.Size, &o.MimeType, &o.ETag, &o.Metadata, &o.CreatedAt, &o.UpdatedAt)
+	return &o, err
+}
+
+// getObject loads an object's metadata, nil if it does not exist
+func getObject(ctx context.Context, project, bucket, name string) (*Object, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s.storage_objects WHERE bucket_id = $1 AND name = $2", objectColumns, project)
+	o, err := scanObject(db.Pool.QueryRow(ctx, query, bucket, name))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return o, err
+}
+
+// errObjectExists is returned by saveObject when not upserting
+var errObjectExists = errors.New("object already exists")
+
+// stagingKey returns a new backend key to store uploaded contents under
+// until their metadata is saved (see commitObject)
+func stagingKey(project string) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return ".staging/" + project + "/" + hex.EncodeToString(b)
+}
+
+// commitObject saves the metadata of the contents stored under staged (see
+// stagingKey) and moves them into place, in one transaction: the object's
+// row stays locked from the insert until the move is done, so a conflicting
+// upload never replaces the existing contents, and the last of concurrent
+// uploads wins for both metadata and contents. The staged contents are
+// deleted if saving fails.
+func commitObject(ctx context.Context, project string, o *Object, upsert bool, staged string) (*Object, error) {
+	var saved *Object
+	err := pgx.BeginFunc(ctx, db.Pool, func(tx pgx.Tx) error {
+		var err error
+		saved, err = saveObject(ctx, tx, project, o, upsert)
+		if err != nil {
+			return err
+		}
+		return Store.Move(ctx, staged, objectKey(project, o.BucketID, o.Name))
+	})
+	if err != nil {
+		Store.Delete(ctx, staged)
+		return nil, err
+	}
+	removeVariants(project, o.BucketID, o.Name) // Of the replaced contents
+	return saved, nil
+}
+
+// rowQuerier is implemented by db.Pool and pgx.Tx
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// saveObject records the metadata of stored contents
+func saveObject(ctx context.Context, q rowQuerier, project string, o *Object, upsert bool) (*Object, error) {
+	conflict := "DO NOTHING"
+	if upsert {
+		conflict = `DO UPDATE SET owner = EXCLUDED.owner, size = EXCLUDED.size, mime_type = EXCLUDED.mime_type,
+			etag = EXCLUDED.etag, metadata = EXCLUDED.metadata, updated_at = NOW()`
+	}
+	query := fmt.Sprintf(`
+		INSERT INTO %s.storage_objects (bucket_id, name, owner, size, mime_type, etag, metadata)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (bucket_id, name) %s
+		RETURNING %s`, project, conflict, objectColumns)
+	saved, err := scanObject(q.QueryRow(ctx, query, o.BucketID, o.Name, o.Owner, o.Size, o.MimeType, o.ETag, o.Metadata))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errObjectExists
+	}
+	return saved, err
+}
+
+// uploadBody returns the uploaded contents: the "file" field of a multipart
+// form, or else the raw request body. Metadata is read from the "metadata"
+// form field or the X-Metadata header (a JSON object).
+func uploadBody(c *fiber.Ctx) (r io.Reader, size int64, mimeType string, metadata json.RawMessage, err error) {
+	metadata = json.RawMessage(c.Get("X-Metadata"))
+
+	if strings.HasPrefix(c.Get("Content-Type"), "multipart/form-data") {
+		fh, ferr := c.FormFile("file")
+		if ferr != nil {
+			return nil, 0, "", nil, errors.New("multipart uploads need a 'file' field")
+		}
+		f, ferr := fh.Open()
+		if ferr != nil {
+			return nil, 0, "", nil, ferr
+		}
+		r, size, mimeType = f, fh.Size, fh.Header.Get("Content-Type")
+		if m := c.FormValue("metadata"); m != "" {
+			metadata = json.RawMessage(m)
+		}
+	} else {
+		body := c.Body()
+		r, size, mimeType = bytes.NewReader(body), int64(len(body)), c.Get("Content-Type")
+	}
+
+	if len(metadata) == 0 {
+		metadata = json.RawMessage("{}")
+	}
+	var m map[string]interface{}
+	if json.Unmarshal(metadata, &m) != nil {
+		return nil, 0, "", nil, errors.New("metadata must be a JSON object")
+	}
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	return r, size, mimeType, metadata, nil
+}
+
+// UploadObjectHandler stores an object.
+// POST creates the object (409 if it exists, unless "x-upsert: true"),
+// PUT creates or replaces it. Project users need insert access, or update
+// access to the object being replaced (see Policy).
+func UploadObjectHandler(c *fiber.Ctx) error {
+	name, ok := objectName(c)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid object name"})
+	}
+	upsert := c.Method() == fiber.MethodPut || c.Get("x-upsert") == "true"
+	return storeUpload(c, name, ownerOf(c), upsert, claimsOf(c))
+}
+
+// storeUpload stores the uploaded object for owner. Policies are checked
+// with claims (the signer's for signed uploads).
+func storeUpload(c *fiber.Ctx, name string, owner *string, upsert bool, claims jwt.MapClaims) error {
+	project := c.Params("project")
+	if !isValidIdentifier(project) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+
+	ctx := context.Background()
+	bucket, err := getBucket(ctx, project, c.Params("bucket"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch bucket"})
+	}
+	if bucket == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Bucket not found"})
+	}
+
+	body, size, mimeType, metadata, err := uploadBody(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if closer, ok := body.(io.Closer); ok {
+		defer closer.Close()
+	}
+	if size > bucket.sizeLimit() {
+		return c.Status(413).JSON(fiber.Map{"error": fmt.Sprintf("Object exceeds the bucket size limit of %d bytes", bucket.sizeLimit())})
+	}
+	if !bucket.allowsMimeType(mimeType) {
+		return c.Status(415).JSON(fiber.Map{"error": "Content type not allowed in this bucket: " + mimeType})
+	}
+
+	existing, err := getObject(ctx, project, bucket.ID, name)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch object"})
+	}
+	if existing != nil && !upsert {
+		return c.Status(409).JSON(fiber.Map{"error": "Object already exists"})
+	}
+
+	obj := &Object{
+		BucketID: bucket.ID,
+		Name:     name,
+		Owner:    owner,
+		Size:     size,
+		MimeType: mimeType,
+		Metadata: metadata,
+	}
+	if existing != nil {
+		err = authorize(ctx, project, OpUpdate, claims, existing)
+	} else {
+		err = authorize(ctx, project, OpInsert, claims, obj)
+	}
+	if err != nil {
+		return authorizeError(c, err)
+	}
+
+	staged := stagingKey(project)
+	stat, err := Store.Put(ctx, staged, body)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not store object"})
+	}
+
+	// Only replace the object the policies were checked against: one created
+	// meanwhile is a conflict
+	obj.Size, obj.ETag = stat.Size, stat.ETag
+	saved, err := commitObject(ctx, project, obj, upsert && existing != nil, staged)
+	if errors.Is(err, errObjectExists) {
+		return c.Status(409).JSON(fiber.Map{"error": "Object already exists"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not save object metadata"})
+	}
+	return c.JSON(saved)
+}
+
+// DownloadObjectHandler serves an object of any bucket (authenticated)
+func DownloadObjectHandler(c *fiber.Ctx) error {
+	return serveObject(c, false)
+}
+
+// PublicDownloadHandler serves an object of a public bucket without a token
+func PublicDownloadHandler(c *fiber.Ctx) error {
+	return serveObject(c, true)
+}
+
+func serveObject(c *fiber.Ctx, publicOnly bool) error {
+	project := c.Params("project")
+	if !isValidIdentifier(project) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+	name, ok := objectName(c)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid object name"})
+	}
+
+	ctx := context.Background()
+	bucket, err := getBucket(ctx, project, c.Params("bucket"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch bucket"})
+	}
+	if bucket == nil || (publicOnly && !bucket.Public) {
+		return c.Status(404).JSON(fiber.Map{"error": "Object not found"})
+	}
+
+	obj, err := getObject(ctx, project, bucket.ID, name)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch object"})
+	}
+	if obj == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Object not found"})
+	}
+	if !publicOnly {
+		if err := authorize(ctx, project, OpSelect, claimsOf(c), obj); err != nil {
+			return authorizeError(c, err)
+		}
+	}
+	return sendObject(c, project, bucket, obj)
+}
+
+// sendObject streams an object's contents with caching headers
+func sendObject(c *fiber.Ctx, project string, bucket *Bucket, obj *Object) error {
+	// Images can be transformed on the way out (see transform.go)
+	opts, err := parseTransform(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !transformableTypes[obj.MimeType] {
+		opts = nil
+	}
+
+	etag := `"` + obj.ETag + `"`
+	if opts != nil {
+		etag = `"` + obj.ETag + "-" + opts.variantKey(project, obj)[:16] + `"`
+	}
+	c.Set("ETag", etag)
+	c.Set("Last-Modified", obj.UpdatedAt.UTC().Format(time.RFC1123))
+	if bucket.Public {
+		c.Set("Cache-Control", "public, max-age=3600")
+	} else {
+		c.Set("Cache-Control", "private, no-cache")
+	}
+	if c.Get("If-None-Match") == etag {
+		return c.SendStatus(304)
+	}
+
+	ctx := context.Background()
+	var rc io.ReadCloser
+	var size int64
+	mimeType := obj.MimeType
+	if opts != nil {
+		path, err := transformedVariant(ctx, project, obj, opts)
+		if errors.Is(err, ErrNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Object contents missing"})
+		}
+		if errors.Is(err, errTransformBusy) {
+			c.Set("Retry-After", "5")
+			return c.Status(503).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err != nil {
+			return c.Status(422).JSON(fiber.Map{"error": "Could not transform image: " + err.Error()})
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Could not read object"})
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return c.Status(500).JSON(fiber.Map{"error": "Could not read object"})
+		}
+		rc, size, mimeType = f, info.Size(), "image/"+opts.outputFormat(obj.MimeType)
+	} else {
+		var stat ObjectStat
+		rc, stat, err = Store.Get(ctx, objectKey(project, bucket.ID, obj.Name))
+		if errors.Is(err, ErrNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Object contents missing"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Could not read object"})
+		}
+		size = stat.Size
+	}
+
+	c.Set("Content-Type", mimeType)
+	if filename := c.Query("download"); c.Request().URI().QueryArgs().Has("download") {
+		if filename == "" {
+			filename = obj.Name[strings.LastIndex(obj.Name, "/")+1:]
+		}
+		c.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	}
+	return c.SendStream(rc, int(size))
+}
+
+// ObjectInfoHandler returns an object's metadata
+func ObjectInfoHandler(c *fiber.Ctx) error {
+	project := c.Params("project")
+	if !isValidIdentifier(project) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+	name, ok := objectName(c)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid object name"})
+	}
+
+	ctx := context.Background()
+	obj, err := getObject(ctx, project, c.Params("bucket"), name)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch object"})
+	}
+	if obj == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Object not found"})
+	}
+	if err := authorize(ctx, project, OpSelect, claimsOf(c), obj); err != nil {
+		return authorizeError(c, err)
+	}
+	return c.JSON(obj)
+}
+
+// DeleteObjectHandler deletes an object
+func DeleteObjectHandler(c *fiber.Ctx) error {
+	project := c.Params("project")
+	if !isValidIdentifier(project) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+	name, ok := objectName(c)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid object name"})
+	}
+	bucket := c.Params("bucket")
+
+	ctx := context.Background()
+	obj, err := getObject(ctx, project, bucket, name)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch object"})
+	}
+	if obj == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Object not found"})
+	}
+	if err := authorize(ctx, project, OpDelete, claimsOf(c), obj); err != nil {
+		return authorizeError(c, err)
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s.storage_objects WHERE bucket_id = $1 AND name = $2", project)
+	tag, err := db.Pool.Exec(ctx, query, bucket, name)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not delete object"})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Object not found"})
+	}
+	if err := deleteContents(ctx, project, bucket, name); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not delete object contents"})
+	}
+	return c.JSON(fiber.Map{"message": "Object deleted"})
+}
+
+// ListObjectsHandler lists the objects of a bucket by name prefix
+// Body: {"prefix": "avatars/", "limit": 100, "offset": 0}
+func ListObjectsHandler(c *fiber.Ctx) error {
+	project := c.Params("project")
+	if !isValidIdentifier(project) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+
+	var req struct {
+		Prefix string `json:"prefix"`
+		Limit  int    `json:"limit"`
+		Offset int    `json:"offset"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+	}
+	if req.Limit <= 0 || req.Limit > 1000 {
+		req.Limit = 100
+	}
+	if req.Offset < 0 {
+		req.Offset = 0
+	}
+
+	// Escape LIKE wildcards in the prefix
+	pattern := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(req.Prefix) + "%"
+	query := fmt.Sprintf(`
+		SELECT %s FROM %s.storage_objects
+		WHERE bucket_id = $1 AND name LIKE $2 AND name > $3
+		ORDER BY name
+		LIMIT %d`, objectColumns, project, listBatchSize)
+
+	// Objects are read in batches and filtered by the select policies, so
+	// limit and offset count the objects the requester may see
+	ctx := context.Background()
+	bucket := c.Params("bucket")
+	objects := []*Object{}
+	skip, after := req.Offset, ""
+	for len(objects) < req.Limit {
+		rows, err := db.Pool.Query(ctx, query, bucket, pattern, after)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to list objects"})
+		}
+		batch, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*Object, error) { return scanObject(row) })
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to list objects"})
+		}
+		if len(batch) == 0 {
+			break
+		}
+		after = batch[len(batch)-1].Name
+
+		allowed, err := filterAllowed(ctx, project, bucket, OpSelect, claimsOf(c), batch)
+		if err != nil {
+			return authorizeError(c, err)
+		}
+		for _, o := range allowed {
+			if skip > 0 {
+				skip--
+			} else if len(objects) < req.Limit {
+				objects = append(objects, o)
+			}
+		}
+		if len(batch) < listBatchSize {
+			break
+		}
+	}
+	return c.JSON(objects)
+}
+
+const listBatchSize = 500
+
+// transferRequest is the body of move and copy:
+// {"bucket": "docs", "from": "a.pdf", "to": "archive/a.pdf", "to_bucket": "archive"}
+// to_bucket defaults to bucket.
+type transferRequest struct {
+	Bucket   string `json:"bucket"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	ToBucket string `json:"to_bucket"`
+}
+
+func parseTransfer(c *fiber.Ctx) (*transferRequest, error) {
+	var req transferRequest
+	if err := c.BodyParser(&req); err != nil {
+		return nil, errors.New("Invalid request")
+	}
+	if req.ToBucket == "" {
+		req.ToBucket = req.Bucket
+	}
+	if !isValidObjectName(req.From) || !isValidObjectName(req.To) {
+		return nil, errors.New("Invalid object name")
+	}
+	if req.Bucket == req.ToBucket && req.From == req.To {
+		return nil, errors.New("Source and destination are the same")
+	}
+	return &req, nil
+}
+
+// MoveObjectHandler renames an object, possibly into another bucket
+func MoveObjectHandler(c *fiber.Ctx) error {
+	return transferObject(c, true)
+}
+
+// CopyObjectHandler copies an object, possibly into another bucket
+func CopyObjectHandler(c *fiber.Ctx) error {
+	return transferObject(c, false)
+}
+
+func transferObject(c *fiber.Ctx, move bool) error {
+	project := c.Params("project")
+	if !isValidIdentifier(project) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+	req, err := parseTransfer(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	ctx := context.Background()
+	src, err := getObject(ctx, project, req.Bucket, req.From)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch object"})
+	}
+	if src == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Object not found"})
+	}
+	dstBucket, err := getBucket(ctx, project, req.ToBucket)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch bucket"})
+	}
+	if dstBucket == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Destination bucket not found"})
+	}
+	if src.Size > dstBucket.sizeLimit() || !dstBucket.allowsMimeType(src.MimeType) {
+		return c.Status(400).JSON(fiber.Map{"error": "Object not allowed in the destination bucket"})
+	}
+	if existing, err := getObject(ctx, project, req.ToBucket, req.To); err != nil || existing != nil {
+		return c.Status(409).JSON(fiber.Map{"error": "Destination object already exists"})
+	}
+
+	// Moving needs update access to the source, copying select access;
+	// both need insert access to the destination
+	claims := claimsOf(c)
+	dst := &Object{BucketID: req.ToBucket, Name: req.To, Owner: src.Owner, Size: src.Size, MimeType: src.MimeType, ETag: src.ETag, Metadata: src.Metadata}
+	srcOp := OpSelect
+	if move {
+		srcOp = OpUpdate
+	} else {
+		dst.Owner = ownerOf(c)
+	}
+	if err := authorize(ctx, project, srcOp, claims, src); err != nil {
+		return authorizeError(c, err)
+	}
+	if err := authorize(ctx, project, OpInsert, claims, dst); err != nil {
+		return authorizeError(c, err)
+	}
+
+	srcKey, dstKey := objectKey(project, req.Bucket, req.From), objectKey(project, req.ToBucket, req.To)
+
+	if move {
+		if err := Store.Move(ctx, srcKey, dstKey); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Could not move object"})
+		}
+		query := fmt.Sprintf(`
+			UPDATE %s.storage_objects SET bucket_id = $3, name = $4, updated_at = NOW()
+			WHERE bucket_id = $1 AND name = $2
+			RETURNING %s`, project, objectColumns)
+		obj, err := scanObject(db.Pool.QueryRow(ctx, query, req.Bucket, req.From, req.ToBucket, req.To))
+		if err != nil {
+			Store.Move(ctx, dstKey, srcKey) // Put the contents back
+			return c.Status(500).JSON(fiber.Map{"error": "Could not move object"})
+		}
+		removeVariants(project, req.Bucket, req.From)
+		return c.JSON(obj)
+	}
+
+	staged := stagingKey(project)
+	if err := Store.Copy(ctx, srcKey, staged); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not copy object"})
+	}
+	obj, err := commitObject(ctx, project, dst, false, staged)
+	if errors.Is(err, errObjectExists) {
+		return c.Status(409).JSON(fiber.Map{"error": "Destination object already exists"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not copy object"})
+	}
+	return c.JSON(obj)
+}
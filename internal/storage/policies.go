@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"baas/internal/db"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// Operations policies grant
+const (
+	OpSelect = "select"
+	OpInsert = "insert"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+const policyTimeout = 5 * time.Second
+
+// Policy grants project users an operation on the objects for which
+// Definition, a boolean SQL expression over the object's columns (id,
+// bucket_id, name, owner, size, mime_type, etag, metadata, created_at,
+// updated_at), is true:
+//
+//	owner::text = current_setting('request.jwt.claim.sub', true)
+//	name LIKE 'public/%' AND mime_type LIKE 'image/%'
+//
+// Like RLS, the expression runs as the requester (see db.WithClaims) with
+// the project schema on the search_path. Policies are permissive: an
+// operation is allowed when any applicable policy passes and denied when
+// none does. Platform admins bypass policies.
+type Policy struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	BucketID   *string   `json:"bucket_id"`
+	Operation  string    `json:"operation"`
+	Definition string    `json:"definition"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// errDenied is returned when no policy allows an operation
+var errDenied = errors.New("access denied by storage policies")
+
+func isAdmin(claims jwt.MapClaims) bool {
+	role, _ := claims["role"].(string)
+	return role == "admin"
+}
+
+// policyQuery selects the positions of the objects (a JSON array) passing
+// any of the definitions
+func policyQuery(definitions []string) string {
+	return fmt.Sprintf(`
+		SELECT ord FROM jsonb_to_recordset($1) AS object(
+			ord int, id uuid, bucket_id text, name text, owner uuid, size bigint,
+			mime_type text, etag text, metadata jsonb, created_at timestamptz, updated_at timestamptz)
+		WHERE (%s)`, strings.Join(definitions, ") OR ("))
+}
+
+// loadPolicies returns the definitions of the policies granting op on bucket
+func loadPolicies(ctx context.Context, project, bucket, op string) ([]string, error) {
+	query := `
+		SELECT s.definition
+		FROM baas_system.storage_policies s
+		JOIN baas_system.projects p ON p.id = s.project_id
+		WHERE p.slug = $1 AND s.operation = $2 AND (s.bucket_id IS NULL OR s.bucket_id = $3)
+	`
+	rows, err := db.Pool.Query(ctx, query, project, op, bucket)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// filterAllowed returns the objects of bucket the requester may access with op
+func filterAllowed(ctx context.Context, project, bucket, op string, claims jwt.MapClaims, objects []*Object) ([]*Object, error) {
+	if isAdmin(claims) || len(objects) == 0 {
+		return objects, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, policyTimeout)
+	defer cancel()
+
+	definitions, err := loadPolicies(ctx, project, bucket, op)
+	if err != nil {
+		return nil, err
+	}
+	if len(definitions) == 0 {
+		return nil, nil
+	}
+
+	type row struct {
+		Ord int `json:"ord"`
+		*Object
+	}
+	rows := make([]row, len(objects))
+	for i, o := range objects {
+		rows[i] = row{Ord: i, Object: o}
+	}
+	data, err := json.Marshal(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	var allowed []*Object
+	err = db.WithClaims(ctx, project, claims, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, fmt.Sprintf("SET LOCAL search_path = %s, public", project)); err != nil {
+			return err
+		}
+		result, err := tx.Query(ctx, policyQuery(definitions), data)
+		if err != nil {
+			return err
+		}
+		ords, err := pgx.CollectRows(result, pgx.RowTo[int32])
+		if err != nil {
+			return err
+		}
+		for _, i := range ords {
+			allowed = append(allowed, objects[i])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("storage policy failed: %w", err)
+	}
+	return allowed, nil
+}
+
+// authorize checks that the requester may access o with op
+func authorize(ctx context.Context, project, op string, claims jwt.MapClaims, o *Object) error {
+	allowed, err := filterAllowed(ctx, project, o.BucketID, op, claims, []*Object{o})
+	if err != nil {
+		return err
+	}
+	if len(allowed) == 0 {
+		return errDenied
+	}
+	return nil
+}
+
+// authorizeError answers a failed authorize
+func authorizeError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, errDenied) {
+		return c.Status(403).JSON(fiber.Map{"error": err.Error()})
+	}
+	// Policy errors may quote the definitions or the project's data
+	log.Printf("Storage: authorizing a request of %s failed: %v\n", c.Params("project"), err)
+	return c.Status(500).JSON(fiber.Map{"error": "Could not evaluate the storage policies"})
+}
+
+// errRollback discards the transaction validating a policy
+var errRollback = errors.New("rollback")
+
+// validateDefinition plans a definition as a project user, reporting
+// syntax errors and unknown columns or functions
+func validateDefinition(ctx context.Context, project, definition string) error {
+	claims := map[string]interface{}{"role": "authenticated"}
+	err := db.WithClaims(ctx, project, claims, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, fmt.Sprintf("SET LOCAL search_path = %s, public", project)); err != nil {
+			return err
+		}
+		rows, err := tx.Query(ctx, policyQuery([]string{definition}), "[]")
+		if err != nil {
+			return err
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if errors.Is(err, errRollback) {
+		return nil
+	}
+	return err
+}
+
+// ListPoliciesHandler lists the storage policies of a project
+func ListPoliciesHandler(c *fiber.Ctx) error {
+	query := `
+		SELECT s.id, s.name, s.bucket_id, s.operation, s.definition, s.created_at
+		FROM baas_system.storage_policies s
+		JOIN baas_system.projects p ON p.id = s.project_id
+		WHERE p.slug = $1
+		ORDER BY s.created_at
+	`
+	rows, err := db.Pool.Query(context.Background(), query, c.Params("project"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch storage policies"})
+	}
+	defer rows.Close()
+
+	policies := []Policy{}
+	for rows.Next() {
+		var p Policy
+		if err := rows.Scan(&p.ID, &p.Name, &p.BucketID, &p.Operation, &p.Definition, &p.CreatedAt); err == nil {
+			policies = append(policies, p)
+		}
+	}
+	return c.JSON(policies)
+}
+
+// CreatePolicyHandler adds a storage policy
+// Body: {"name": "own files", "bucket_id": "avatars", "operation": "select",
+// "definition": "owner::text = current_setting('request.jwt.claim.sub', true)"}
+func CreatePolicyHandler(c *fiber.Ctx) error {
+	project := c.Params("project")
+	if !isValidIdentifier(project) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+
+	var p Policy
+	if err := c.BodyParser(&p); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if p.Name == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "name is required"})
+	}
+	switch p.Operation {
+	case OpSelect, OpInsert, OpUpdate, OpDelete:
+	default:
+		return c.Status(400).JSON(fiber.Map{"error": "operation must be 'select', 'insert', 'update' or 'delete'"})
+	}
+	if strings.TrimSpace(p.Definition) == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "definition is required"})
+	}
+
+	ctx := context.Background()
+	if err := validateDefinition(ctx, project, p.Definition); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid definition: " + err.Error()})
+	}
+
+	query := `
+		INSERT INTO baas_system.storage_policies (project_id, name, bucket_id, operation, definition)
+		SELECT id, $2, $3, $4, $5 FROM baas_system.projects WHERE slug = $1
+		RETURNING id, created_at
+	`
+	err := db.Pool.QueryRow(ctx, query, project, p.Name, p.BucketID, p.Operation, p.Definition).Scan(&p.ID, &p.CreatedAt)
+	if err != nil {
+		return c.Status(409).JSON(fiber.Map{"error": "Could not create storage policy (name might be taken)"})
+	}
+	return c.JSON(p)
+}
+
+// DeletePolicyHandler removes a storage policy
+func DeletePolicyHandler(c *fiber.Ctx) error {
+	query := `
+		DELETE FROM baas_system.storage_policies s
+		USING baas_system.projects p
+		WHERE p.id = s.project_id AND p.slug = $1 AND s.id::text = $2
+	`
+	tag, err := db.Pool.Exec(context.Background(), query, c.Params("project"), c.Params("id"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete storage policy"})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Storage policy not found"})
+	}
+	return c.JSON(fiber.Map{"message": "Storage policy deleted"})
+}
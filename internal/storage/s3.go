@@ -0,0 +1,689 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"baas/internal/db"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// S3-compatible API, path-style, with the endpoint
+// http(s)://<host>/<project>/storage/v1/s3:
+//
+//	GET    /                                    ListBuckets
+//	HEAD   /<bucket>                            HeadBucket
+//	GET    /<bucket>?location                   GetBucketLocation
+//	GET    /<bucket>?list-type=2                ListObjectsV2
+//	PUT    /<bucket>/<key>                      PutObject
+//	GET    /<bucket>/<key>                      GetObject (with Range)
+//	HEAD   /<bucket>/<key>                      HeadObject
+//	DELETE /<bucket>/<key>                      DeleteObject
+//	POST   /<bucket>/<key>?uploads              CreateMultipartUpload
+//	PUT    /<bucket>/<key>?partNumber&uploadId  UploadPart
+//	POST   /<bucket>/<key>?uploadId             CompleteMultipartUpload
+//	DELETE /<bucket>/<key>?uploadId             AbortMultipartUpload
+//
+// Requests are authenticated with SigV4 (see S3Auth). User metadata is
+// kept from and returned as x-amz-meta-* headers.
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+const s3TimeFormat = "2006-01-02T15:04:05.000Z"
+
+const maxParts = 10000
+
+type s3ErrorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource,omitempty"`
+}
+
+func s3Error(c *fiber.Ctx, status int, code, message string) error {
+	return s3XML(c.Status(status), s3ErrorResponse{Code: code, Message: message, Resource: c.Path()})
+}
+
+func s3XML(c *fiber.Ctx, v interface{}) error {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		return c.Status(500).SendString(err.Error())
+	}
+	c.Set("Content-Type", "application/xml")
+	return c.Send(append([]byte(xml.Header), body...))
+}
+
+func s3NotImplemented(c *fiber.Ctx) error {
+	return s3Error(c, 501, "NotImplemented", "This operation is not supported")
+}
+
+// S3Handler routes the requests of the S3-compatible API
+func S3Handler(c *fiber.Ctx) error {
+	project := c.Params("project")
+	if !isValidIdentifier(project) {
+		return s3Error(c, 400, "InvalidArgument", "Invalid project")
+	}
+	bucketID := c.Params("bucket")
+	if bucketID == "" {
+		if c.Method() != fiber.MethodGet {
+			return s3NotImplemented(c)
+		}
+		return s3ListBuckets(c, project)
+	}
+
+	ctx := context.Background()
+	bucket, err := getBucket(ctx, project, bucketID)
+	if err != nil {
+		return s3Error(c, 500, "InternalError", "Failed to fetch bucket")
+	}
+	if bucket == nil {
+		return s3Error(c, 404, "NoSuchBucket", "The specified bucket does not exist")
+	}
+
+	q := c.Request().URI().QueryArgs()
+	rawKey := c.Params("*")
+	if rawKey == "" {
+		switch {
+		case c.Method() == fiber.MethodHead:
+			return c.SendStatus(200)
+		case c.Method() == fiber.MethodGet && q.Has("location"):
+			return s3XML(c, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				Xmlns   string   `xml:"xmlns,attr"`
+			}{Xmlns: s3Namespace})
+		case c.Method() == fiber.MethodGet && c.Query("list-type") == "2":
+			return s3ListObjects(c, project, bucket)
+		}
+		return s3NotImplemented(c)
+	}
+
+	key, err := url.PathUnescape(rawKey)
+	if err != nil || !isValidObjectName(key) {
+		return s3Error(c, 400, "InvalidArgument", "Invalid object key")
+	}
+
+	uploadID := c.Query("uploadId")
+	switch c.Method() {
+	case fiber.MethodPut:
+		if uploadID != "" {
+			return s3UploadPart(c, project, bucket, key, uploadID)
+		}
+		if c.Get("X-Amz-Copy-Source") != "" {
+			return s3NotImplemented(c)
+		}
+		return s3PutObject(c, project, bucket, key)
+	case fiber.MethodGet, fiber.MethodHead:
+		return s3GetObject(c, project, bucket, key)
+	case fiber.MethodDelete:
+		if uploadID != "" {
+			return s3AbortUpload(c, project, bucket, key, uploadID)
+		}
+		return s3DeleteObject(c, project, bucket, key)
+	case fiber.MethodPost:
+		if q.Has("uploads") {
+			return s3CreateUpload(c, project, bucket, key)
+		}
+		if uploadID != "" {
+			return s3CompleteUpload(c, project, bucket, key, uploadID)
+		}
+	}
+	return s3NotImplemented(c)
+}
+
+func s3ETag(etag string) string {
+	return `"` + etag + `"`
+}
+
+// s3Body returns the request payload, decoding aws-chunked uploads
+func s3Body(c *fiber.Ctx) ([]byte, error) {
+	mode := c.Get("X-Amz-Content-Sha256")
+	if !strings.HasPrefix(mode, "STREAMING-") {
+		return c.Body(), nil
+	}
+	sig, _ := c.Locals("s3sig").(*s3Signature)
+	signed := strings.HasPrefix(mode, "STREAMING-AWS4-HMAC-SHA256-PAYLOAD")
+	return decodeAWSChunked(c.Body(), sig, signed)
+}
+
+// s3Metadata collects the x-amz-meta-* headers into a JSON object
+func s3Metadata(c *fiber.Ctx) json.RawMessage {
+	meta := map[string]string{}
+	c.Request().Header.VisitAll(func(key, value []byte) {
+		if name, ok := strings.CutPrefix(strings.ToLower(string(key)), "x-amz-meta-"); ok {
+			meta[name] = string(value)
+		}
+	})
+	data, _ := json.Marshal(meta)
+	return data
+}
+
+func s3MimeType(c *fiber.Ctx) string {
+	mimeType := c.Get("Content-Type")
+	if mimeType == "" || mimeType == "binary/octet-stream" {
+		return "application/octet-stream"
+	}
+	return mimeType
+}
+
+func s3ListBuckets(c *fiber.Ctx, project string) error {
+	query := fmt.Sprintf("SELECT id, created_at FROM %s.storage_buckets ORDER BY id", project)
+	rows, err := db.Pool.Query(context.Background(), query)
+	if err != nil {
+		return s3Error(c, 500, "InternalError", "Failed to fetch buckets")
+	}
+	defer rows.Close()
+
+	type s3Bucket struct {
+		Name         string `xml:"Name"`
+		CreationDate string `xml:"CreationDate"`
+	}
+	result := struct {
+		XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+		Xmlns   string     `xml:"xmlns,attr"`
+		OwnerID string     `xml:"Owner>ID"`
+		Buckets []s3Bucket `xml:"Buckets>Bucket"`
+	}{Xmlns: s3Namespace, OwnerID: project}
+	for rows.Next() {
+		var name string
+		var created time.Time
+		if err := rows.Scan(&name, &created); err == nil {
+			result.Buckets = append(result.Buckets, s3Bucket{name, created.UTC().Format(s3TimeFormat)})
+		}
+	}
+	return s3XML(c, result)
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3Prefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// s3ListObjects lists a bucket in binary key order (ListObjectsV2).
+// Continuation tokens are the last returned key or common prefix.
+func s3ListObjects(c *fiber.Ctx, project string, bucket *Bucket) error {
+	prefix, delimiter := c.Query("prefix"), c.Query("delimiter")
+	maxKeys := 1000
+	if v := c.Query("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return s3Error(c, 400, "InvalidArgument", "Invalid max-keys")
+		}
+		maxKeys = min(n, 1000)
+	}
+	after := c.Query("start-after")
+	if token := c.Query("continuation-token"); token != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			return s3Error(c, 400, "InvalidArgument", "Invalid continuation token")
+		}
+		after = string(decoded)
+	}
+	urlEncode := c.Query("encoding-type") == "url"
+	encode := func(s string) string {
+		if urlEncode {
+			return awsURIEncode(s, false)
+		}
+		return s
+	}
+
+	result := struct {
+		XMLName               xml.Name   `xml:"ListBucketResult"`
+		Xmlns                 string     `xml:"xmlns,attr"`
+		Name                  string     `xml:"Name"`
+		Prefix                string     `xml:"Prefix"`
+		Delimiter             string     `xml:"Delimiter,omitempty"`
+		MaxKeys               int        `xml:"MaxKeys"`
+		KeyCount              int        `xml:"KeyCount"`
+		IsTruncated           bool       `xml:"IsTruncated"`
+		EncodingType          string     `xml:"EncodingType,omitempty"`
+		ContinuationToken     string     `xml:"ContinuationToken,omitempty"`
+		NextContinuationToken string     `xml:"NextContinuationToken,omitempty"`
+		StartAfter            string     `xml:"StartAfter,omitempty"`
+		Contents              []s3Object `xml:"Contents"`
+		CommonPrefixes        []s3Prefix `xml:"CommonPrefixes"`
+	}{
+		Xmlns:             s3Namespace,
+		Name:              bucket.ID,
+		Prefix:            encode(prefix),
+		Delimiter:         encode(delimiter),
+		MaxKeys:           maxKeys,
+		ContinuationToken: c.Query("continuation-token"),
+		StartAfter:        encode(c.Query("start-after")),
+	}
+	if urlEncode {
+		result.EncodingType = "url"
+	}
+
+	// A continuation token ending a common prefix skips the keys below it
+	lastPrefix := ""
+	if delimiter != "" && strings.HasPrefix(after, prefix) && strings.HasSuffix(after, delimiter) {
+		lastPrefix = after
+	}
+
+	pattern := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+	query := fmt.Sprintf(`
+		SELECT name, etag, size, updated_at FROM %s.storage_objects
+		WHERE bucket_id = $1 AND name LIKE $2 AND name COLLATE "C" > $3
+		ORDER BY name COLLATE "C"
+		LIMIT %d`, project, listBatchSize)
+
+	ctx := context.Background()
+	last := ""
+	for maxKeys > 0 {
+		rows, err := db.Pool.Query(ctx, query, bucket.ID, pattern, after)
+		if err != nil {
+			return s3Error(c, 500, "InternalError", "Failed to list objects")
+		}
+		type entry struct {
+			name, etag string
+			size       int64
+			updated    time.Time
+		}
+		batch, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (entry, error) {
+			var e entry
+			err := row.Scan(&e.name, &e.etag, &e.size, &e.updated)
+			return e, err
+		})
+		if err != nil {
+			return s3Error(c, 500, "InternalError", "Failed to list objects")
+		}
+
+		for _, e := range batch {
+			after = e.name
+			if lastPrefix != "" && strings.HasPrefix(e.name, lastPrefix) {
+				continue
+			}
+			if result.KeyCount == maxKeys {
+				result.IsTruncated = true
+				break
+			}
+			if delimiter != "" {
+				if i := strings.Index(e.name[len(prefix):], delimiter); i >= 0 {
+					lastPrefix = e.name[:len(prefix)+i+len(delimiter)]
+					result.CommonPrefixes = append(result.CommonPrefixes, s3Prefix{encode(lastPrefix)})
+					result.KeyCount++
+					last = lastPrefix
+					continue
+				}
+			}
+			result.Contents = append(result.Contents, s3Object{
+				Key:          encode(e.name),
+				LastModified: e.updated.UTC().Format(s3TimeFormat),
+				ETag:         s3ETag(e.etag),
+				Size:         e.size,
+				StorageClass: "STANDARD",
+			})
+			result.KeyCount++
+			last = e.name
+		}
+		if result.IsTruncated || len(batch) < listBatchSize {
+			break
+		}
+	}
+	if result.IsTruncated {
+		result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+	}
+	return s3XML(c, result)
+}
+
+func s3PutObject(c *fiber.Ctx, project string, bucket *Bucket, key string) error {
+	body, err := s3Body(c)
+	if err != nil {
+		return s3Error(c, 400, "InvalidRequest", err.Error())
+	}
+	mimeType := s3MimeType(c)
+	if int64(len(body)) > bucket.sizeLimit() {
+		return s3Error(c, 400, "EntityTooLarge", fmt.Sprintf("Objects are limited to %d bytes, use a multipart upload", bucket.sizeLimit()))
+	}
+	if !bucket.allowsMimeType(mimeType) {
+		return s3Error(c, 415, "InvalidArgument", "Content type not allowed in this bucket: "+mimeType)
+	}
+
+	ctx := context.Background()
+	staged := stagingKey(project)
+	stat, err := Store.Put(ctx, staged, bytes.NewReader(body))
+	if err != nil {
+		return s3Error(c, 500, "InternalError", "Could not store object")
+	}
+	_, err = commitObject(ctx, project, &Object{
+		BucketID: bucket.ID,
+		Name:     key,
+		Size:     stat.Size,
+		MimeType: mimeType,
+		ETag:     stat.ETag,
+		Metadata: s3Metadata(c),
+	}, true, staged)
+	if err != nil {
+		return s3Error(c, 500, "InternalError", "Could not save object metadata")
+	}
+	c.Set("ETag", s3ETag(stat.ETag))
+	return c.SendStatus(200)
+}
+
+func s3GetObject(c *fiber.Ctx, project string, bucket *Bucket, key string) error {
+	ctx := context.Background()
+	obj, err := getObject(ctx, project, bucket.ID, key)
+	if err != nil {
+		return s3Error(c, 500, "InternalError", "Failed to fetch object")
+	}
+	if obj == nil {
+		return s3Error(c, 404, "NoSuchKey", "The specified key does not exist")
+	}
+
+	c.Set("ETag", s3ETag(obj.ETag))
+	c.Set("Last-Modified", obj.UpdatedAt.UTC().Format(http.TimeFormat))
+	c.Set("Content-Type", obj.MimeType)
+	c.Set("Accept-Ranges", "bytes")
+	var meta map[string]interface{}
+	json.Unmarshal(obj.Metadata, &meta)
+	for name, value := range meta {
+		if s, ok := value.(string); ok {
+			c.Set("X-Amz-Meta-"+name, s)
+		}
+	}
+	if match := c.Get("If-None-Match"); match != "" && match == s3ETag(obj.ETag) {
+		return c.SendStatus(304)
+	}
+
+	if c.Method() == fiber.MethodHead {
+		c.Response().Header.SetContentLength(int(obj.Size))
+		c.Response().SkipBody = true
+		return c.SendStatus(200)
+	}
+
+	rc, stat, err := Store.Get(ctx, objectKey(project, bucket.ID, key))
+	if errors.Is(err, ErrNotFound) {
+		return s3Error(c, 404, "NoSuchKey", "The object contents are missing")
+	}
+	if err != nil {
+		return s3Error(c, 500, "InternalError", "Could not read object")
+	}
+
+	if rangeHeader := c.Get("Range"); rangeHeader != "" {
+		if seeker, ok := rc.(io.ReadSeeker); ok {
+			start, end, ok := parseRange(rangeHeader, stat.Size)
+			if !ok {
+				rc.Close()
+				c.Set("Content-Range", fmt.Sprintf("bytes */%d", stat.Size))
+				return s3Error(c, 416, "InvalidRange", "The requested range is not satisfiable")
+			}
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				rc.Close()
+				return s3Error(c, 500, "InternalError", "Could not read object")
+			}
+			c.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, stat.Size))
+			c.Status(206)
+			return c.SendStream(struct {
+				io.Reader
+				io.Closer
+			}{io.LimitReader(rc, end-start+1), rc}, int(end-start+1))
+		}
+	}
+	return c.SendStream(rc, int(stat.Size))
+}
+
+// parseRange parses a single "bytes=start-end" range (end inclusive)
+func parseRange(header string, size int64) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, _ := strings.Cut(spec, "-")
+	if first == "" {
+		// Suffix range: the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		return max(0, size-n), size - 1, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end, true
+}
+
+func s3DeleteObject(c *fiber.Ctx, project string, bucket *Bucket, key string) error {
+	ctx := context.Background()
+	query := fmt.Sprintf("DELETE FROM %s.storage_objects WHERE bucket_id = $1 AND name = $2", project)
+	tag, err := db.Pool.Exec(ctx, query, bucket.ID, key)
+	if err != nil {
+		return s3Error(c, 500, "InternalError", "Could not delete object")
+	}
+	if tag.RowsAffected() > 0 {
+		deleteContents(ctx, project, bucket.ID, key)
+	}
+	return c.SendStatus(204)
+}
+
+// partKey is the backend key of a multipart upload part
+func partKey(project, uploadID string, number int) string {
+	return fmt.Sprintf(".multipart/%s/%s/%d", project, uploadID, number)
+}
+
+// multipartUpload loads an upload of key, nil if it does not exist
+func multipartUpload(ctx context.Context, project, bucket, key, uploadID string) (mimeType string, metadata json.RawMessage, found bool, err error) {
+	query := fmt.Sprintf(`
+		SELECT mime_type, metadata FROM %s.storage_multipart_uploads
+		WHERE id::text = $1 AND bucket_id = $2 AND name = $3`, project)
+	err = db.Pool.QueryRow(ctx, query, uploadID, bucket, key).Scan(&mimeType, &metadata)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil, false, nil
+	}
+	return mimeType, metadata, err == nil, err
+}
+
+func s3CreateUpload(c *fiber.Ctx, project string, bucket *Bucket, key string) error {
+	mimeType := s3MimeType(c)
+	if !bucket.allowsMimeType(mimeType) {
+		return s3Error(c, 415, "InvalidArgument", "Content type not allowed in this bucket: "+mimeType)
+	}
+
+	var uploadID string
+	query := fmt.Sprintf(`
+		INSERT INTO %s.storage_multipart_uploads (bucket_id, name, mime_type, metadata)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id`, project)
+	err := db.Pool.QueryRow(context.Background(), query, bucket.ID, key, mimeType, s3Metadata(c)).Scan(&uploadID)
+	if err != nil {
+		return s3Error(c, 500, "InternalError", "Could not create upload")
+	}
+	return s3XML(c, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadID string   `xml:"UploadId"`
+	}{Xmlns: s3Namespace, Bucket: bucket.ID, Key: key, UploadID: uploadID})
+}
+
+func s3UploadPart(c *fiber.Ctx, project string, bucket *Bucket, key, uploadID string) error {
+	number, err := strconv.Atoi(c.Query("partNumber"))
+	if err != nil || number < 1 || number > maxParts {
+		return s3Error(c, 400, "InvalidArgument", fmt.Sprintf("partNumber must be between 1 and %d", maxParts))
+	}
+	ctx := context.Background()
+	_, _, found, err := multipartUpload(ctx, project, bucket.ID, key, uploadID)
+	if err != nil {
+		return s3Error(c, 500, "InternalError", "Failed to fetch upload")
+	}
+	if !found {
+		return s3Error(c, 404, "NoSuchUpload", "The specified upload does not exist")
+	}
+
+	body, err := s3Body(c)
+	if err != nil {
+		return s3Error(c, 400, "InvalidRequest", err.Error())
+	}
+	stat, err := Store.Put(ctx, partKey(project, uploadID, number), bytes.NewReader(body))
+	if err != nil {
+		return s3Error(c, 500, "InternalError", "Could not store part")
+	}
+
+	query := fmt.Sprintf(`
+		INSERT INTO %s.storage_multipart_parts (upload_id, part_number, size, etag)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (upload_id, part_number) DO UPDATE SET size = EXCLUDED.size, etag = EXCLUDED.etag`, project)
+	if _, err := db.Pool.Exec(ctx, query, uploadID, number, stat.Size, stat.ETag); err != nil {
+		return s3Error(c, 500, "InternalError", "Could not save part")
+	}
+	c.Set("ETag", s3ETag(stat.ETag))
+	return c.SendStatus(200)
+}
+
+func s3CompleteUpload(c *fiber.Ctx, project string, bucket *Bucket, key, uploadID string) error {
+	var req struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(c.Body(), &req); err != nil || len(req.Parts) == 0 {
+		return s3Error(c, 400, "MalformedXML", "Invalid CompleteMultipartUpload request")
+	}
+	if !sort.SliceIsSorted(req.Parts, func(i, j int) bool { return req.Parts[i].PartNumber < req.Parts[j].PartNumber }) {
+		return s3Error(c, 400, "InvalidPartOrder", "Parts must be listed in ascending order")
+	}
+
+	ctx := context.Background()
+	mimeType, metadata, found, err := multipartUpload(ctx, project, bucket.ID, key, uploadID)
+	if err != nil {
+		return s3Error(c, 500, "InternalError", "Failed to fetch upload")
+	}
+	if !found {
+		return s3Error(c, 404, "NoSuchUpload", "The specified upload does not exist")
+	}
+
+	query := fmt.Sprintf("SELECT part_number, size, etag FROM %s.storage_multipart_parts WHERE upload_id = $1", project)
+	rows, err := db.Pool.Query(ctx, query, uploadID)
+	if err != nil {
+		return s3Error(c, 500, "InternalError", "Failed to fetch parts")
+	}
+	type part struct {
+		size int64
+		etag string
+	}
+	stored := map[int]part{}
+	for rows.Next() {
+		var n int
+		var p part
+		if err := rows.Scan(&n, &p.size, &p.etag); err == nil {
+			stored[n] = p
+		}
+	}
+	rows.Close()
+
+	var total int64
+	readers := make([]io.Reader, 0, len(req.Parts))
+	defer func() {
+		for _, r := range readers {
+			r.(io.Closer).Close()
+		}
+	}()
+	for _, p := range req.Parts {
+		s, ok := stored[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, `"`) != s.etag {
+			return s3Error(c, 400, "InvalidPart", fmt.Sprintf("Part %d was not uploaded or its ETag does not match", p.PartNumber))
+		}
+		total += s.size
+		if total > bucket.resumableLimit() {
+			return s3Error(c, 400, "EntityTooLarge", fmt.Sprintf("Objects are limited to %d bytes", bucket.resumableLimit()))
+		}
+		rc, _, err := Store.Get(ctx, partKey(project, uploadID, p.PartNumber))
+		if err != nil {
+			return s3Error(c, 500, "InternalError", "Could not read part")
+		}
+		readers = append(readers, rc)
+	}
+
+	staged := stagingKey(project)
+	stat, err := Store.Put(ctx, staged, io.MultiReader(readers...))
+	if err != nil {
+		return s3Error(c, 500, "InternalError", "Could not store object")
+	}
+	_, err = commitObject(ctx, project, &Object{
+		BucketID: bucket.ID,
+		Name:     key,
+		Size:     stat.Size,
+		MimeType: mimeType,
+		ETag:     stat.ETag,
+		Metadata: metadata,
+	}, true, staged)
+	if err != nil {
+		return s3Error(c, 500, "InternalError", "Could not save object metadata")
+	}
+	deleteMultipart(ctx, project, uploadID)
+
+	return s3XML(c, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string   `xml:"Location"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		ETag     string   `xml:"ETag"`
+	}{Xmlns: s3Namespace, Location: c.Path(), Bucket: bucket.ID, Key: key, ETag: s3ETag(stat.ETag)})
+}
+
+func s3AbortUpload(c *fiber.Ctx, project string, bucket *Bucket, key, uploadID string) error {
+	ctx := context.Background()
+	_, _, found, err := multipartUpload(ctx, project, bucket.ID, key, uploadID)
+	if err != nil {
+		return s3Error(c, 500, "InternalError", "Failed to fetch upload")
+	}
+	if !found {
+		return s3Error(c, 404, "NoSuchUpload", "The specified upload does not exist")
+	}
+	if err := deleteMultipart(ctx, project, uploadID); err != nil {
+		return s3Error(c, 500, "InternalError", "Could not abort upload")
+	}
+	return c.SendStatus(204)
+}
+
+// deleteMultipart removes a multipart upload and its parts
+func deleteMultipart(ctx context.Context, project, uploadID string) error {
+	query := fmt.Sprintf(`
+		DELETE FROM %s.storage_multipart_parts WHERE upload_id = $1
+		RETURNING part_number`, project)
+	rows, err := db.Pool.Query(ctx, query, uploadID)
+	if err != nil {
+		return err
+	}
+	numbers, err := pgx.CollectRows(rows, pgx.RowTo[int32])
+	if err != nil {
+		return err
+	}
+	for _, n := range numbers {
+		Store.Delete(ctx, partKey(project, uploadID, int(n)))
+	}
+	_, err = db.Pool.Exec(ctx, fmt.Sprintf("DELETE FROM %s.storage_multipart_uploads WHERE id = $1", project), uploadID)
+	return err
+}
@@ -0,0 +1,378 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"baas/internal/db"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// AWS Signature Version 4 for the S3-compatible API. Requests are signed
+// with a project access key, either in the Authorization header or in the
+// query string (presigned URLs). Access keys act with full access to the
+// project's buckets, like platform admins.
+
+const (
+	sigAlgorithm    = "AWS4-HMAC-SHA256"
+	sigTimeFormat   = "20060102T150405Z"
+	sigMaxSkew      = 15 * time.Minute
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	emptySHA256     = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// Replaced in tests
+var (
+	s3SecretLookup = accessKeySecret
+	s3Now          = time.Now
+)
+
+// s3Signature is a verified request signature, kept to check the chunk
+// signatures of aws-chunked bodies
+type s3Signature struct {
+	signingKey []byte
+	date       string
+	scope      string
+	signature  string
+}
+
+// S3Auth verifies the SigV4 signature of S3 requests
+func S3Auth() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		sig, err := verifySignature(c)
+		if err != nil {
+			var s3err *s3Err
+			if errors.As(err, &s3err) {
+				return s3Error(c, s3err.status, s3err.code, s3err.message)
+			}
+			return s3Error(c, 500, "InternalError", "Could not verify the signature")
+		}
+		c.Locals("s3sig", sig)
+		return c.Next()
+	}
+}
+
+// s3Err is an S3 error response
+type s3Err struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3Err) Error() string { return e.message }
+
+func errAccessDenied(message string) error {
+	return &s3Err{403, "AccessDenied", message}
+}
+
+func verifySignature(c *fiber.Ctx) (*s3Signature, error) {
+	query, err := url.ParseQuery(string(c.Request().URI().QueryString()))
+	if err != nil {
+		return nil, &s3Err{400, "InvalidArgument", "Invalid query string"}
+	}
+
+	var credential, signedHeaders, signature, amzDate, payloadHash string
+	presigned := query.Get("X-Amz-Algorithm") != ""
+	if presigned {
+		if query.Get("X-Amz-Algorithm") != sigAlgorithm {
+			return nil, errAccessDenied("Unsupported signing algorithm")
+		}
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		payloadHash = unsignedPayload
+		query.Del("X-Amz-Signature")
+	} else {
+		authorization := c.Get("Authorization")
+		rest, ok := strings.CutPrefix(authorization, sigAlgorithm+" ")
+		if !ok {
+			return nil, errAccessDenied("Requests must be signed with AWS Signature Version 4")
+		}
+		for _, field := range strings.Split(rest, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch key {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				signature = value
+			}
+		}
+		amzDate = c.Get("X-Amz-Date")
+		payloadHash = c.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			return nil, &s3Err{400, "InvalidRequest", "Missing x-amz-content-sha256"}
+		}
+	}
+
+	// Credential: <access key>/<date>/<region>/s3/aws4_request
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[3] != "s3" || parts[4] != "aws4_request" || signature == "" || signedHeaders == "" {
+		return nil, &s3Err{400, "AuthorizationHeaderMalformed", "Malformed credential or signature"}
+	}
+	accessKey, scope := parts[0], strings.Join(parts[1:], "/")
+
+	signedAt, err := time.Parse(sigTimeFormat, amzDate)
+	if err != nil || amzDate[:8] != parts[1] {
+		return nil, errAccessDenied("Invalid X-Amz-Date")
+	}
+	now := s3Now()
+	if presigned {
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires < 1 || expires > 7*24*60*60 {
+			return nil, errAccessDenied("Invalid X-Amz-Expires")
+		}
+		if now.After(signedAt.Add(time.Duration(expires)*time.Second)) || signedAt.After(now.Add(sigMaxSkew)) {
+			return nil, errAccessDenied("Request has expired")
+		}
+	} else if now.Sub(signedAt) > sigMaxSkew || signedAt.Sub(now) > sigMaxSkew {
+		return nil, &s3Err{403, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large"}
+	}
+
+	secret, err := s3SecretLookup(context.Background(), c.Params("project"), accessKey)
+	if err != nil {
+		return nil, err
+	}
+
+	canonical := strings.Join([]string{
+		c.Method(),
+		string(c.Request().URI().PathOriginal()),
+		canonicalQuery(query),
+		canonicalHeaders(c, signedHeaders),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	stringToSign := strings.Join([]string{sigAlgorithm, amzDate, scope, sha256Hex([]byte(canonical))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secret), parts[1])
+	for _, part := range parts[2:] {
+		key = hmacSHA256(key, part)
+	}
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, &s3Err{403, "SignatureDoesNotMatch", "The request signature does not match"}
+	}
+
+	// A signed payload hash must match the body
+	if !presigned && len(payloadHash) == 64 && payloadHash != sha256Hex(c.Body()) {
+		return nil, &s3Err{400, "XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 does not match the body"}
+	}
+	return &s3Signature{signingKey: key, date: amzDate, scope: scope, signature: signature}, nil
+}
+
+// accessKeySecret returns the secret of a project's access key
+func accessKeySecret(ctx context.Context, project, accessKey string) (string, error) {
+	query := `
+		SELECT k.secret_access_key
+		FROM baas_system.storage_access_keys k
+		JOIN baas_system.projects p ON p.id = k.project_id
+		WHERE k.access_key_id = $1 AND p.slug = $2
+	`
+	var secret string
+	err := db.Pool.QueryRow(ctx, query, accessKey, project).Scan(&secret)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", &s3Err{403, "InvalidAccessKeyId", "The access key does not exist for this project"}
+	}
+	return secret, err
+}
+
+// canonicalQuery sorts the encoded parameters by name, then value
+func canonicalQuery(query url.Values) string {
+	type pair struct{ key, value string }
+	pairs := make([]pair, 0, len(query))
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, pair{awsURIEncode(key, true), awsURIEncode(value, true)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].key != pairs[j].key {
+			return pairs[i].key < pairs[j].key
+		}
+		return pairs[i].value < pairs[j].value
+	})
+	encoded := make([]string, len(pairs))
+	for i, p := range pairs {
+		encoded[i] = p.key + "=" + p.value
+	}
+	return strings.Join(encoded, "&")
+}
+
+func canonicalHeaders(c *fiber.Ctx, signedHeaders string) string {
+	var b strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		var value string
+		if name == "host" {
+			value = string(c.Request().Host())
+		} else {
+			value = string(c.Request().Header.Peek(name))
+		}
+		b.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	return b.String()
+}
+
+// awsURIEncode escapes everything but the unreserved characters
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9') ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || (ch == '/' && !encodeSlash) {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// decodeAWSChunked returns the payload of an aws-chunked body
+// ("<hex size>[;chunk-signature=<sig>]\r\n<data>\r\n" ... then trailers),
+// checking the chunk signatures of signed streaming uploads
+func decodeAWSChunked(body []byte, sig *s3Signature, signed bool) ([]byte, error) {
+	var out bytes.Buffer
+	previous := sig.signature
+	for {
+		line, rest, ok := bytes.Cut(body, []byte("\r\n"))
+		if !ok {
+			return nil, errors.New("truncated chunk header")
+		}
+		sizeHex, ext, _ := strings.Cut(string(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil || size < 0 || size > int64(len(rest)) {
+			return nil, errors.New("invalid chunk size")
+		}
+		data := rest[:size]
+
+		if signed {
+			chunkSig, _ := strings.CutPrefix(ext, "chunk-signature=")
+			stringToSign := strings.Join([]string{sigAlgorithm + "-PAYLOAD", sig.date, sig.scope, previous, emptySHA256, sha256Hex(data)}, "\n")
+			expected := hex.EncodeToString(hmacSHA256(sig.signingKey, stringToSign))
+			if !hmac.Equal([]byte(expected), []byte(chunkSig)) {
+				return nil, errors.New("chunk signature does not match")
+			}
+			previous = chunkSig
+		}
+		if size == 0 {
+			return out.Bytes(), nil // Trailers (checksums) follow
+		}
+		out.Write(data)
+		body = bytes.TrimPrefix(rest[size:], []byte("\r\n"))
+	}
+}
+
+// AccessKey is an S3 credential of a project
+type AccessKey struct {
+	ID              string    `json:"id"`
+	AccessKeyID     string    `json:"access_key_id"`
+	SecretAccessKey string    `json:"secret_access_key,omitempty"`
+	Description     string    `json:"description"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// ListAccessKeysHandler lists the S3 access keys of a project (without secrets)
+func ListAccessKeysHandler(c *fiber.Ctx) error {
+	query := `
+		SELECT k.id, k.access_key_id, k.description, k.created_at
+		FROM baas_system.storage_access_keys k
+		JOIN baas_system.projects p ON p.id = k.project_id
+		WHERE p.slug = $1
+		ORDER BY k.created_at
+	`
+	rows, err := db.Pool.Query(context.Background(), query, c.Params("project"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch access keys"})
+	}
+	defer rows.Close()
+
+	keys := []AccessKey{}
+	for rows.Next() {
+		var k AccessKey
+		if err := rows.Scan(&k.ID, &k.AccessKeyID, &k.Description, &k.CreatedAt); err == nil {
+			keys = append(keys, k)
+		}
+	}
+	return c.JSON(keys)
+}
+
+// CreateAccessKeyHandler creates an S3 access key. The secret is only
+// returned here.
+// Body: {"description": "backups"}
+func CreateAccessKeyHandler(c *fiber.Ctx) error {
+	var k AccessKey
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&k); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+	}
+
+	id := make([]byte, 10)
+	secret := make([]byte, 30)
+	if _, err := rand.Read(id); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not generate key"})
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not generate key"})
+	}
+	k.AccessKeyID = "HB" + strings.ToUpper(hex.EncodeToString(id))
+	k.SecretAccessKey = base64.RawURLEncoding.EncodeToString(secret)
+
+	query := `
+		INSERT INTO baas_system.storage_access_keys (project_id, access_key_id, secret_access_key, description)
+		SELECT id, $2, $3, $4 FROM baas_system.projects WHERE slug = $1
+		RETURNING id, created_at
+	`
+	err := db.Pool.QueryRow(context.Background(), query, c.Params("project"), k.AccessKeyID, k.SecretAccessKey, k.Description).Scan(&k.ID, &k.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(404).JSON(fiber.Map{"error": "Project not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not create access key"})
+	}
+	return c.Status(201).JSON(k)
+}
+
+// DeleteAccessKeyHandler revokes an S3 access key
+func DeleteAccessKeyHandler(c *fiber.Ctx) error {
+	query := `
+		DELETE FROM baas_system.storage_access_keys k
+		USING baas_system.projects p
+		WHERE p.id = k.project_id AND p.slug = $1 AND k.id::text = $2
+	`
+	tag, err := db.Pool.Exec(context.Background(), query, c.Params("project"), c.Params("id"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete access key"})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Access key not found"})
+	}
+	return c.JSON(fiber.Map{"message": "Access key deleted"})
+}
@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"baas/internal/auth"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Signed URL kinds
+const (
+	signDownload = "download"
+	signUpload   = "upload"
+)
+
+// maxSignedExpiry caps the lifetime of signed URLs (one week)
+const maxSignedExpiry = 7 * 24 * 60 * 60
+
+// signedAudience keeps signed URL tokens from being accepted as tenant
+// tokens (see auth.ValidateTenantToken)
+func signedAudience(project string) string {
+	return project + ":storage"
+}
+
+// signObjectURL returns the path of a signed URL for an object. The claims
+// of the signer, if given, are kept to check the policies when the URL is
+// used.
+func signObjectURL(project, bucket, name, kind string, owner *string, signer jwt.MapClaims, upsert bool, expiresIn int) (string, string, error) {
+	claims := jwt.MapClaims{
+		"aud":    signedAudience(project),
+		"kind":   kind,
+		"bucket": bucket,
+		"name":   name,
+		"upsert": upsert,
+		"exp":    time.Now().Add(time.Duration(expiresIn) * time.Second).Unix(),
+	}
+	if owner != nil {
+		claims["sub"] = *owner
+	}
+	if signer != nil {
+		claims["signer"] = signer
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(auth.SecretKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	path := "/object/sign/"
+	if kind == signUpload {
+		path = "/object/upload/sign/"
+	}
+	escaped := make([]string, 0)
+	for _, part := range strings.Split(name, "/") {
+		escaped = append(escaped, url.PathEscape(part))
+	}
+	return fmt.Sprintf("/%s/storage/v1%s%s/%s?token=%s", project, path, bucket, strings.Join(escaped, "/"), token), token, nil
+}
+
+// checkSignedToken validates the token of a signed URL for the requested object
+func checkSignedToken(c *fiber.Ctx, kind, bucket, name string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(c.Query("token"), func(token *jwt.Token) (interface{}, error) {
+		return auth.SecretKey, nil
+	}, jwt.WithValidMethods([]string{"HS256"}), jwt.WithAudience(signedAudience(c.Params("project"))))
+	if err != nil || !token.Valid {
+		return nil, errors.New("Invalid or expired signature")
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if claims["kind"] != kind || claims["bucket"] != bucket || claims["name"] != name {
+		return nil, errors.New("Signature does not match this object")
+	}
+	return claims, nil
+}
+
+// parseExpiresIn reads {"expires_in": seconds} (default one hour)
+func parseExpiresIn(c *fiber.Ctx, req *signRequest) error {
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(req); err != nil {
+			return errors.New("Invalid request")
+		}
+	}
+	if req.ExpiresIn == 0 {
+		req.ExpiresIn = 3600
+	}
+	if req.ExpiresIn < 0 || req.ExpiresIn > maxSignedExpiry {
+		return fmt.Errorf("expires_in must be between 1 and %d seconds", maxSignedExpiry)
+	}
+	return nil
+}
+
+type signRequest struct {
+	ExpiresIn int  `json:"expires_in"`
+	Upsert    bool `json:"upsert"`
+}
+
+// CreateSignedURLHandler returns a URL downloading an object without a token
+// until it expires. The requester needs select access to the object.
+// Body: {"expires_in": 3600}
+func CreateSignedURLHandler(c *fiber.Ctx) error {
+	project := c.Params("project")
+	if !isValidIdentifier(project) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+	name, ok := objectName(c)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid object name"})
+	}
+	var req signRequest
+	if err := parseExpiresIn(c, &req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	ctx := context.Background()
+	obj, err := getObject(ctx, project, c.Params("bucket"), name)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch object"})
+	}
+	if obj == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Object not found"})
+	}
+	if err := authorize(ctx, project, OpSelect, claimsOf(c), obj); err != nil {
+		return authorizeError(c, err)
+	}
+
+	signed, _, err := signObjectURL(project, obj.BucketID, obj.Name, signDownload, nil, nil, false, req.ExpiresIn)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not sign URL"})
+	}
+	return c.JSON(fiber.Map{"signed_url": signed, "expires_in": req.ExpiresIn})
+}
+
+// SignedDownloadHandler serves an object through a signed URL
+func SignedDownloadHandler(c *fiber.Ctx) error {
+	project := c.Params("project")
+	if !isValidIdentifier(project) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+	name, ok := objectName(c)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid object name"})
+	}
+	if _, err := checkSignedToken(c, signDownload, c.Params("bucket"), name); err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	ctx := context.Background()
+	bucket, err := getBucket(ctx, project, c.Params("bucket"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch bucket"})
+	}
+	if bucket == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Object not found"})
+	}
+	obj, err := getObject(ctx, project, bucket.ID, name)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch object"})
+	}
+	if obj == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Object not found"})
+	}
+	return sendObject(c, project, bucket, obj)
+}
+
+// CreateSignedUploadURLHandler returns a URL uploading an object without a
+// token until it expires. The requester needs insert access (update access
+// to replace an existing object with "upsert"); the object is owned by the
+// requester. The policies are checked again at upload time, as the
+// requester, against the uploaded object (type, size and metadata), and so
+// are the bucket limits. "upsert" only applies if the object exists when
+// signing.
+// Body: {"expires_in": 600, "upsert": false}
+func CreateSignedUploadURLHandler(c *fiber.Ctx) error {
+	project := c.Params("project")
+	if !isValidIdentifier(project) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+	name, ok := objectName(c)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid object name"})
+	}
+	var req signRequest
+	if err := parseExpiresIn(c, &req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	ctx := context.Background()
+	bucket, err := getBucket(ctx, project, c.Params("bucket"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch bucket"})
+	}
+	if bucket == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Bucket not found"})
+	}
+	existing, err := getObject(ctx, project, bucket.ID, name)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch object"})
+	}
+	if existing != nil && !req.Upsert {
+		return c.Status(409).JSON(fiber.Map{"error": "Object already exists"})
+	}
+
+	owner := ownerOf(c)
+	if existing != nil {
+		err = authorize(ctx, project, OpUpdate, claimsOf(c), existing)
+	} else {
+		err = authorize(ctx, project, OpInsert, claimsOf(c), &Object{BucketID: bucket.ID, Name: name, Owner: owner, Metadata: []byte("{}")})
+	}
+	if err != nil {
+		return authorizeError(c, err)
+	}
+
+	signed, token, err := signObjectURL(project, bucket.ID, name, signUpload, owner, claimsOf(c), req.Upsert && existing != nil, req.ExpiresIn)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not sign URL"})
+	}
+	return c.JSON(fiber.Map{"signed_url": signed, "token": token, "expires_in": req.ExpiresIn})
+}
+
+// SignedUploadHandler stores an object through a signed upload URL
+// (raw body or multipart "file" field, like UploadObjectHandler)
+func SignedUploadHandler(c *fiber.Ctx) error {
+	name, ok := objectName(c)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid object name"})
+	}
+	claims, err := checkSignedToken(c, signUpload, c.Params("bucket"), name)
+	if err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var owner *string
+	if sub, ok := claims["sub"].(string); ok {
+		owner = &sub
+	}
+	signer, ok := claims["signer"].(map[string]interface{})
+	if !ok {
+		return c.Status(403).JSON(fiber.Map{"error": "Invalid or expired signature"})
+	}
+	upsert, _ := claims["upsert"].(bool)
+	return storeUpload(c, name, owner, upsert, jwt.MapClaims(signer))
+}
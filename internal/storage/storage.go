@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Store is the backend holding object contents (see Setup)
+var Store Backend
+
+// MaxUploadBytes caps the size of a single upload request
+// (STORAGE_MAX_UPLOAD_BYTES, 50 MB by default)
+var MaxUploadBytes = envInt("STORAGE_MAX_UPLOAD_BYTES", 50<<20)
+
+// BodyLimit buffers request bodies, rejecting the ones over the route's limit
+// with 413. The app streams request bodies (fiber.Config.StreamRequestBody),
+// so only storage uploads may send up to MaxUploadBytes; every other route
+// keeps fiber's default limit.
+func BodyLimit() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		limit := fiber.DefaultBodyLimit
+		if isUploadPath(c.Path()) {
+			limit = MaxUploadBytes
+		}
+
+		req := c.Request()
+		if req.Header.ContentLength() > limit {
+			return bodyTooLarge(c, limit)
+		}
+		if stream := req.BodyStream(); stream != nil {
+			// Chunked bodies have no length to check up front
+			body, err := io.ReadAll(io.LimitReader(stream, int64(limit)+1))
+			if err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "Could not read request body"})
+			}
+			if len(body) > limit {
+				return bodyTooLarge(c, limit)
+			}
+			req.SetBody(body)
+		}
+		return c.Next()
+	}
+}
+
+func bodyTooLarge(c *fiber.Ctx, limit int) error {
+	c.Context().SetConnectionClose() // The rest of the body is not read
+	return c.Status(413).JSON(fiber.Map{"error": fmt.Sprintf("Request body exceeds the limit of %d bytes", limit)})
+}
+
+// isUploadPath reports whether path is a storage route receiving object
+// contents: /:project/storage/v1/object/..., upload/resumable/... or s3/...
+func isUploadPath(path string) bool {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 4)
+	if len(parts) < 4 || parts[1] != "storage" || parts[2] != "v1" {
+		return false
+	}
+	rest := parts[3]
+	return strings.HasPrefix(rest, "object/") || strings.HasPrefix(rest, "upload/resumable") ||
+		rest == "s3" || strings.HasPrefix(rest, "s3/")
+}
+
+// Setup configures Store from the environment: files are kept below
+// STORAGE_DIR (./data/storage by default) and transformed images below
+// STORAGE_TRANSFORM_CACHE (STORAGE_DIR/.transforms by default, see
+// transform.go for its size limit). It also starts removing expired
+// resumable uploads.
+func Setup() {
+	dir := os.Getenv("STORAGE_DIR")
+	if dir == "" {
+		dir = "./data/storage"
+	}
+	Store = NewLocalBackend(dir)
+
+	transformCacheDir = os.Getenv("STORAGE_TRANSFORM_CACHE")
+	if transformCacheDir == "" {
+		transformCacheDir = filepath.Join(dir, ".transforms")
+	}
+	transformCacheBytes = int64(envInt("STORAGE_TRANSFORM_CACHE_BYTES", 1<<30))
+	go sweepTransformCache()
+	go expireUploads()
+}
+
+// reservedBucketNames collide with the object routes
+var reservedBucketNames = map[string]bool{
+	"public": true, "list": true, "info": true, "move": true, "copy": true, "sign": true, "upload": true,
+}
+
+// isValidBucketName accepts lowercase names usable as a path segment
+func isValidBucketName(s string) bool {
+	if len(s) == 0 || len(s) > 63 || reservedBucketNames[s] {
+		return false
+	}
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '_' && r != '.' {
+			return false
+		}
+	}
+	return s != "." && s != ".."
+}
+
+// isValidObjectName accepts slash separated names without empty, "." or
+// ".." segments
+func isValidObjectName(s string) bool {
+	if len(s) == 0 || len(s) > 1024 {
+		return false
+	}
+	for _, r := range s {
+		if r < 0x20 || r == 0x7f || r == '\\' {
+			return false
+		}
+	}
+	for _, part := range strings.Split(s, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+func isValidIdentifier(s string) bool {
+	if len(s) == 0 || len(s) > 63 {
+		return false
+	}
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// objectKey is the backend key of an object
+func objectKey(project, bucket, name string) string {
+	return project + "/" + bucket + "/" + name
+}
+
+// deleteContents removes the contents of a deleted object and its
+// transformed variants
+func deleteContents(ctx context.Context, project, bucket, name string) error {
+	removeVariants(project, bucket, name)
+	return Store.Delete(ctx, objectKey(project, bucket, name))
+}
+
+// objectName returns the unescaped object name of a wildcard route
+func objectName(c *fiber.Ctx) (string, bool) {
+	name, err := url.PathUnescape(c.Params("*"))
+	if err != nil || !isValidObjectName(name) {
+		return "", false
+	}
+	return name, true
+}
+
+func claimsOf(c *fiber.Ctx) jwt.MapClaims {
+	claims, _ := c.Locals("claims").(jwt.MapClaims)
+	return claims
+}
+
+// ownerOf returns the project user a request acts as, nil for platform admins
+func ownerOf(c *fiber.Ctx) *string {
+	claims := claimsOf(c)
+	if role, _ := claims["role"].(string); role == "admin" {
+		return nil
+	}
+	if sub, ok := claims["sub"].(string); ok && sub != "" {
+		return &sub
+	}
+	return nil
+}
+
+// envInt reads an integer setting, falling back to def
+func envInt(name string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return n
+	}
+	return def
+}
@@ -0,0 +1,372 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	_ "image/gif"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Image transformations of downloads, e.g. a thumbnail:
+//
+//	GET /:project/storage/v1/object/public/photos/cat.jpg?width=200&height=200&fit=cover&format=jpeg&quality=70
+//
+//	width, height  target size in pixels (1-2500); with one of them the
+//	               aspect ratio is kept
+//	fit            cover (default: fill the box, cropping the overflow),
+//	               contain (fit inside the box) or fill (stretch)
+//	format         jpeg or png (default: jpeg for JPEG sources, png for
+//	               other images). WebP is read but cannot be written:
+//	               there is no pure Go encoder.
+//	quality        JPEG quality (1-100, default 80)
+//
+// JPEG, PNG, GIF (first frame) and WebP objects can be transformed; other
+// objects are served unchanged. Variants are cached on disk, keyed by the
+// object's ETag and the parameters, in a directory per object that is
+// removed when the object is replaced, moved or deleted. Since public
+// objects can be transformed by anyone, an object keeps at most
+// maxVariantsPerObject variants, the cache is trimmed to
+// STORAGE_TRANSFORM_CACHE_BYTES (1 GB by default) least recently used first,
+// and only renderSlots images are transformed at once.
+
+const (
+	maxTransformSize     = 2500
+	maxTransformPixels   = 40_000_000 // Source images above are rejected
+	maxTransformBytes    = 50 << 20
+	defaultQuality       = 80
+	maxVariantsPerObject = 10
+	renderWait           = 10 * time.Second // Queued longer, the request fails with 503
+)
+
+// transformCacheDir holds the transformed variants (see Setup)
+var transformCacheDir string
+
+var (
+	transformCacheBytes int64        // See Setup
+	transformCacheSize  atomic.Int64 // Approximate, corrected by each sweep
+	sweeping            atomic.Bool
+	renderSlots         = make(chan struct{}, runtime.NumCPU())
+)
+
+// errTransformBusy is returned when no render slot frees up in time
+var errTransformBusy = errors.New("too many image transformations in progress")
+
+var transformableTypes = map[string]bool{
+	"image/jpeg": true, "image/png": true, "image/gif": true, "image/webp": true,
+}
+
+type transformOptions struct {
+	Width, Height int
+	Fit           string
+	Format        string
+	Quality       int
+}
+
+// parseTransform reads the transformation parameters, nil without any
+func parseTransform(c *fiber.Ctx) (*transformOptions, error) {
+	q := c.Request().URI().QueryArgs()
+	if !q.Has("width") && !q.Has("height") && !q.Has("format") && !q.Has("quality") && !q.Has("fit") {
+		return nil, nil
+	}
+
+	opts := &transformOptions{Fit: c.Query("fit", "cover"), Format: c.Query("format"), Quality: defaultQuality}
+	size := func(name string) (int, error) {
+		if !q.Has(name) {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(c.Query(name))
+		if err != nil || n < 1 || n > maxTransformSize {
+			return 0, fmt.Errorf("%s must be between 1 and %d", name, maxTransformSize)
+		}
+		return n, nil
+	}
+	var err error
+	if opts.Width, err = size("width"); err != nil {
+		return nil, err
+	}
+	if opts.Height, err = size("height"); err != nil {
+		return nil, err
+	}
+	if q.Has("quality") {
+		opts.Quality, err = strconv.Atoi(c.Query("quality"))
+		if err != nil || opts.Quality < 1 || opts.Quality > 100 {
+			return nil, errors.New("quality must be between 1 and 100")
+		}
+	}
+
+	switch opts.Fit {
+	case "cover", "contain", "fill":
+	default:
+		return nil, errors.New("fit must be 'cover', 'contain' or 'fill'")
+	}
+	switch opts.Format {
+	case "", "jpeg", "png":
+	case "jpg":
+		opts.Format = "jpeg"
+	case "webp":
+		return nil, errors.New("webp output is not supported, use jpeg or png")
+	default:
+		return nil, errors.New("format must be 'jpeg' or 'png'")
+	}
+	return opts, nil
+}
+
+// outputFormat is the format of the variant of a sourceType object
+func (o *transformOptions) outputFormat(sourceType string) string {
+	if o.Format != "" {
+		return o.Format
+	}
+	if sourceType == "image/jpeg" {
+		return "jpeg"
+	}
+	return "png"
+}
+
+// variantKey identifies the variant of an object's contents
+func (o *transformOptions) variantKey(project string, obj *Object) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%s\x00%s\x00%d:%d:%s:%s:%d",
+		project, obj.BucketID, obj.Name, obj.ETag,
+		o.Width, o.Height, o.Fit, o.outputFormat(obj.MimeType), o.Quality)))
+	return hex.EncodeToString(sum[:])
+}
+
+// variantDir holds the variants of an object
+func variantDir(project, bucket, name string) string {
+	sum := sha256.Sum256([]byte(bucket + "/" + name))
+	return filepath.Join(transformCacheDir, project, hex.EncodeToString(sum[:]))
+}
+
+// removeVariants drops the cached variants of an object
+func removeVariants(project, bucket, name string) {
+	dir := variantDir(project, bucket, name)
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil {
+			transformCacheSize.Add(-info.Size())
+		}
+	}
+	os.RemoveAll(dir)
+}
+
+// transformedVariant returns the cached variant of an object, creating it
+// if needed
+func transformedVariant(ctx context.Context, project string, obj *Object, opts *transformOptions) (string, error) {
+	dir := variantDir(project, obj.BucketID, obj.Name)
+	path := filepath.Join(dir, opts.variantKey(project, obj))
+	if _, err := os.Stat(path); err == nil {
+		now := time.Now()
+		os.Chtimes(path, now, now) // The modification time records the last use
+		return path, nil
+	}
+
+	select {
+	case renderSlots <- struct{}{}:
+		defer func() { <-renderSlots }()
+	case <-time.After(renderWait):
+		return "", errTransformBusy
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	// Rendered by another request while waiting
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	rc, _, err := Store.Get(ctx, objectKey(project, obj.BucketID, obj.Name))
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	src, err := decodeImage(rc)
+	if err != nil {
+		return "", err
+	}
+	dst := resizeImage(src, opts)
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	evictVariants(dir, maxVariantsPerObject-1)
+	tmp, err := os.CreateTemp(dir, ".variant-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name()) // No-op after the rename
+
+	if opts.outputFormat(obj.MimeType) == "jpeg" {
+		err = jpeg.Encode(tmp, dst, &jpeg.Options{Quality: opts.Quality})
+	} else {
+		err = png.Encode(tmp, dst)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(tmp.Name()); err == nil {
+		if transformCacheSize.Add(info.Size()) > transformCacheBytes {
+			go sweepTransformCache()
+		}
+	}
+	return path, os.Rename(tmp.Name(), path)
+}
+
+// evictVariants removes the least recently used variants in dir beyond keep
+func evictVariants(dir string, keep int) {
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) <= keep {
+		return
+	}
+	files := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && !strings.HasPrefix(e.Name(), ".") {
+			files = append(files, info)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for len(files) > keep {
+		if os.Remove(filepath.Join(dir, files[0].Name())) == nil {
+			transformCacheSize.Add(-files[0].Size())
+		}
+		files = files[1:]
+	}
+}
+
+// sweepTransformCache measures the cache and, above transformCacheBytes,
+// removes the least recently used variants until it is 10% below
+func sweepTransformCache() {
+	if !sweeping.CompareAndSwap(false, true) {
+		return
+	}
+	defer sweeping.Store(false)
+
+	type variant struct {
+		path string
+		size int64
+		used time.Time
+	}
+	var variants []variant
+	var total int64
+	filepath.WalkDir(transformCacheDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			variants = append(variants, variant{path, info.Size(), info.ModTime()})
+			total += info.Size()
+		}
+		return nil
+	})
+
+	if total > transformCacheBytes {
+		sort.Slice(variants, func(i, j int) bool { return variants[i].used.Before(variants[j].used) })
+		for _, v := range variants {
+			if total <= transformCacheBytes*9/10 {
+				break
+			}
+			if os.Remove(v.path) == nil {
+				total -= v.size
+				os.Remove(filepath.Dir(v.path)) // Once its last variant is gone
+			}
+		}
+	}
+	transformCacheSize.Store(total)
+}
+
+// errImageTooLarge guards against decompression bombs
+var errImageTooLarge = errors.New("image too large to transform")
+
+func decodeImage(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxTransformBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxTransformBytes {
+		return nil, errImageTooLarge
+	}
+	// Check the dimensions before decoding
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxTransformPixels {
+		return nil, errImageTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// resizeImage scales src to the requested box. A side derived from the
+// aspect ratio is capped at maxTransformSize, shrinking the other one.
+func resizeImage(src image.Image, opts *transformOptions) image.Image {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	w, h := opts.Width, opts.Height
+	if sw == 0 || sh == 0 {
+		return src
+	}
+
+	switch {
+	case w == 0 && h == 0:
+		w, h = sw, sh
+	case w == 0:
+		w = max(1, sw*h/sh)
+		if w > maxTransformSize {
+			w, h = maxTransformSize, max(1, sh*maxTransformSize/sw)
+		}
+	case h == 0:
+		h = max(1, sh*w/sw)
+		if h > maxTransformSize {
+			w, h = max(1, sw*maxTransformSize/sh), maxTransformSize
+		}
+	}
+
+	srcRect := b
+	switch opts.Fit {
+	case "contain":
+		// Shrink the box to the source's aspect ratio
+		if sw*h > sh*w {
+			h = max(1, sh*w/sw)
+		} else {
+			w = max(1, sw*h/sh)
+		}
+	case "cover":
+		// Crop the source to the box's aspect ratio, centered
+		if sw*h > sh*w {
+			cw := sh * w / h
+			srcRect = image.Rect(b.Min.X+(sw-cw)/2, b.Min.Y, b.Min.X+(sw-cw)/2+cw, b.Max.Y)
+		} else {
+			ch := sw * h / w
+			srcRect = image.Rect(b.Min.X, b.Min.Y+(sh-ch)/2, b.Max.X, b.Min.Y+(sh-ch)/2+ch)
+		}
+	}
+
+	if w == sw && h == sh && srcRect == b {
+		return src
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, srcRect, draw.Src, nil)
+	return dst
+}
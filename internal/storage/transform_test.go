@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"image"
+	"testing"
+)
+
+func TestResizeImage(t *testing.T) {
+	tests := []struct {
+		name          string
+		srcW, srcH    int
+		width, height int
+		fit           string
+		wantW, wantH  int
+	}{
+		{"no size", 300, 200, 0, 0, "", 300, 200},
+		{"width only", 300, 200, 150, 0, "", 150, 100},
+		{"height only", 300, 200, 0, 50, "", 75, 50},
+		{"upscale", 100, 100, 200, 0, "", 200, 200},
+		{"fill", 300, 200, 100, 100, "fill", 100, 100},
+		{"cover", 300, 200, 100, 100, "cover", 100, 100},
+		{"contain wide", 300, 200, 100, 100, "contain", 100, 66},
+		{"contain tall", 200, 300, 100, 100, "contain", 66, 100},
+		{"tall source by width", 1, 10000, 2500, 0, "", 1, 2500},
+		{"wide source by height", 10000, 1, 0, 2500, "", 2500, 1},
+		{"tall source by width, cover", 20, 10000, 2500, 0, "cover", 5, 2500},
+		{"tall source by small width", 40, 40000, 100, 0, "", 2, 2500},
+		{"wide source by small height", 40000, 40, 0, 100, "", 2500, 2},
+		{"derived side rounds to zero", 10000, 1, 10, 0, "", 10, 1},
+		{"cover extreme ratio", 1, 10000, 2500, 2500, "cover", 2500, 2500},
+		{"contain extreme ratio", 1, 10000, 2500, 2500, "contain", 1, 2500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := image.NewGray(image.Rect(0, 0, tt.srcW, tt.srcH))
+			opts := &transformOptions{Width: tt.width, Height: tt.height, Fit: tt.fit}
+			b := resizeImage(src, opts).Bounds()
+			if b.Dx() != tt.wantW || b.Dy() != tt.wantH {
+				t.Errorf("resizeImage(%dx%d, %dx%d %s) = %dx%d, want %dx%d",
+					tt.srcW, tt.srcH, tt.width, tt.height, tt.fit, b.Dx(), b.Dy(), tt.wantW, tt.wantH)
+			}
+			if b.Dx() > maxTransformSize || b.Dy() > maxTransformSize {
+				t.Errorf("resizeImage result %dx%d exceeds %d", b.Dx(), b.Dy(), maxTransformSize)
+			}
+		})
+	}
+}
@@ -0,0 +1,490 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"baas/internal/db"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// tus 1.0 resumable uploads (https://tus.io/protocols/resumable-upload):
+//
+//	POST   /:project/storage/v1/upload/resumable       create (creation, creation-with-upload)
+//	HEAD   /:project/storage/v1/upload/resumable/:id   current offset
+//	PATCH  /:project/storage/v1/upload/resumable/:id   append a chunk
+//	DELETE /:project/storage/v1/upload/resumable/:id   abort (termination)
+//
+// The target is given in Upload-Metadata: bucketName, objectName and
+// optionally contentType and metadata (a JSON object). "x-upsert: true"
+// replaces an existing object. Access is checked like UploadObjectHandler
+// when the upload is created; uploads then belong to their creator. The
+// object appears once the last byte has been received. Chunks are bounded
+// by the request body limit (MaxUploadBytes), so clients must set a chunk
+// size below it.
+const tusVersion = "1.0.0"
+
+const tusExtensions = "creation,creation-with-upload,expiration,termination"
+
+// MaxResumableBytes caps the size of a resumable upload
+// (STORAGE_MAX_RESUMABLE_BYTES, 5 GB by default). Bucket file size limits
+// still apply.
+var MaxResumableBytes = int64(envInt("STORAGE_MAX_RESUMABLE_BYTES", 5<<30))
+
+// resumableExpiry is how long an upload may take
+// (STORAGE_RESUMABLE_EXPIRY seconds, one day by default)
+var resumableExpiry = time.Duration(envInt("STORAGE_RESUMABLE_EXPIRY", 24*60*60)) * time.Second
+
+// upload is a resumable upload in progress
+type upload struct {
+	ID        string
+	BucketID  string
+	Name      string
+	Owner     *string
+	Length    int64
+	MimeType  string
+	Metadata  json.RawMessage
+	Upsert    bool
+	ExpiresAt time.Time
+}
+
+const uploadColumns = "id, bucket_id, name, owner::text, upload_length, mime_type, metadata, upsert, expires_at"
+
+// getUpload loads an upload, nil if it does not exist. lock holds the row
+// until tx ends, serializing the chunks of an upload.
+func getUpload(ctx context.Context, tx pgx.Tx, project, id string, lock bool) (*upload, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s.storage_uploads WHERE id::text = $1", uploadColumns, project)
+	if lock {
+		query += " FOR UPDATE"
+	}
+	var u upload
+	err := tx.QueryRow(ctx, query, id).Scan(&u.ID, &u.BucketID, &u.Name, &u.Owner, &u.Length, &u.MimeType, &u.Metadata, &u.Upsert, &u.ExpiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return &u, err
+}
+
+// ownedBy reports whether the request may continue the upload
+func (u *upload) ownedBy(c *fiber.Ctx) bool {
+	if u.Owner == nil {
+		return isAdmin(claimsOf(c))
+	}
+	owner := ownerOf(c)
+	return owner != nil && *owner == *u.Owner
+}
+
+// resumableLimit is the largest resumable upload a bucket accepts
+func (b *Bucket) resumableLimit() int64 {
+	if b.FileSizeLimit != nil && *b.FileSizeLimit < MaxResumableBytes {
+		return *b.FileSizeLimit
+	}
+	return MaxResumableBytes
+}
+
+func tusHeaders(c *fiber.Ctx) {
+	c.Set("Tus-Resumable", tusVersion)
+	c.Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length, Upload-Expires")
+}
+
+// tusSupported reports whether a request uses the supported protocol version
+func tusSupported(c *fiber.Ctx) bool {
+	tusHeaders(c)
+	if c.Get("Tus-Resumable") != tusVersion {
+		c.Set("Tus-Version", tusVersion)
+		return false
+	}
+	return true
+}
+
+func errUnsupportedTus(c *fiber.Ctx) error {
+	return c.Status(412).JSON(fiber.Map{"error": "Unsupported tus version"})
+}
+
+// errNoPartials answers requests when the backend cannot resume uploads
+func errNoPartials(c *fiber.Ctx) error {
+	return c.Status(501).JSON(fiber.Map{"error": "Resumable uploads are not supported by the storage backend"})
+}
+
+// parseUploadMetadata decodes "key base64value,key2 base64value2"
+func parseUploadMetadata(header string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %q", key)
+		}
+		values[key] = string(value)
+	}
+	return values, nil
+}
+
+// TusOptionsHandler advertises the supported protocol
+func TusOptionsHandler(c *fiber.Ctx) error {
+	tusHeaders(c)
+	c.Set("Tus-Version", tusVersion)
+	c.Set("Tus-Extension", tusExtensions)
+	c.Set("Tus-Max-Size", strconv.FormatInt(MaxResumableBytes, 10))
+	return c.SendStatus(204)
+}
+
+// TusCreateHandler starts a resumable upload
+func TusCreateHandler(c *fiber.Ctx) error {
+	if !tusSupported(c) {
+		return errUnsupportedTus(c)
+	}
+	pb, ok := Store.(PartialBackend)
+	if !ok {
+		return errNoPartials(c)
+	}
+	project := c.Params("project")
+	if !isValidIdentifier(project) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+
+	if c.Get("Upload-Defer-Length") != "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Upload-Defer-Length is not supported"})
+	}
+	length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Upload-Length is required"})
+	}
+	meta, err := parseUploadMetadata(c.Get("Upload-Metadata"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	name := meta["objectName"]
+	if !isValidObjectName(name) {
+		return c.Status(400).JSON(fiber.Map{"error": "Upload-Metadata needs a valid objectName"})
+	}
+	mimeType := meta["contentType"]
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	metadata := json.RawMessage(meta["metadata"])
+	if len(metadata) == 0 {
+		metadata = json.RawMessage("{}")
+	}
+	var m map[string]interface{}
+	if json.Unmarshal(metadata, &m) != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "metadata must be a JSON object"})
+	}
+	upsert := c.Get("x-upsert") == "true"
+
+	ctx := context.Background()
+	bucket, err := getBucket(ctx, project, meta["bucketName"])
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch bucket"})
+	}
+	if bucket == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Bucket not found"})
+	}
+	if length > bucket.resumableLimit() {
+		c.Set("Tus-Max-Size", strconv.FormatInt(bucket.resumableLimit(), 10))
+		return c.Status(413).JSON(fiber.Map{"error": fmt.Sprintf("Object exceeds the size limit of %d bytes", bucket.resumableLimit())})
+	}
+	if !bucket.allowsMimeType(mimeType) {
+		return c.Status(415).JSON(fiber.Map{"error": "Content type not allowed in this bucket: " + mimeType})
+	}
+
+	existing, err := getObject(ctx, project, bucket.ID, name)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch object"})
+	}
+	if existing != nil && !upsert {
+		return c.Status(409).JSON(fiber.Map{"error": "Object already exists"})
+	}
+	owner := ownerOf(c)
+	if existing != nil {
+		err = authorize(ctx, project, OpUpdate, claimsOf(c), existing)
+	} else {
+		err = authorize(ctx, project, OpInsert, claimsOf(c), &Object{BucketID: bucket.ID, Name: name, Owner: owner, Size: length, MimeType: mimeType, Metadata: metadata})
+	}
+	if err != nil {
+		return authorizeError(c, err)
+	}
+
+	// The upload may only replace the object the policies were checked
+	// against; one created before it completes is a conflict
+	u := &upload{BucketID: bucket.ID, Name: name, Owner: owner, Length: length, MimeType: mimeType, Metadata: metadata, Upsert: upsert && existing != nil}
+	query := fmt.Sprintf(`
+		INSERT INTO %s.storage_uploads (bucket_id, name, owner, upload_length, mime_type, metadata, upsert, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW() + $8 * INTERVAL '1 second')
+		RETURNING id, expires_at`, project)
+	err = db.Pool.QueryRow(ctx, query, u.BucketID, u.Name, u.Owner, u.Length, u.MimeType, u.Metadata, u.Upsert, int64(resumableExpiry/time.Second)).Scan(&u.ID, &u.ExpiresAt)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not create upload"})
+	}
+	if err := pb.CreatePart(ctx, u.ID); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not create upload"})
+	}
+
+	c.Set("Location", fmt.Sprintf("/%s/storage/v1/upload/resumable/%s", project, u.ID))
+	c.Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+
+	// creation-with-upload: the first chunk can come with the request
+	if c.Get("Content-Type") == "application/offset+octet-stream" && len(c.Body()) > 0 {
+		return appendChunk(c, pb, project, u.ID, 0, 201)
+	}
+	c.Set("Upload-Offset", "0")
+	if length == 0 {
+		return appendChunk(c, pb, project, u.ID, 0, 201)
+	}
+	return c.SendStatus(201)
+}
+
+// TusHeadHandler reports the offset of an upload
+func TusHeadHandler(c *fiber.Ctx) error {
+	if !tusSupported(c) {
+		return errUnsupportedTus(c)
+	}
+	pb, ok := Store.(PartialBackend)
+	if !ok {
+		return errNoPartials(c)
+	}
+	project := c.Params("project")
+	if !isValidIdentifier(project) {
+		return c.SendStatus(400)
+	}
+
+	ctx := context.Background()
+	var u *upload
+	err := pgx.BeginFunc(ctx, db.Pool, func(tx pgx.Tx) (err error) {
+		u, err = getUpload(ctx, tx, project, c.Params("id"), false)
+		return err
+	})
+	if err != nil {
+		return c.SendStatus(500)
+	}
+	if u == nil || !u.ownedBy(c) {
+		return c.SendStatus(404)
+	}
+	if time.Now().After(u.ExpiresAt) {
+		return c.SendStatus(410)
+	}
+	offset, err := pb.PartSize(ctx, u.ID)
+	if err != nil {
+		return c.SendStatus(404)
+	}
+
+	c.Set("Cache-Control", "no-store")
+	c.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	c.Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	return c.SendStatus(200)
+}
+
+// TusPatchHandler appends a chunk to an upload
+func TusPatchHandler(c *fiber.Ctx) error {
+	if !tusSupported(c) {
+		return errUnsupportedTus(c)
+	}
+	pb, ok := Store.(PartialBackend)
+	if !ok {
+		return errNoPartials(c)
+	}
+	project := c.Params("project")
+	if !isValidIdentifier(project) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+	if c.Get("Content-Type") != "application/offset+octet-stream" {
+		return c.Status(415).JSON(fiber.Map{"error": "Content-Type must be application/offset+octet-stream"})
+	}
+	offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Upload-Offset is required"})
+	}
+	return appendChunk(c, pb, project, c.Params("id"), offset, 204)
+}
+
+// appendChunk writes the request body to an upload at offset and, once
+// every byte has been received, stores the object
+func appendChunk(c *fiber.Ctx, pb PartialBackend, project, id string, offset int64, status int) error {
+	ctx := context.Background()
+	body := c.Body()
+
+	var u *upload
+	var newOffset int64
+	var obj *Object
+	failStatus, failMessage := 0, "" // Answered after the transaction
+	err := pgx.BeginFunc(ctx, db.Pool, func(tx pgx.Tx) error {
+		var err error
+		u, err = getUpload(ctx, tx, project, id, true)
+		if err != nil {
+			return err
+		}
+		if u == nil || !u.ownedBy(c) {
+			failStatus, failMessage = 404, "Upload not found"
+			return nil
+		}
+		if time.Now().After(u.ExpiresAt) {
+			failStatus, failMessage = 410, "Upload expired"
+			return nil
+		}
+		if offset+int64(len(body)) > u.Length {
+			failStatus, failMessage = 413, "Chunk exceeds Upload-Length"
+			return nil
+		}
+
+		newOffset, err = pb.AppendPart(ctx, u.ID, offset, bytes.NewReader(body))
+		if errors.Is(err, errOffsetMismatch) {
+			c.Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+			failStatus, failMessage = 409, "Upload-Offset does not match the upload"
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if newOffset < u.Length {
+			return nil
+		}
+
+		obj, err = finishUpload(ctx, tx, pb, project, u)
+		if errors.Is(err, errObjectExists) {
+			failStatus, failMessage = 409, "Object already exists"
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not store upload"})
+	}
+	if failStatus != 0 {
+		return c.Status(failStatus).JSON(fiber.Map{"error": failMessage})
+	}
+
+	c.Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	c.Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	if obj != nil && status != 204 {
+		return c.Status(status).JSON(obj)
+	}
+	return c.SendStatus(status)
+}
+
+// finishUpload turns a complete upload into an object. Like commitObject,
+// the contents only replace an existing object once the metadata is saved
+// (in tx, which keeps the object's row locked).
+func finishUpload(ctx context.Context, tx pgx.Tx, pb PartialBackend, project string, u *upload) (*Object, error) {
+	staged := stagingKey(project)
+	stat, err := pb.CompletePart(ctx, u.ID, staged)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := saveObject(ctx, tx, project, &Object{
+		BucketID: u.BucketID,
+		Name:     u.Name,
+		Owner:    u.Owner,
+		Size:     stat.Size,
+		MimeType: u.MimeType,
+		ETag:     stat.ETag,
+		Metadata: u.Metadata,
+	}, u.Upsert)
+	if err == nil {
+		err = Store.Move(ctx, staged, objectKey(project, u.BucketID, u.Name))
+	}
+	if err != nil {
+		Store.Delete(ctx, staged)
+		return nil, err
+	}
+	removeVariants(project, u.BucketID, u.Name)
+	_, err = tx.Exec(ctx, fmt.Sprintf("DELETE FROM %s.storage_uploads WHERE id = $1", project), u.ID)
+	return obj, err
+}
+
+// TusDeleteHandler aborts an upload
+func TusDeleteHandler(c *fiber.Ctx) error {
+	if !tusSupported(c) {
+		return errUnsupportedTus(c)
+	}
+	pb, ok := Store.(PartialBackend)
+	if !ok {
+		return errNoPartials(c)
+	}
+	project := c.Params("project")
+	if !isValidIdentifier(project) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid project"})
+	}
+
+	ctx := context.Background()
+	found := false
+	err := pgx.BeginFunc(ctx, db.Pool, func(tx pgx.Tx) error {
+		u, err := getUpload(ctx, tx, project, c.Params("id"), true)
+		if err != nil || u == nil || !u.ownedBy(c) {
+			return err
+		}
+		found = true
+		if _, err := tx.Exec(ctx, fmt.Sprintf("DELETE FROM %s.storage_uploads WHERE id = $1", project), u.ID); err != nil {
+			return err
+		}
+		return pb.DeletePart(ctx, u.ID)
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Could not delete upload"})
+	}
+	if !found {
+		return c.Status(404).JSON(fiber.Map{"error": "Upload not found"})
+	}
+	return c.SendStatus(204)
+}
+
+// expireUploads periodically removes the expired resumable and multipart
+// uploads of every project
+func expireUploads() {
+	for range time.Tick(time.Hour) {
+		pb, hasPartials := Store.(PartialBackend)
+		ctx := context.Background()
+		rows, err := db.Pool.Query(ctx, "SELECT slug FROM baas_system.projects")
+		if err != nil {
+			log.Printf("Could not list projects for upload expiry: %v", err)
+			continue
+		}
+		projects, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			continue
+		}
+
+		for _, project := range projects {
+			if !isValidIdentifier(project) {
+				continue
+			}
+			query := fmt.Sprintf("DELETE FROM %s.storage_uploads WHERE expires_at < NOW() RETURNING id::text", project)
+			rows, err := db.Pool.Query(ctx, query)
+			if err != nil {
+				continue
+			}
+			ids, _ := pgx.CollectRows(rows, pgx.RowTo[string])
+			for _, id := range ids {
+				if hasPartials {
+					pb.DeletePart(ctx, id)
+				}
+			}
+
+			// Abandoned S3 multipart uploads expire the same way
+			query = fmt.Sprintf("SELECT id::text FROM %s.storage_multipart_uploads WHERE created_at < NOW() - $1 * INTERVAL '1 second'", project)
+			rows, err = db.Pool.Query(ctx, query, int64(resumableExpiry/time.Second))
+			if err != nil {
+				continue
+			}
+			ids, _ = pgx.CollectRows(rows, pgx.RowTo[string])
+			for _, id := range ids {
+				deleteMultipart(ctx, project, id)
+			}
+		}
+	}
+}
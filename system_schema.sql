@@ -9,6 +9,8 @@ CREATE TABLE IF NOT EXISTS baas_system.projects (
     db_schema TEXT NOT NULL UNIQUE, -- The PostgreSQL schema name for this project
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
+-- Password of the project's login role (see db.ProjectRole), used by the SQL editor
+ALTER TABLE baas_system.projects ADD COLUMN IF NOT EXISTS db_password TEXT;
 
 -- Users table: Platform admins/users (who manage projects)
 CREATE TABLE IF NOT EXISTS baas_system.users (
@@ -25,3 +27,116 @@ CREATE TABLE IF NOT EXISTS baas_system.project_members (
     role TEXT DEFAULT 'owner',
     PRIMARY KEY (project_id, user_id)
 );
+
+-- Auth settings: Per-project signup and password policies
+CREATE TABLE IF NOT EXISTS baas_system.auth_settings (
+    project_id UUID PRIMARY KEY REFERENCES baas_system.projects(id) ON DELETE CASCADE,
+    disable_signup BOOLEAN NOT NULL DEFAULT FALSE, -- Invite-only: users are created by admins
+    enable_anonymous_signin BOOLEAN NOT NULL DEFAULT FALSE,
+    require_email_confirmation BOOLEAN NOT NULL DEFAULT FALSE,
+    password_min_length INT NOT NULL DEFAULT 6,
+    password_require_lowercase BOOLEAN NOT NULL DEFAULT FALSE,
+    password_require_uppercase BOOLEAN NOT NULL DEFAULT FALSE,
+    password_require_digit BOOLEAN NOT NULL DEFAULT FALSE,
+    password_require_symbol BOOLEAN NOT NULL DEFAULT FALSE,
+    check_breached_passwords BOOLEAN NOT NULL DEFAULT FALSE, -- Uses BREACHED_PASSWORDS_DIR
+    email_allow_domains TEXT[] NOT NULL DEFAULT '{}', -- Empty means any domain
+    email_deny_domains TEXT[] NOT NULL DEFAULT '{}',
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+ALTER TABLE baas_system.auth_settings ADD COLUMN IF NOT EXISTS enable_anonymous_signin BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Auth hooks: Project-defined webhooks / SQL functions run during auth flows
+CREATE TABLE IF NOT EXISTS baas_system.auth_hooks (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    project_id UUID NOT NULL REFERENCES baas_system.projects(id) ON DELETE CASCADE,
+    hook_point TEXT NOT NULL CHECK (hook_point IN ('before_signup', 'after_signin')),
+    type TEXT NOT NULL CHECK (type IN ('http', 'sql')),
+    target TEXT NOT NULL, -- URL for 'http', function name in the project schema for 'sql'
+    secret TEXT, -- HMAC key used to sign webhook requests
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Realtime channel rules: Project functions deciding who may join / broadcast on channels
+CREATE TABLE IF NOT EXISTS baas_system.realtime_channel_rules (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    project_id UUID NOT NULL REFERENCES baas_system.projects(id) ON DELETE CASCADE,
+    pattern TEXT NOT NULL, -- Channel name, or prefix ending with '*'
+    action TEXT NOT NULL CHECK (action IN ('join', 'broadcast')),
+    check_function TEXT NOT NULL, -- fn(channel text, action text) RETURNS boolean in the project schema
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Storage access policies: SQL conditions on object metadata granting project users access
+CREATE TABLE IF NOT EXISTS baas_system.storage_policies (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    project_id UUID NOT NULL REFERENCES baas_system.projects(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    bucket_id TEXT, -- NULL applies to every bucket
+    operation TEXT NOT NULL CHECK (operation IN ('select', 'insert', 'update', 'delete')),
+    definition TEXT NOT NULL, -- Boolean SQL expression over the object's columns
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE (project_id, name)
+);
+
+-- Storage S3 access keys: credentials for the S3-compatible API (SigV4 needs the secret)
+CREATE TABLE IF NOT EXISTS baas_system.storage_access_keys (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    project_id UUID NOT NULL REFERENCES baas_system.projects(id) ON DELETE CASCADE,
+    access_key_id TEXT UNIQUE NOT NULL,
+    secret_access_key TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Parent of the per-project roles tenant requests run as (see db.TenantRole), so
+-- RLS policies can be written TO authenticated. It is granted nothing itself.
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'authenticated') THEN
+        CREATE ROLE authenticated NOLOGIN;
+    END IF;
+    EXECUTE format('GRANT authenticated TO %I', current_user);
+END
+$$;
+
+-- Key realtime NOTIFY payloads are signed with (see realtime.verifyNotification),
+-- so database roles that can NOTIFY (e.g. project roles) cannot forge events.
+-- ipad and opad are the zero-padded key XOR the HMAC-SHA256 pads.
+CREATE TABLE IF NOT EXISTS baas_system.realtime_signing_key (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id), -- Single row
+    key BYTEA NOT NULL,
+    ipad BYTEA NOT NULL,
+    opad BYTEA NOT NULL
+);
+DO $$
+DECLARE
+    k BYTEA := uuid_send(gen_random_uuid()) || uuid_send(gen_random_uuid());
+    padded BYTEA;
+    ipad BYTEA;
+    opad BYTEA;
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM baas_system.realtime_signing_key) THEN
+        padded := k || decode(repeat('00', 32), 'hex');
+        ipad := padded;
+        opad := padded;
+        FOR i IN 0..63 LOOP
+            ipad := set_byte(ipad, i, get_byte(padded, i) # 54);
+            opad := set_byte(opad, i, get_byte(padded, i) # 92);
+        END LOOP;
+        INSERT INTO baas_system.realtime_signing_key (key, ipad, opad) VALUES (k, ipad, opad);
+    END IF;
+END
+$$;
+
+-- Publication consumed by the logical replication realtime source
+-- (REALTIME_SOURCE=replication). Tables are added when realtime is enabled for them.
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = 'hanbase_realtime') THEN
+        CREATE PUBLICATION hanbase_realtime;
+    END IF;
+END
+$$;